@@ -24,6 +24,310 @@ type Expression interface {
 	expressionNode()
 }
 
+// LineOf returns the source line where node starts, or 0 when the node has no
+// position information (e.g. ASTs built by hand in tests).
+func LineOf(node Node) int {
+	return startToken(node).Line
+}
+
+// ColumnOf returns the source column where node starts, or 0 when the node
+// has no position information.
+func ColumnOf(node Node) int {
+	return startToken(node).Column
+}
+
+// startToken returns the first token of node, whose position is the node's.
+func startToken(node Node) token.Token {
+	switch n := node.(type) {
+	case *LetStatement:
+		return n.Token
+	case *ConstStatement:
+		return n.Token
+	case *ReturnStatement:
+		return n.Token
+	case *ExpressionStatement:
+		return n.Token
+	case *BlockStatement:
+		return n.Token
+	case *TypeDefinition:
+		return n.Token
+	case *UseStatement:
+		return n.Token
+	case *CompoundAssignStatement:
+		return n.Token
+	case *BreakStatement:
+		return n.Token
+	case *ContinueStatement:
+		return n.Token
+	case *SwitchStatement:
+		return n.Token
+	case *FallthroughStatement:
+		return n.Token
+	case *Identifier:
+		return n.Token
+	case *IntegerLiteral:
+		return n.Token
+	case *FloatLiteral:
+		return n.Token
+	case *StringLiteral:
+		return n.Token
+	case *ListLiteral:
+		return n.Token
+	case *MapLiteral:
+		return n.Token
+	case *FunctionLiteral:
+		return n.Token
+	case *CallExpression:
+		if n.Function != nil {
+			return startToken(n.Function)
+		}
+		return n.Token
+	case *InfixExpression:
+		if n.Left != nil {
+			return startToken(n.Left)
+		}
+		return n.Token
+	case *MemberAccessExpression:
+		if n.Object != nil {
+			return startToken(n.Object)
+		}
+		return n.Token
+	case *IndexExpression:
+		if n.Left != nil {
+			return startToken(n.Left)
+		}
+		return n.Token
+	case *SliceExpression:
+		if n.Left != nil {
+			return startToken(n.Left)
+		}
+		return n.Token
+	case *TryExpression:
+		return n.Token
+	case *CastExpression:
+		if n.Value != nil {
+			return startToken(n.Value)
+		}
+		return n.Token
+	}
+	return token.Token{}
+}
+
+// ListElementType returns T for a list type annotation `[T]`.
+func ListElementType(typeName string) (string, bool) {
+	if _, _, ok := ArrayType(typeName); ok {
+		return "", false
+	}
+	if len(typeName) > 2 && strings.HasPrefix(typeName, "[") && strings.HasSuffix(typeName, "]") {
+		return typeName[1 : len(typeName)-1], true
+	}
+	return "", false
+}
+
+// ArrayType returns T and N for a fixed-size array type annotation `[T; N]`,
+// where N is an integer or the name of a constant.
+func ArrayType(typeName string) (string, string, bool) {
+	if !strings.HasPrefix(typeName, "[") || !strings.HasSuffix(typeName, "]") {
+		return "", "", false
+	}
+	inner := typeName[1 : len(typeName)-1]
+	i := strings.LastIndex(inner, "; ")
+	if i <= 0 || strings.ContainsAny(inner[i+2:], "[]") {
+		return "", "", false
+	}
+	return inner[:i], inner[i+2:], true
+}
+
+// MapElementTypes returns K and V for a map type annotation `{K: V}`.
+func MapElementTypes(typeName string) (string, string, bool) {
+	if !strings.HasPrefix(typeName, "{") || !strings.HasSuffix(typeName, "}") {
+		return "", "", false
+	}
+	key, value, ok := strings.Cut(typeName[1:len(typeName)-1], ": ")
+	if !ok || key == "" || value == "" {
+		return "", "", false
+	}
+	return key, value, true
+}
+
+// InferStructType returns the name of the struct type defined in typeDefs
+// whose field names are exactly the keys of ml, so that an unannotated map
+// literal such as {"id": 1, "name": "A"} can be taken as a User. It returns
+// "" when no type or more than one type matches.
+func InferStructType(ml *MapLiteral, typeDefs map[string]*TypeDefinition) string {
+	keys := map[string]bool{}
+	for k := range ml.Pairs {
+		switch key := k.(type) {
+		case *StringLiteral:
+			keys[key.Value] = true
+		case *Identifier:
+			keys[key.Value] = true
+		default:
+			return ""
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	match := ""
+	for name, td := range typeDefs {
+		if td.Alias != "" || len(td.Fields) != len(keys) {
+			continue
+		}
+		all := true
+		for _, f := range td.Fields {
+			if !keys[f.Name] {
+				all = false
+				break
+			}
+		}
+		if !all {
+			continue
+		}
+		if match != "" {
+			return ""
+		}
+		match = name
+	}
+	return match
+}
+
+// Inspect calls visit for every statement and expression in stmts, at any
+// depth: function bodies, switch cases and the operands of every
+// expression are visited too, parents before their children.
+func Inspect(stmts []Statement, visit func(Node)) {
+	var walkStmts func(stmts []Statement)
+	var walk func(expr Expression)
+	walk = func(expr Expression) {
+		if expr == nil {
+			return
+		}
+		visit(expr)
+		switch e := expr.(type) {
+		case *IndexExpression:
+			walk(e.Left)
+			walk(e.Index)
+		case *SliceExpression:
+			walk(e.Left)
+			walk(e.Start)
+			walk(e.End)
+		case *CallExpression:
+			walk(e.Function)
+			for _, a := range e.Arguments {
+				walk(a)
+			}
+		case *InfixExpression:
+			walk(e.Left)
+			walk(e.Right)
+		case *MemberAccessExpression:
+			walk(e.Object)
+		case *ListLiteral:
+			for _, el := range e.Elements {
+				walk(el)
+			}
+		case *MapLiteral:
+			for k, v := range e.Pairs {
+				walk(k)
+				walk(v)
+			}
+		case *TryExpression:
+			walk(e.Call)
+		case *CastExpression:
+			walk(e.Value)
+		case *FunctionLiteral:
+			for _, d := range e.Defaults {
+				walk(d)
+			}
+			if e.Body != nil {
+				walkStmts(e.Body.Statements)
+			}
+		}
+	}
+	walkStmts = func(stmts []Statement) {
+		for _, stmt := range stmts {
+			visit(stmt)
+			switch s := stmt.(type) {
+			case *LetStatement:
+				walk(s.Value)
+			case *ConstStatement:
+				walk(s.Value)
+			case *ReturnStatement:
+				walk(s.ReturnValue)
+			case *CompoundAssignStatement:
+				walk(s.Value)
+			case *ExpressionStatement:
+				walk(s.Expression)
+				walk(s.Guard)
+			case *BlockStatement:
+				walkStmts(s.Statements)
+			case *SwitchStatement:
+				walk(s.Value)
+				cases := s.Cases
+				if s.Default != nil {
+					cases = append(cases[:len(cases):len(cases)], s.Default)
+				}
+				for _, c := range cases {
+					for _, v := range c.Values {
+						walk(v)
+					}
+					walkStmts(c.Body)
+				}
+			}
+		}
+	}
+	walkStmts(stmts)
+}
+
+// MapNames returns the names that stmts use as a map, at any depth: indexed
+// or sliced as in x["id"] or x[1:], searched with `k in x` or measured with
+// len(x). A name copied into one of those, as in `let v = x`, is used as a
+// map too. A map literal assigned to such a name stays a map even when its
+// keys match a type, see InferStructType.
+func MapNames(stmts []Statement) map[string]bool {
+	names := map[string]bool{}
+	// copies maps each name to the names whose value was copied into it
+	copies := map[string][]string{}
+	mark := func(expr Expression) {
+		if id, ok := expr.(*Identifier); ok {
+			names[id.Value] = true
+		}
+	}
+	Inspect(stmts, func(n Node) {
+		switch e := n.(type) {
+		case *IndexExpression:
+			mark(e.Left)
+		case *SliceExpression:
+			mark(e.Left)
+		case *InfixExpression:
+			if e.Operator == "in" {
+				mark(e.Right)
+			}
+		case *CallExpression:
+			if fn, ok := e.Function.(*Identifier); ok && fn.Value == "len" && len(e.Arguments) == 1 {
+				mark(e.Arguments[0])
+			}
+		case *LetStatement:
+			if id, ok := e.Value.(*Identifier); ok {
+				copies[e.Name.Value] = append(copies[e.Name.Value], id.Value)
+			}
+		}
+	})
+	for changed := true; changed; {
+		changed = false
+		for name, sources := range copies {
+			if !names[name] {
+				continue
+			}
+			for _, src := range sources {
+				if !names[src] {
+					names[src], changed = true, true
+				}
+			}
+		}
+	}
+	return names
+}
+
 // Program is the root node of every AST our parser produces.
 type Program struct {
 	Statements []Statement
@@ -37,12 +341,13 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+// String renders the program as source, one statement per line.
 func (p *Program) String() string {
-	var out bytes.Buffer
+	lines := []string{}
 	for _, s := range p.Statements {
-		out.WriteString(s.String())
+		lines = append(lines, s.String())
 	}
-	return out.String()
+	return strings.Join(lines, "\n")
 }
 
 // LetStatement represents a 'let' statement, e.g., `let x = 5;`
@@ -51,6 +356,9 @@ type LetStatement struct {
 	Name     *Identifier
 	Value    Expression
 	TypeName string
+	// Names lists every name of a multi-name let such as
+	// `let val, ok = m["key"]`, with Name being the first; nil otherwise
+	Names []*Identifier
 }
 
 func (ls *LetStatement) statementNode()       {}
@@ -58,7 +366,18 @@ func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString(ls.TokenLiteral() + " ")
-	out.WriteString(ls.Name.String())
+	if len(ls.Names) > 0 {
+		names := []string{}
+		for _, n := range ls.Names {
+			names = append(names, n.String())
+		}
+		out.WriteString(strings.Join(names, ", "))
+	} else {
+		out.WriteString(ls.Name.String())
+	}
+	if ls.TypeName != "" {
+		out.WriteString(": " + ls.TypeName)
+	}
 	out.WriteString(" = ")
 	if ls.Value != nil {
 		out.WriteString(ls.Value.String())
@@ -80,6 +399,9 @@ func (cs *ConstStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString(cs.TokenLiteral() + " ")
 	out.WriteString(cs.Name.String())
+	if cs.TypeName != "" {
+		out.WriteString(": " + cs.TypeName)
+	}
 	out.WriteString(" = ")
 	if cs.Value != nil {
 		out.WriteString(cs.Value.String())
@@ -96,14 +418,56 @@ type ReturnStatement struct {
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
 func (rs *ReturnStatement) String() string {
-	var out bytes.Buffer
-	out.WriteString(rs.TokenLiteral() + " ")
-	if rs.ReturnValue != nil {
-		out.WriteString(rs.ReturnValue.String())
+	if rs.ReturnValue == nil {
+		return rs.TokenLiteral()
 	}
-	return out.String()
+	return rs.TokenLiteral() + " " + rs.ReturnValue.String()
 }
 
+// UseStatement imports a Go package into the generated code, e.g., `use "net/url"`
+type UseStatement struct {
+	Token token.Token // the 'use' token
+	Path  string      // Go import path
+}
+
+func (us *UseStatement) statementNode()       {}
+func (us *UseStatement) TokenLiteral() string { return us.Token.Literal }
+func (us *UseStatement) String() string       { return us.TokenLiteral() + " \"" + us.Path + "\"" }
+
+// CompoundAssignStatement represents an update of a variable with an
+// arithmetic operator, e.g., `i += 1`
+type CompoundAssignStatement struct {
+	Token    token.Token // the variable's token
+	Name     *Identifier
+	Operator string // "+=", "-=" or "*="
+	Value    Expression
+}
+
+func (cs *CompoundAssignStatement) statementNode()       {}
+func (cs *CompoundAssignStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *CompoundAssignStatement) String() string {
+	return cs.Name.String() + " " + cs.Operator + " " + cs.Value.String()
+}
+
+// BreakStatement represents a 'break' statement that leaves the innermost loop.
+type BreakStatement struct {
+	Token token.Token // the 'break' token
+}
+
+func (bs *BreakStatement) statementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) String() string       { return bs.Token.Literal }
+
+// ContinueStatement represents a 'continue' statement that starts the next
+// iteration of the innermost loop.
+type ContinueStatement struct {
+	Token token.Token // the 'continue' token
+}
+
+func (cs *ContinueStatement) statementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) String() string       { return cs.Token.Literal }
+
 // Identifier represents an identifier (variable name).
 type Identifier struct {
 	Token token.Token // the token.IDENT token
@@ -124,6 +488,74 @@ func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
+// FloatLiteral represents a floating point value such as 2.5, .5 or 1.5e10.
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
+
+// SwitchStatement represents `switch value { case 1, 2: ... default: ... }`.
+// As in Go, a case ends without running the next one unless its last
+// statement is fallthrough.
+type SwitchStatement struct {
+	Token token.Token // the 'switch' token
+	Value Expression
+	Cases []*SwitchCase
+	// Default is the default case, which comes last; nil when there is none
+	Default *SwitchCase
+}
+
+// SwitchCase is one case of a switch: the values it matches and the
+// statements it runs. The default case has no values.
+type SwitchCase struct {
+	Token  token.Token // the 'case' or 'default' token
+	Values []Expression
+	Body   []Statement
+}
+
+func (ss *SwitchStatement) statementNode()       {}
+func (ss *SwitchStatement) TokenLiteral() string { return ss.Token.Literal }
+func (ss *SwitchStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("switch " + ss.Value.String() + " {\n")
+	cases := ss.Cases
+	if ss.Default != nil {
+		cases = append(cases[:len(cases):len(cases)], ss.Default)
+	}
+	for _, c := range cases {
+		if len(c.Values) == 0 {
+			out.WriteString("default:\n")
+		} else {
+			values := []string{}
+			for _, v := range c.Values {
+				values = append(values, v.String())
+			}
+			out.WriteString("case " + strings.Join(values, ", ") + ":\n")
+		}
+		for _, s := range c.Body {
+			for _, line := range strings.Split(s.String(), "\n") {
+				out.WriteString("\t" + line + "\n")
+			}
+		}
+	}
+	out.WriteString("}")
+	return out.String()
+}
+
+// FallthroughStatement represents 'fallthrough', which ends a switch case by
+// running the next one.
+type FallthroughStatement struct {
+	Token token.Token // the 'fallthrough' token
+}
+
+func (fs *FallthroughStatement) statementNode()       {}
+func (fs *FallthroughStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *FallthroughStatement) String() string       { return fs.Token.Literal }
+
 // BlockStatement represents a block of statements, e.g., `{ ... }`
 type BlockStatement struct {
 	Token      token.Token // the { token
@@ -133,12 +565,18 @@ type BlockStatement struct {
 func (bs *BlockStatement) statementNode()       {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
 func (bs *BlockStatement) String() string {
+	if len(bs.Statements) == 0 {
+		return "{}"
+	}
+	// one statement per line, indented by a tab; nested blocks indent further
 	var out bytes.Buffer
-	out.WriteString("{ ")
+	out.WriteString("{\n")
 	for _, s := range bs.Statements {
-		out.WriteString(s.String())
+		for _, line := range strings.Split(s.String(), "\n") {
+			out.WriteString("\t" + line + "\n")
+		}
 	}
-	out.WriteString(" }")
+	out.WriteString("}")
 	return out.String()
 }
 
@@ -148,6 +586,10 @@ type FunctionLiteral struct {
 	Name       *Identifier
 	Parameters []*Identifier
 	ParamTypes map[string]string // param name -> type (optional)
+	// Defaults maps parameter names to their default values; nil when no
+	// parameter has one. Callers of a named function may omit trailing
+	// parameters that have defaults.
+	Defaults   map[string]Expression
 	ReturnType string
 	Body       *BlockStatement
 }
@@ -158,13 +600,14 @@ func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 	params := []string{}
 	for _, p := range fl.Parameters {
-		if fl.ParamTypes != nil {
-			if t, ok := fl.ParamTypes[p.Value]; ok {
-				params = append(params, p.String()+": "+t)
-				continue
-			}
+		param := p.String()
+		if t, ok := fl.ParamTypes[p.Value]; ok {
+			param += ": " + t
 		}
-		params = append(params, p.String())
+		if d, ok := fl.Defaults[p.Value]; ok {
+			param += " = " + d.String()
+		}
+		params = append(params, param)
 	}
 	out.WriteString(fl.TokenLiteral())
 	if fl.Name != nil {
@@ -173,20 +616,24 @@ func (fl *FunctionLiteral) String() string {
 	}
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
-	out.WriteString(") ")
+	out.WriteString(")")
 	if fl.ReturnType != "" {
-		out.WriteString(":" + fl.ReturnType + " ")
+		out.WriteString(": " + fl.ReturnType)
 	}
+	out.WriteString(" ")
 	out.WriteString(fl.Body.String())
 	return out.String()
 }
 
-// TypeDefinition represents `type Name = { ... }` style declarations
+// TypeDefinition represents `type Name = { ... }` style declarations, or an
+// alias of another type such as `type Id = int`
 type TypeDefinition struct {
 	Token token.Token // the 'type' token
 	Name  *Identifier
 	// Fields represent struct-like members: name and type
 	Fields []*Field
+	// Alias is the aliased type name for `type Name = other`; empty for structs
+	Alias string
 }
 
 func (td *TypeDefinition) statementNode()       {}
@@ -194,6 +641,10 @@ func (td *TypeDefinition) TokenLiteral() string { return td.Token.Literal }
 func (td *TypeDefinition) String() string {
 	var out bytes.Buffer
 	out.WriteString(td.TokenLiteral() + " " + td.Name.String() + " = ")
+	if td.Alias != "" {
+		out.WriteString(td.Alias)
+		return out.String()
+	}
 	if td.Fields != nil {
 		fields := []string{}
 		for _, f := range td.Fields {
@@ -215,11 +666,23 @@ func (td *TypeDefinition) String() string {
 
 // Field represents a field inside a type definition: name and type
 type Field struct {
-	Name   string
+	Name string
+	// Type is a type annotation such as `int`, the list type `[string]` or
+	// the map type `{string: int}`
 	Type   string
 	Nested *TypeDefinition
 }
 
+// ElementType returns the element type T of a field of list type `[T]`.
+func (f *Field) ElementType() (string, bool) {
+	return ListElementType(f.Type)
+}
+
+// MapTypes returns the key and value types of a field of map type `{K: V}`.
+func (f *Field) MapTypes() (string, string, bool) {
+	return MapElementTypes(f.Type)
+}
+
 // CallExpression represents a function call, e.g., `myFunction(arg1, arg2)`
 type CallExpression struct {
 	Token     token.Token // The '(' token
@@ -242,19 +705,25 @@ func (ce *CallExpression) String() string {
 	return out.String()
 }
 
-// ExpressionStatement consists of a single expression.
+// ExpressionStatement consists of a single expression, optionally guarded by
+// a trailing `when` condition, e.g., `server.route("/admin", h) when ADMIN`
 type ExpressionStatement struct {
 	Token      token.Token // the first token of the expression
 	Expression Expression
+	// Guard is the condition of a `when` modifier; nil when there is none
+	Guard Expression
 }
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
 func (es *ExpressionStatement) String() string {
-	if es.Expression != nil {
-		return es.Expression.String()
+	if es.Expression == nil {
+		return ""
 	}
-	return ""
+	if es.Guard != nil {
+		return es.Expression.String() + " when " + es.Guard.String()
+	}
+	return es.Expression.String()
 }
 
 // InfixExpression represents a binary operation, e.g., `left + right`
@@ -270,15 +739,22 @@ func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
 
 // MemberAccessExpression represents accessing a property of an object, e.g., `my_object.property`
 type MemberAccessExpression struct {
-	Token    token.Token // The . token
+	Token    token.Token // The . or ?. token
 	Object   Expression
 	Property *Identifier
+	// Optional marks a ?. access, which yields nil instead of panicking
+	// when the object is not a map
+	Optional bool
 }
 
 func (mae *MemberAccessExpression) expressionNode()      {}
 func (mae *MemberAccessExpression) TokenLiteral() string { return mae.Token.Literal }
 func (mae *MemberAccessExpression) String() string {
-	return "(" + mae.Object.String() + "." + mae.Property.String() + ")"
+	dot := "."
+	if mae.Optional {
+		dot = "?."
+	}
+	return "(" + mae.Object.String() + dot + mae.Property.String() + ")"
 }
 
 // StringLiteral represents a string value, e.g., "hello world"
@@ -349,6 +825,33 @@ func (ie *IndexExpression) String() string {
 	out.WriteString("])")
 	return out.String()
 }
+
+// SliceExpression represents a slice operation, e.g., `list[1:3]`, `list[:3]` or `list[2:]`
+type SliceExpression struct {
+	Token token.Token // The [ token
+	Left  Expression
+	Start Expression // nil when omitted
+	End   Expression // nil when omitted
+}
+
+func (se *SliceExpression) expressionNode()      {}
+func (se *SliceExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Start != nil {
+		out.WriteString(se.Start.String())
+	}
+	out.WriteString(":")
+	if se.End != nil {
+		out.WriteString(se.End.String())
+	}
+	out.WriteString("])")
+	return out.String()
+}
+
 func (ie *InfixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -358,3 +861,29 @@ func (ie *InfixExpression) String() string {
 	out.WriteString(")")
 	return out.String()
 }
+
+// TryExpression calls a function returning a value and an error, e.g.
+// `let n = try strconv.Atoi(s)`. It is only valid as the value of a let inside
+// a function whose return type is error; a non-nil error is returned from
+// that function.
+type TryExpression struct {
+	Token token.Token // The try token
+	Call  Expression
+}
+
+func (te *TryExpression) expressionNode()      {}
+func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TryExpression) String() string       { return "try " + te.Call.String() }
+
+// CastExpression asserts the dynamic type of a value, e.g. `req["n"] as int`.
+type CastExpression struct {
+	Token token.Token // The as token
+	Value Expression
+	Type  string // type annotation, e.g. int or [string]
+}
+
+func (ce *CastExpression) expressionNode()      {}
+func (ce *CastExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CastExpression) String() string {
+	return "(" + ce.Value.String() + " as " + ce.Type + ")"
+}
@@ -0,0 +1,237 @@
+// Package astjson serializes a pisuke AST into JSON for editors and other
+// tooling.
+//
+// Every node becomes an object whose "type" member names the ast node type
+// (e.g. "LetStatement"), plus a "line" member when the node carries position
+// information and one member per field of the node. Child nodes are nested
+// objects, lists of nodes become arrays and absent optional children are
+// null.
+package astjson
+
+import (
+	"encoding/json"
+	"pisuke/ast"
+	"sort"
+)
+
+// Marshal returns the JSON encoding of node and everything below it.
+func Marshal(node ast.Node) ([]byte, error) {
+	return json.Marshal(Tree(node))
+}
+
+// MarshalIndent is like Marshal but indents the output like
+// json.MarshalIndent.
+func MarshalIndent(node ast.Node, prefix, indent string) ([]byte, error) {
+	return json.MarshalIndent(Tree(node), prefix, indent)
+}
+
+// Tree converts node into the generic map/slice form that Marshal encodes.
+func Tree(node ast.Node) interface{} {
+	if node == nil || isNilNode(node) {
+		return nil
+	}
+	obj := map[string]interface{}{}
+	switch n := node.(type) {
+	case *ast.Program:
+		obj["type"] = "Program"
+		obj["statements"] = statements(n.Statements)
+	case *ast.LetStatement:
+		obj["type"] = "LetStatement"
+		obj["name"] = Tree(n.Name)
+		if len(n.Names) > 0 {
+			names := []interface{}{}
+			for _, name := range n.Names {
+				names = append(names, Tree(name))
+			}
+			obj["names"] = names
+		}
+		obj["typeName"] = n.TypeName
+		obj["value"] = expression(n.Value)
+	case *ast.ConstStatement:
+		obj["type"] = "ConstStatement"
+		obj["name"] = Tree(n.Name)
+		obj["typeName"] = n.TypeName
+		obj["value"] = expression(n.Value)
+	case *ast.ReturnStatement:
+		obj["type"] = "ReturnStatement"
+		obj["value"] = expression(n.ReturnValue)
+	case *ast.UseStatement:
+		obj["type"] = "UseStatement"
+		obj["path"] = n.Path
+	case *ast.CompoundAssignStatement:
+		obj["type"] = "CompoundAssignStatement"
+		obj["name"] = Tree(n.Name)
+		obj["operator"] = n.Operator
+		obj["value"] = expression(n.Value)
+	case *ast.BreakStatement:
+		obj["type"] = "BreakStatement"
+	case *ast.ContinueStatement:
+		obj["type"] = "ContinueStatement"
+	case *ast.FallthroughStatement:
+		obj["type"] = "FallthroughStatement"
+	case *ast.SwitchStatement:
+		obj["type"] = "SwitchStatement"
+		obj["value"] = expression(n.Value)
+		cases := []interface{}{}
+		for _, c := range n.Cases {
+			cases = append(cases, map[string]interface{}{"values": expressions(c.Values), "body": statements(c.Body)})
+		}
+		obj["cases"] = cases
+		if n.Default != nil {
+			obj["default"] = statements(n.Default.Body)
+		}
+	case *ast.ExpressionStatement:
+		obj["type"] = "ExpressionStatement"
+		obj["expression"] = expression(n.Expression)
+		if n.Guard != nil {
+			obj["guard"] = expression(n.Guard)
+		}
+	case *ast.BlockStatement:
+		obj["type"] = "BlockStatement"
+		obj["statements"] = statements(n.Statements)
+	case *ast.TypeDefinition:
+		obj["type"] = "TypeDefinition"
+		obj["name"] = Tree(n.Name)
+		if n.Alias != "" {
+			obj["alias"] = n.Alias
+		} else {
+			obj["fields"] = fields(n.Fields)
+		}
+	case *ast.Identifier:
+		obj["type"] = "Identifier"
+		obj["value"] = n.Value
+	case *ast.IntegerLiteral:
+		obj["type"] = "IntegerLiteral"
+		obj["value"] = n.Value
+	case *ast.FloatLiteral:
+		obj["type"] = "FloatLiteral"
+		obj["value"] = n.Value
+	case *ast.StringLiteral:
+		obj["type"] = "StringLiteral"
+		obj["value"] = n.Value
+	case *ast.ListLiteral:
+		obj["type"] = "ListLiteral"
+		obj["elements"] = expressions(n.Elements)
+	case *ast.MapLiteral:
+		obj["type"] = "MapLiteral"
+		obj["pairs"] = pairs(n.Pairs)
+	case *ast.FunctionLiteral:
+		obj["type"] = "FunctionLiteral"
+		obj["name"] = Tree(n.Name)
+		params := []interface{}{}
+		for _, p := range n.Parameters {
+			param := map[string]interface{}{"name": p.Value, "type": n.ParamTypes[p.Value]}
+			if d, ok := n.Defaults[p.Value]; ok {
+				param["default"] = expression(d)
+			}
+			params = append(params, param)
+		}
+		obj["parameters"] = params
+		obj["returnType"] = n.ReturnType
+		obj["body"] = Tree(n.Body)
+	case *ast.TryExpression:
+		obj["type"] = "TryExpression"
+		obj["call"] = expression(n.Call)
+	case *ast.CastExpression:
+		obj["type"] = "CastExpression"
+		obj["value"] = expression(n.Value)
+		obj["typeName"] = n.Type
+	case *ast.CallExpression:
+		obj["type"] = "CallExpression"
+		obj["function"] = expression(n.Function)
+		obj["arguments"] = expressions(n.Arguments)
+	case *ast.InfixExpression:
+		obj["type"] = "InfixExpression"
+		obj["operator"] = n.Operator
+		obj["left"] = expression(n.Left)
+		obj["right"] = expression(n.Right)
+	case *ast.MemberAccessExpression:
+		obj["type"] = "MemberAccessExpression"
+		obj["object"] = expression(n.Object)
+		obj["property"] = Tree(n.Property)
+		if n.Optional {
+			obj["optional"] = true
+		}
+	case *ast.IndexExpression:
+		obj["type"] = "IndexExpression"
+		obj["left"] = expression(n.Left)
+		obj["index"] = expression(n.Index)
+	case *ast.SliceExpression:
+		obj["type"] = "SliceExpression"
+		obj["left"] = expression(n.Left)
+		obj["start"] = expression(n.Start)
+		obj["end"] = expression(n.End)
+	default:
+		// keep unknown nodes visible instead of dropping them silently
+		obj["type"] = "Unknown"
+		obj["text"] = node.String()
+	}
+	if line := ast.LineOf(node); line > 0 {
+		obj["line"] = line
+	}
+	return obj
+}
+
+func expression(e ast.Expression) interface{} {
+	if e == nil {
+		return nil
+	}
+	return Tree(e)
+}
+
+func statements(stmts []ast.Statement) []interface{} {
+	out := []interface{}{}
+	for _, s := range stmts {
+		out = append(out, Tree(s))
+	}
+	return out
+}
+
+func expressions(exprs []ast.Expression) []interface{} {
+	out := []interface{}{}
+	for _, e := range exprs {
+		out = append(out, expression(e))
+	}
+	return out
+}
+
+func fields(fs []*ast.Field) []interface{} {
+	out := []interface{}{}
+	for _, f := range fs {
+		field := map[string]interface{}{"name": f.Name, "type": f.Type}
+		if f.Nested != nil {
+			field["fields"] = fields(f.Nested.Fields)
+		}
+		out = append(out, field)
+	}
+	return out
+}
+
+// pairs lists map literal entries sorted by the source text of their keys so
+// the output does not depend on Go's map iteration order.
+func pairs(m map[ast.Expression]ast.Expression) []interface{} {
+	keys := make([]ast.Expression, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	out := []interface{}{}
+	for _, k := range keys {
+		out = append(out, map[string]interface{}{"key": expression(k), "value": expression(m[k])})
+	}
+	return out
+}
+
+// isNilNode reports whether node is a typed nil pointer, which happens for
+// optional children such as a missing function name.
+func isNilNode(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.Identifier:
+		return n == nil
+	case *ast.BlockStatement:
+		return n == nil
+	case *ast.Program:
+		return n == nil
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package astjson
+
+import (
+	"pisuke/lexer"
+	"pisuke/parser"
+	"testing"
+)
+
+func TestMarshalProgram(t *testing.T) {
+	input := `let x = 5
+fn add(a: int, b: int = 1) :int { return a + b }`
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+
+	out, err := Marshal(program)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	expected := `{"statements":[` +
+		`{"line":1,"name":{"line":1,"type":"Identifier","value":"x"},"type":"LetStatement","typeName":"",` +
+		`"value":{"line":1,"type":"IntegerLiteral","value":5}},` +
+		`{"expression":{"body":{"line":2,"statements":[{"line":2,"type":"ReturnStatement","value":` +
+		`{"left":{"line":2,"type":"Identifier","value":"a"},"line":2,"operator":"+",` +
+		`"right":{"line":2,"type":"Identifier","value":"b"},"type":"InfixExpression"}}],"type":"BlockStatement"},` +
+		`"line":2,"name":{"line":2,"type":"Identifier","value":"add"},` +
+		`"parameters":[{"name":"a","type":"int"},{"default":{"line":2,"type":"IntegerLiteral","value":1},"name":"b","type":"int"}],` +
+		`"returnType":"int","type":"FunctionLiteral"},"line":2,"type":"ExpressionStatement"}],` +
+		`"type":"Program"}`
+	if string(out) != expected {
+		t.Errorf("unexpected JSON.\nexpected=%s\ngot=     %s", expected, out)
+	}
+}
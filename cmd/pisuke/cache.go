@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// moduleCache keeps the source of imported modules so that unchanged files
+// are not re-read on every build. An entry stays valid while the file's size
+// and modification time are unchanged. When either differs the file is read
+// again and its content hash compared: an equal hash only refreshes the
+// metadata, a different hash replaces the entry.
+//
+// The cache lives in memory for one run unless --cache persists it to the
+// user's cache directory, see loadModuleCache.
+type moduleCache struct {
+	path    string // file the cache is persisted to; empty keeps it in memory
+	entries map[string]*cacheEntry
+	dirty   bool
+
+	hits   int
+	misses int
+}
+
+type cacheEntry struct {
+	ModTime int64  `json:"modTime"`
+	Size    int64  `json:"size"`
+	Hash    string `json:"hash"`
+	Content string `json:"content"`
+}
+
+func newModuleCache() *moduleCache {
+	return &moduleCache{entries: map[string]*cacheEntry{}}
+}
+
+// loadModuleCache reads a persisted cache from path. A missing or corrupt
+// file yields an empty cache that will be written back to path on save.
+func loadModuleCache(path string) *moduleCache {
+	c := newModuleCache()
+	c.path = path
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil || c.entries == nil {
+		c.entries = map[string]*cacheEntry{}
+	}
+	return c
+}
+
+// defaultCachePath returns the per-user location of the module cache, or ""
+// when no cache directory is available.
+func defaultCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "pisuke", "modules.json")
+}
+
+// read returns the content of the module at the absolute path abs, serving
+// it from the cache when the file has not changed.
+func (c *moduleCache) read(abs string) (string, error) {
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	if e, ok := c.entries[abs]; ok && e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() {
+		c.hits++
+		return e.Content, nil
+	}
+
+	data, err := ioutil.ReadFile(abs)
+	if err != nil {
+		return "", err
+	}
+	c.misses++
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if e, ok := c.entries[abs]; ok && e.Hash == hash {
+		e.Size, e.ModTime = info.Size(), info.ModTime().UnixNano()
+	} else {
+		c.entries[abs] = &cacheEntry{
+			ModTime: info.ModTime().UnixNano(),
+			Size:    info.Size(),
+			Hash:    hash,
+			Content: string(data),
+		}
+	}
+	c.dirty = true
+	return string(data), nil
+}
+
+// save persists the cache if it has a path and changed since it was loaded.
+// Entries of modules that no longer exist are dropped.
+func (c *moduleCache) save() error {
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+	for abs := range c.entries {
+		if _, err := os.Stat(abs); os.IsNotExist(err) {
+			delete(c.entries, abs)
+		}
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.path, data, 0644); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// saveCache persists cache. The cache only speeds up later builds, so a
+// failure is not fatal and is only reported in verbose mode.
+func saveCache(cache *moduleCache, stages stageLogger) {
+	if err := cache.save(); err != nil {
+		stages.logf("module cache not saved: %s", err)
+	}
+}
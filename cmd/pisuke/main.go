@@ -1,65 +1,249 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"pisuke/astjson"
 	"pisuke/codegen"
 	"pisuke/lexer"
 	"pisuke/parser"
 	"pisuke/token"
+	"pisuke/typecheck"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+// cliOptions holds the parsed command line.
+type cliOptions struct {
+	command   string
+	inputFile string
+	verbose   bool
+	multiFile bool
+	// goVersion is the Go release to generate code for, see
+	// codegen.Generator.TargetGoVersion
+	goVersion string
+	useAny    bool
+	// checkedArith generates overflow checked int arithmetic, see
+	// codegen.Generator.CheckedArith
+	checkedArith bool
+	// showTokens, showAST and showGo select the stages printed by debug;
+	// when none is set every stage is printed
+	showTokens bool
+	showAST    bool
+	showGo     bool
+	// json makes the ast command print the tree as JSON
+	json bool
+	// cache persists the module cache between builds, see moduleCache
+	cache bool
+	// pkg is the generated Go package name, see codegen.Generator.Package;
+	// a package other than main is written out as Go source instead of
+	// being built
+	pkg string
+}
+
+// generateOptions returns the code generation settings selected by the flags.
+// The generated code is gofmt'ed unless a //pisuke:nofmt directive says
+// otherwise, see applyDirectives.
+func (o cliOptions) generateOptions() codegen.GenerateOptions {
+	return codegen.GenerateOptions{TargetGoVersion: o.goVersion, UseAny: o.useAny, CheckedArith: o.checkedArith, Package: o.pkg, Format: true}
+}
+
+// directiveRe matches a //pisuke: directive comment, which must start a line
+// like the import statements it sits among.
+var directiveRe = regexp.MustCompile(`(?m)^[ \t]*//pisuke:(\S*)[ \t]*(.*?)[ \t]*$`)
+
+// applyDirectives applies the //pisuke: directive comments in src to opts.
+// They give escape hatches into the generated Go without new syntax:
+//
+//	//pisuke:import "crypto/sha256"  adds a Go import
+//	//pisuke:nofmt                    leaves the generated code unformatted
+func applyDirectives(src string, opts *codegen.GenerateOptions) error {
+	for _, m := range directiveRe.FindAllStringSubmatch(src, -1) {
+		name, arg := m[1], m[2]
+		switch name {
+		case "import":
+			path, err := strconv.Unquote(arg)
+			if err != nil || path == "" {
+				return fmt.Errorf("//pisuke:import expects a quoted import path, got %q", arg)
+			}
+			opts.Imports = append(opts.Imports, path)
+		case "nofmt":
+			if arg != "" {
+				return fmt.Errorf("//pisuke:nofmt takes no argument, got %q", arg)
+			}
+			opts.Format = false
+		default:
+			return fmt.Errorf("unknown directive //pisuke:%s", name)
+		}
+	}
+	return nil
+}
+
+// parseArgs parses `<command> [flags] <filename>`; flags may appear before or
+// after the filename.
+func parseArgs(args []string) (cliOptions, error) {
+	opts := cliOptions{}
+	if len(args) < 1 {
+		return opts, fmt.Errorf("missing command")
+	}
+	opts.command = args[0]
+
+	fs := flag.NewFlagSet(opts.command, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.BoolVar(&opts.verbose, "verbose", false, "print each build stage to stderr")
+	fs.BoolVar(&opts.multiFile, "multi-file", false, "generate one Go file per module instead of inlining imports")
+	fs.StringVar(&opts.goVersion, "target-go-version", "", "Go release to generate code for, e.g. 1.22")
+	fs.BoolVar(&opts.useAny, "any", false, "spell the empty interface as any instead of interface{}")
+	fs.BoolVar(&opts.checkedArith, "checked-arith", false, "panic on int overflow in +, - and * instead of wrapping")
+	fs.BoolVar(&opts.showTokens, "tokens", false, "debug: print the token stream")
+	fs.BoolVar(&opts.showAST, "ast", false, "debug: print the parsed AST")
+	fs.BoolVar(&opts.showGo, "go", false, "debug: print the generated Go code")
+	fs.BoolVar(&opts.json, "json", false, "ast: print the tree as JSON")
+	fs.BoolVar(&opts.cache, "cache", false, "keep imported modules in the user cache directory between builds")
+	fs.StringVar(&opts.pkg, "package", "", "name of the generated Go package (default main)")
+
+	rest := args[1:]
+	positional := []string{}
+	for {
+		if err := fs.Parse(rest); err != nil {
+			return opts, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+	if !opts.showTokens && !opts.showAST && !opts.showGo {
+		opts.showTokens, opts.showAST, opts.showGo = true, true, true
+	}
+	if len(positional) != 1 {
+		return opts, fmt.Errorf("expected exactly one filename, got %d", len(positional))
+	}
+	if opts.goVersion != "" && !goVersionRe.MatchString(opts.goVersion) {
+		return opts, fmt.Errorf("invalid --target-go-version %q, expected a release like 1.22", opts.goVersion)
+	}
+	if opts.pkg != "" && !goPackageRe.MatchString(opts.pkg) {
+		return opts, fmt.Errorf("invalid --package %q, expected a Go package name", opts.pkg)
+	}
+	if opts.multiFile && opts.pkg != "" && opts.pkg != "main" {
+		return opts, fmt.Errorf("--package cannot be combined with --multi-file")
+	}
+	if opts.multiFile && opts.command == "watch" {
+		return opts, fmt.Errorf("watch does not support --multi-file")
+	}
+	opts.inputFile = positional[0]
+	return opts, nil
+}
+
+var (
+	goVersionRe = regexp.MustCompile(`^(go)?1\.[0-9]+(\.[0-9]+)?$`)
+	goPackageRe = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+)
+
+// stageLogger reports build pipeline progress to stderr in verbose mode and
+// stays silent otherwise.
+type stageLogger struct {
+	w       io.Writer
+	enabled bool
+}
+
+func (s stageLogger) logf(format string, args ...interface{}) {
+	if s.enabled {
+		fmt.Fprintf(s.w, "[pisuke] "+format+"\n", args...)
+	}
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: pisuke <command> <filename>")
-		fmt.Println("Commands: build, debug")
+	opts, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		fmt.Println("Usage: pisuke <command> [--verbose] [--multi-file] [--cache] [--target-go-version 1.N] [--any] [--checked-arith] [--package name] <filename>")
+		fmt.Println("Commands: build, check, watch, debug [--tokens] [--ast] [--go], ast [--json]")
 		os.Exit(1)
 	}
+	stages := stageLogger{w: os.Stderr, enabled: opts.verbose}
+	if opts.command == "watch" {
+		// build errors are printed and the watch goes on until interrupted
+		watch(func() []string { return watchBuild(os.Stdout, opts, stages) }, watchInterval, nil)
+		return
+	}
 
-	command := os.Args[1]
-	inputFile := os.Args[2]
+	command := opts.command
+	inputFile := opts.inputFile
 	data, err := ioutil.ReadFile(inputFile)
 	if err != nil {
 		fmt.Printf("Error reading file: %s\n", err)
 		os.Exit(1)
 	}
 
+	cache := newModuleCache()
+	if opts.cache {
+		cache = loadModuleCache(defaultCachePath())
+	}
+	if command == "build" && opts.multiFile {
+		buildMultiFile(opts, string(data), cache, stages)
+		return
+	}
+
 	// Preprocess imports: inline referenced .psk modules and remove import statements
-	processed, err := preprocessImports(inputFile, string(data))
+	processed, err := preprocessImports(inputFile, string(data), cache)
 	if err != nil {
 		fmt.Printf("Error processing imports: %s\n", err)
 		os.Exit(1)
 	}
+	stages.logf("imports resolved: %d module(s) read, %d served from cache", cache.misses, cache.hits)
+	saveCache(cache, stages)
 
 	l := lexer.New(processed)
 
 	switch command {
 	case "debug":
-		fmt.Println("--- Tokens ---")
-		for {
-			tok := l.NextToken()
-			fmt.Printf("%+v\n", tok)
-			if tok.Type == token.EOF {
-				break
+		sep := ""
+		if opts.showTokens {
+			fmt.Println("--- Tokens ---")
+			for _, tok := range l.Tokens() {
+				fmt.Println(formatToken(tok))
 			}
+			sep = "\n"
 		}
-		// Re-create lexer because it's stateful; use processed content (imports inlined)
-		l = lexer.New(processed)
+		if !opts.showAST && !opts.showGo {
+			return
+		}
+		l.Reset()
 		p := parser.New(l)
 		program := p.ParseProgram()
-		fmt.Println("\n--- AST ---")
-		fmt.Println(program.String())
+		if opts.showAST {
+			fmt.Println(sep + "--- AST ---")
+			fmt.Println(program.String())
+			sep = "\n"
+		}
 
-		fmt.Println("\n--- Generated Go Code ---")
-		generatedCode := codegen.Generate(program)
-		fmt.Println(generatedCode)
+		if opts.showGo {
+			fmt.Println(sep + "--- Generated Go Code ---")
+			genOpts := opts.generateOptions()
+			var errs []string
+			if err := applyDirectives(processed, &genOpts); err != nil {
+				errs = append(errs, err.Error())
+			}
+			generatedCode, genErrs := codegen.GenerateWith(program, genOpts)
+			errs = append(errs, genErrs...)
+			fmt.Println(generatedCode)
+			if len(errs) > 0 {
+				fmt.Println("\n--- Codegen Errors ---")
+				for _, msg := range errs {
+					fmt.Println(msg)
+				}
+			}
+		}
 
-	case "build":
+	case "ast":
 		p := parser.New(l)
 		program := p.ParseProgram()
 		if len(p.Errors) > 0 {
@@ -69,74 +253,244 @@ func main() {
 			}
 			os.Exit(1)
 		}
-
-		generatedCode := codegen.Generate(program)
-		tempGoFile := "pisuke_temp_output.go"
-		err = ioutil.WriteFile(tempGoFile, []byte(generatedCode), 0644)
+		if !opts.json {
+			fmt.Println(program.String())
+			return
+		}
+		out, err := astjson.MarshalIndent(program, "", "  ")
 		if err != nil {
-			fmt.Printf("Error writing temporary Go file: %s\n", err)
+			fmt.Printf("Error encoding AST: %s\n", err)
 			os.Exit(1)
 		}
-		defer os.Remove(tempGoFile)
-
-		outputName := strings.TrimSuffix(inputFile, filepath.Ext(inputFile))
+		fmt.Println(string(out))
 
-		cmd := exec.Command("go", "build", "-o", outputName, tempGoFile)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+	case "check":
+		if !checkSource(os.Stdout, inputFile, processed) {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: no errors\n", inputFile)
 
-		if err != nil {
-			fmt.Printf("Error compiling generated Go code: %s\n", err)
+	case "build":
+		if !buildSource(os.Stdout, opts, processed, stages) {
 			os.Exit(1)
 		}
 
-		fmt.Printf("Successfully compiled %s to %s\n", inputFile, outputName)
+	default:
+		fmt.Printf("Unknown command: %s\n", command)
+		fmt.Println("Commands: build, check, watch, debug [--tokens] [--ast] [--go], ast [--json]")
+		os.Exit(1)
 	}
 }
 
+// buildSource compiles processed, the source of opts.inputFile with its
+// imports inlined, into an executable next to the input, or into Go source
+// for a package other than main. Errors are printed to w the way check prints
+// them; it reports whether the build succeeded.
+func buildSource(w io.Writer, opts cliOptions, processed string, stages stageLogger) bool {
+	if stages.enabled {
+		stages.logf("lexing done: %d tokens", countTokens(processed))
+	}
+	p := parser.New(lexer.New(processed))
+	program := p.ParseProgram()
+	if len(p.Errors) > 0 {
+		fmt.Fprintln(w, "Parser errors:")
+		for _, msg := range p.Errors {
+			fmt.Fprintln(w, "\t"+msg)
+		}
+		return false
+	}
+	stages.logf("parse done: %d statements", len(program.Statements))
+
+	lines := buildLineMap(opts.inputFile, processed)
+	if errs := typecheck.CheckProgram(program); len(errs) > 0 {
+		printTypeErrors(w, errs, lines)
+		return false
+	}
+	stages.logf("typecheck passed")
+
+	genOpts := opts.generateOptions()
+	if err := applyDirectives(processed, &genOpts); err != nil {
+		fmt.Fprintf(w, "Error: %s\n", err)
+		return false
+	}
+	genOpts.Lines = lines
+	generatedCode, errs := codegen.GenerateWith(program, genOpts)
+	if len(errs) > 0 {
+		fmt.Fprintln(w, "Codegen errors:")
+		for _, msg := range errs {
+			fmt.Fprintln(w, "\t"+msg)
+		}
+		return false
+	}
+	outputName := strings.TrimSuffix(opts.inputFile, filepath.Ext(opts.inputFile))
+	// a library package has no main to build; keep its Go source
+	if opts.pkg != "" && opts.pkg != "main" {
+		if err := ioutil.WriteFile(outputName+".go", []byte(generatedCode), 0644); err != nil {
+			fmt.Fprintf(w, "Error writing Go file: %s\n", err)
+			return false
+		}
+		fmt.Fprintf(w, "Successfully generated package %s from %s to %s.go\n", opts.pkg, opts.inputFile, outputName)
+		return true
+	}
+
+	tempGoFile := "pisuke_temp_output.go"
+	err := ioutil.WriteFile(tempGoFile, []byte(generatedCode), 0644)
+	if err != nil {
+		fmt.Fprintf(w, "Error writing temporary Go file: %s\n", err)
+		return false
+	}
+	defer os.Remove(tempGoFile)
+	stages.logf("generated Go written to %s (%d bytes)", tempGoFile, len(generatedCode))
+
+	cmd := exec.Command("go", "build", "-o", outputName, tempGoFile)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stages.logf("running: %s", strings.Join(cmd.Args, " "))
+	err = cmd.Run()
+
+	if err != nil {
+		fmt.Fprintf(w, "Error compiling generated Go code: %s\n", err)
+		return false
+	}
+
+	fmt.Fprintf(w, "Successfully compiled %s to %s\n", opts.inputFile, outputName)
+	return true
+}
+
+// checkSource parses and typechecks src, the source of file with its imports
+// inlined, without generating Go, printing parser errors or type errors to w
+// the way build does. It reports whether src is free of errors.
+func checkSource(w io.Writer, file, src string) bool {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors) > 0 {
+		fmt.Fprintln(w, "Parser errors:")
+		for _, msg := range p.Errors {
+			fmt.Fprintln(w, "\t"+msg)
+		}
+		return false
+	}
+	if errs := typecheck.CheckProgram(program); len(errs) > 0 {
+		printTypeErrors(w, errs, buildLineMap(file, src))
+		return false
+	}
+	return true
+}
+
+// printTypeErrors prints errs to w, each as `file:line:col: message` with
+// the line resolved to the source file it came from through lines.
+func printTypeErrors(w io.Writer, errs typecheck.Diagnostics, lines codegen.LineResolver) {
+	fmt.Fprintln(w, "Type errors:")
+	for _, d := range errs {
+		fmt.Fprintln(w, "\t"+formatDiagnostic(d, lines))
+	}
+}
+
+// formatDiagnostic renders d as `file:line:col: message`. A diagnostic
+// without a position is just its message, and one whose line lines cannot
+// place, or with no lines at all, is `line:col: message`.
+func formatDiagnostic(d typecheck.Diagnostic, lines codegen.LineResolver) string {
+	if d.Line <= 0 {
+		return d.Message
+	}
+	if lines != nil {
+		if file, line, ok := lines(d.Line); ok {
+			return fmt.Sprintf("%s:%d:%d: %s", file, line, d.Column, d.Message)
+		}
+	}
+	return fmt.Sprintf("%d:%d: %s", d.Line, d.Column, d.Message)
+}
+
+// formatToken renders tok for the debug token dump as `TYPE "literal" (line:col)`.
+func formatToken(tok token.Token) string {
+	return fmt.Sprintf("%s %q (%d:%d)", tok.Type, tok.Literal, tok.Line, tok.Column)
+}
+
+// countTokens lexes src and returns the number of tokens before EOF.
+func countTokens(src string) int {
+	return len(lexer.New(src).Tokens()) - 1
+}
+
 // preprocessImports finds import statements like: import { a, b } from "module"
 // and replaces them by inlining the contents of the referenced .psk file(s).
+// Namespaced imports (import * as m from "module") are inlined with their
+// top-level names prefixed, see namespaceModule.
 // It resolves relative paths based on the importing file's directory. It avoids
-// duplicating the same module by tracking visited files.
-func preprocessImports(entryFile string, content string) (string, error) {
+// duplicating the same module by tracking visited files. Module sources are
+// read through cache so unchanged files are not read again.
+func preprocessImports(entryFile string, content string, cache *moduleCache) (string, error) {
 	visited := make(map[string]bool)
 	dir := filepath.Dir(entryFile)
-	return resolveImportsRecursive(dir, content, visited)
+	return resolveImportsRecursive(dir, content, visited, cache)
+}
+
+// Import statements must start a line so that imports mentioned in comments
+// (e.g. a commented-out `// import { x } from "y"`) are left alone.
+var (
+	// matches: import { ... } from "module"
+	importRe = regexp.MustCompile(`(?m)^[ \t]*import\s*\{[^}]*\}\s*from\s*"([^"]+)"`)
+	// matches: import * as name from "module"
+	namespaceImportRe = regexp.MustCompile(`(?m)^[ \t]*import\s*\*\s*as\s+([A-Za-z_][A-Za-z0-9_]*)\s+from\s*"([^"]+)"`)
+)
+
+// resolveModulePath resolves modulePath (like "math", "std/webserver" or
+// "./util.psk") to the absolute path of its .psk file.
+func resolveModulePath(baseDir, modulePath string) (string, error) {
+	modulePath = strings.TrimSuffix(modulePath, ".psk")
+	var candidate string
+	if filepath.IsAbs(modulePath) {
+		candidate = modulePath + ".psk"
+	} else {
+		candidate = filepath.Join(baseDir, modulePath+".psk")
+	}
+
+	// If the file doesn't exist relative, try modulePath directly in workspace
+	if _, err := os.Stat(candidate); os.IsNotExist(err) {
+		// try modulePath as-is (maybe already contains path separators)
+		candidate = modulePath + ".psk"
+	}
+	return filepath.Abs(candidate)
 }
 
 // resolveImportsRecursive scans content for import statements, loads referenced
 // files and inlines them. It returns the resulting source where import lines
 // are removed and replaced by the inlined module source.
-func resolveImportsRecursive(baseDir string, content string, visited map[string]bool) (string, error) {
-	// regex to match: import { ... } from "module"
-	re := regexp.MustCompile(`import\s*\{[^}]*\}\s*from\s*"([^"]+)"`)
-
+func resolveImportsRecursive(baseDir string, content string, visited map[string]bool, cache *moduleCache) (string, error) {
 	result := content
-	matches := re.FindAllStringSubmatch(content, -1)
-	for _, m := range matches {
-		if len(m) < 2 {
+	for _, m := range namespaceImportRe.FindAllStringSubmatch(content, -1) {
+		namespace, modulePath := m[1], m[2]
+		abs, err := resolveModulePath(baseDir, modulePath)
+		if err != nil {
+			return "", err
+		}
+		// the same module may be imported under several namespaces, each
+		// getting its own prefixed copy
+		key := abs + "#" + namespace
+		if visited[key] {
+			result = strings.Replace(result, m[0], "", -1)
 			continue
 		}
-		modulePath := m[1]
-		// resolve to a .psk file path. Support modulePath like "math" or "std/webserver"
-		var candidate string
-		if filepath.IsAbs(modulePath) {
-			candidate = modulePath + ".psk"
-		} else {
-			candidate = filepath.Join(baseDir, modulePath+".psk")
-		}
-
-		// If the file doesn't exist relative, try modulePath directly in workspace
-		if _, err := os.Stat(candidate); os.IsNotExist(err) {
-			// try modulePath as-is (maybe already contains path separators)
-			candidate = modulePath
-			if !strings.HasSuffix(candidate, ".psk") {
-				candidate = candidate + ".psk"
-			}
+		data, err := cache.read(abs)
+		if err != nil {
+			return "", fmt.Errorf("cannot read module %s: %w", modulePath, err)
+		}
+		visited[key] = true
+
+		inlined, err := resolveImportsRecursive(filepath.Dir(abs), data, visited, cache)
+		if err != nil {
+			return "", err
 		}
+		prefixed, names := namespaceModule(inlined, namespace)
+		result = qualifyNamespaceReferences(result, namespace, names)
+		result = strings.Replace(result, m[0], "\n"+beginModuleMarker+abs+" as "+namespace+"\n"+prefixed+"\n"+endModuleMarker+abs+"\n", -1)
+	}
 
-		abs, err := filepath.Abs(candidate)
+	for _, m := range importRe.FindAllStringSubmatch(content, -1) {
+		if len(m) < 2 {
+			continue
+		}
+		modulePath := m[1]
+		abs, err := resolveModulePath(baseDir, modulePath)
 		if err != nil {
 			return "", err
 		}
@@ -146,20 +500,20 @@ func resolveImportsRecursive(baseDir string, content string, visited map[string]
 			continue
 		}
 
-		data, err := ioutil.ReadFile(abs)
+		data, err := cache.read(abs)
 		if err != nil {
 			return "", fmt.Errorf("cannot read module %s: %w", modulePath, err)
 		}
 		visited[abs] = true
 
 		// Recursively resolve imports in the module itself
-		inlined, err := resolveImportsRecursive(filepath.Dir(abs), string(data), visited)
+		inlined, err := resolveImportsRecursive(filepath.Dir(abs), data, visited, cache)
 		if err != nil {
 			return "", err
 		}
 
 		// Replace the import statement with the inlined module source
-		result = strings.Replace(result, m[0], "\n// begin inlined module: "+modulePath+"\n"+inlined+"\n// end inlined module: "+modulePath+"\n", -1)
+		result = strings.Replace(result, m[0], "\n"+beginModuleMarker+abs+"\n"+inlined+"\n"+endModuleMarker+abs+"\n", -1)
 	}
 	return result, nil
 }
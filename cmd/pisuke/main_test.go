@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pisuke/codegen"
+	"pisuke/lexer"
+	"pisuke/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnchangedModuleServedFromCache(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `import { add } from "math"
+print(add(1, 2))`
+	writeFile(t, entry, src)
+	writeFile(t, filepath.Join(dir, "math.psk"), "let add = fn add(a, b) { return a + b }\n")
+
+	cache := newModuleCache()
+	first, err := preprocessImports(entry, src, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.misses != 1 || cache.hits != 0 {
+		t.Fatalf("first build: expected 1 miss and 0 hits, got %d misses and %d hits", cache.misses, cache.hits)
+	}
+
+	second, err := preprocessImports(entry, src, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.hits != 1 {
+		t.Fatalf("second build: expected module to be served from cache, got %d hits", cache.hits)
+	}
+	if first != second {
+		t.Fatalf("cached build differs:\n%s\n---\n%s", first, second)
+	}
+
+	// a changed module must be read again
+	writeFile(t, filepath.Join(dir, "math.psk"), "let add = fn add(a, b) { return b + a }\n")
+	third, err := preprocessImports(entry, src, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.misses != 2 {
+		t.Fatalf("expected changed module to miss the cache, got %d misses", cache.misses)
+	}
+	if !strings.Contains(third, "return b + a") {
+		t.Fatalf("expected updated module content, got:\n%s", third)
+	}
+}
+
+func TestModuleCachePersists(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "math.psk")
+	writeFile(t, module, "let one = 1\n")
+	cachePath := filepath.Join(dir, "cache", "modules.json")
+
+	c := loadModuleCache(cachePath)
+	if _, err := c.read(module); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := loadModuleCache(cachePath)
+	content, err := reloaded.read(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.hits != 1 || content != "let one = 1\n" {
+		t.Fatalf("expected persisted entry to be served, got hits=%d content=%q", reloaded.hits, content)
+	}
+}
+
+func TestModuleCacheDropsDeletedModules(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept.psk")
+	gone := filepath.Join(dir, "gone.psk")
+	writeFile(t, kept, "let one = 1\n")
+	writeFile(t, gone, "let two = 2\n")
+	cachePath := filepath.Join(dir, "cache", "modules.json")
+
+	c := loadModuleCache(cachePath)
+	for _, module := range []string{kept, gone} {
+		if _, err := c.read(module); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := loadModuleCache(cachePath)
+	if _, ok := reloaded.entries[gone]; ok || len(reloaded.entries) != 1 {
+		t.Fatalf("expected only %s to be persisted, got %v", kept, reloaded.entries)
+	}
+}
+
+func TestModuleCacheSaveFailureIsReported(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "math.psk")
+	writeFile(t, module, "let one = 1\n")
+	// the cache directory cannot be created below a regular file
+	c := loadModuleCache(filepath.Join(module, "modules.json"))
+	if _, err := c.read(module); err != nil {
+		t.Fatal(err)
+	}
+
+	var quiet, verbose bytes.Buffer
+	saveCache(c, stageLogger{w: &quiet})
+	saveCache(c, stageLogger{w: &verbose, enabled: true})
+	if quiet.Len() != 0 {
+		t.Errorf("expected no output without --verbose, got %q", quiet.String())
+	}
+	if !strings.Contains(verbose.String(), "module cache not saved") {
+		t.Errorf("expected the failure to be reported, got %q", verbose.String())
+	}
+}
+
+func TestNamespacedImportsAvoidCollisions(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `import * as ints from "ints"
+import * as strs from "strs"
+let 名前 = "main"
+print(ints.add(1, 2), ints.名前, 名前)
+print(strs.add("a", "b"))`
+	writeFile(t, entry, src)
+	writeFile(t, filepath.Join(dir, "ints.psk"), "let 名前 = \"ints\"\nfn add(a: int, b: int): int {\n    return a + b\n}\n")
+	writeFile(t, filepath.Join(dir, "strs.psk"), "// joins two strings with add\nfn add(a: string, b: string): string {\n    return a + \"add\" + b\n}\n")
+
+	processed, err := preprocessImports(entry, src, newModuleCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"fn ints_add(a: int, b: int): int",
+		"fn strs_add(a: string, b: string): string",
+		"let ints_名前 = \"ints\"",
+		"print(ints_add(1, 2), ints_名前, 名前)",
+		`print(strs_add("a", "b"))`,
+		`a + "add" + b`,
+		"// joins two strings with add",
+	} {
+		if !strings.Contains(processed, want) {
+			t.Errorf("expected processed source to contain %q, got:\n%s", want, processed)
+		}
+	}
+
+	l := lexer.New(processed)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	code := codegen.Generate(program)
+	if !strings.Contains(code, "func ints_add(") || !strings.Contains(code, "func strs_add(") {
+		t.Fatalf("expected both prefixed functions in generated code, got:\n%s", code)
+	}
+}
+
+func TestNamespacedModuleKeepsFieldsAndKeys(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `import * as util from "util"
+let p: util.Person = {name: util.name, age: 1}
+print(p.name)`
+	writeFile(t, entry, src)
+	// the field and the map key share their name with a top-level let
+	writeFile(t, filepath.Join(dir, "util.psk"), `let name = "util"
+type Person = { name: string
+  age: int }
+let keys = {name: name}
+print(keys["name"])
+`)
+
+	processed, err := preprocessImports(entry, src, newModuleCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"type util_Person = { name: string",
+		"let util_keys = {name: util_name}",
+		"let p: util_Person = {name: util_name, age: 1}",
+	} {
+		if !strings.Contains(processed, want) {
+			t.Errorf("expected processed source to contain %q, got:\n%s", want, processed)
+		}
+	}
+
+	p := parser.New(lexer.New(processed))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	writeFile(t, filepath.Join(dir, "gen", "main.go"), codegen.Generate(program))
+	goBuild(t, filepath.Join(dir, "gen"))
+}
+
+func TestLineMapFollowsInlinedModules(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `import { add } from "math"
+let x = add(1, 2)
+print(x)`
+	writeFile(t, entry, src)
+	writeFile(t, filepath.Join(dir, "math.psk"), "// math helpers\nlet add = fn add(a, b) {\n    return a + b\n}\nimport { twice } from \"./lib/twice.psk\"\n")
+	writeFile(t, filepath.Join(dir, "lib", "twice.psk"), "let twice = fn twice(a) {\n    return a * 2\n}\n")
+
+	processed, err := preprocessImports(entry, src, newModuleCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := buildLineMap(entry, processed)
+
+	lines := strings.Split(processed, "\n")
+	find := func(text string) int {
+		for i, l := range lines {
+			if strings.Contains(l, text) {
+				return i + 1
+			}
+		}
+		t.Fatalf("%q not found in:\n%s", text, processed)
+		return 0
+	}
+
+	tests := []struct {
+		text string
+		file string
+		line int
+	}{
+		{"let add", filepath.Join(dir, "math.psk"), 2},
+		{"return a + b", filepath.Join(dir, "math.psk"), 3},
+		// imports with a .psk suffix resolve against the importing module
+		{"let twice", filepath.Join(dir, "lib", "twice.psk"), 1},
+		{"let x", entry, 2},
+		{"print(x)", entry, 3},
+	}
+	for _, tt := range tests {
+		file, line, ok := resolve(find(tt.text))
+		if !ok || file != tt.file || line != tt.line {
+			t.Errorf("%q: expected %s:%d, got %s:%d (ok=%v)", tt.text, tt.file, tt.line, file, line, ok)
+		}
+	}
+	if _, _, ok := resolve(find(beginModuleMarker)); ok {
+		t.Errorf("expected marker line to have no origin")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    cliOptions
+		wantErr bool
+	}{
+		{[]string{"build", "main.psk"}, cliOptions{command: "build", inputFile: "main.psk", showTokens: true, showAST: true, showGo: true}, false},
+		{[]string{"build", "--verbose", "main.psk"}, cliOptions{command: "build", inputFile: "main.psk", showTokens: true, showAST: true, showGo: true, verbose: true}, false},
+		{[]string{"build", "main.psk", "--verbose"}, cliOptions{command: "build", inputFile: "main.psk", showTokens: true, showAST: true, showGo: true, verbose: true}, false},
+		{[]string{"build", "--multi-file", "main.psk"}, cliOptions{command: "build", inputFile: "main.psk", showTokens: true, showAST: true, showGo: true, multiFile: true}, false},
+		{[]string{"build", "main.psk", "--target-go-version", "1.22"}, cliOptions{command: "build", inputFile: "main.psk", showTokens: true, showAST: true, showGo: true, goVersion: "1.22"}, false},
+		{[]string{"build", "--any=false", "main.psk"}, cliOptions{command: "build", inputFile: "main.psk", showTokens: true, showAST: true, showGo: true}, false},
+		{[]string{"build", "--checked-arith", "main.psk"}, cliOptions{command: "build", inputFile: "main.psk", checkedArith: true, showTokens: true, showAST: true, showGo: true}, false},
+		{[]string{"build", "--cache", "main.psk"}, cliOptions{command: "build", inputFile: "main.psk", cache: true, showTokens: true, showAST: true, showGo: true}, false},
+		{[]string{"ast", "--json", "main.psk"}, cliOptions{command: "ast", inputFile: "main.psk", showTokens: true, showAST: true, showGo: true, json: true}, false},
+		{[]string{"debug", "--tokens", "--go", "main.psk"}, cliOptions{command: "debug", inputFile: "main.psk", showTokens: true, showGo: true}, false},
+		{[]string{"build", "--package", "geometry", "main.psk"}, cliOptions{command: "build", inputFile: "main.psk", showTokens: true, showAST: true, showGo: true, pkg: "geometry"}, false},
+		{[]string{"build", "--package", "Geo-metry", "main.psk"}, cliOptions{}, true},
+		{[]string{"build", "--package", "geometry", "--multi-file", "main.psk"}, cliOptions{}, true},
+		{[]string{"watch", "--multi-file", "main.psk"}, cliOptions{}, true},
+		{[]string{"build", "--target-go-version=latest", "main.psk"}, cliOptions{}, true},
+		{[]string{"build"}, cliOptions{}, true},
+		{[]string{"build", "a.psk", "b.psk"}, cliOptions{}, true},
+		{[]string{"build", "--nope", "main.psk"}, cliOptions{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseArgs(tt.args)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseArgs(%v): expected error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseArgs(%v): unexpected error %v", tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseArgs(%v) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestWatchRebuildsWhenAnImportChanges(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	module := filepath.Join(dir, "util.psk")
+	writeFile(t, entry, "import { limit } from \"util\"\nprint(limit)\n")
+	writeFile(t, module, "let limit: string = 1\n")
+
+	opts := cliOptions{command: "watch", inputFile: entry}
+	type build struct {
+		files []string
+		out   string
+	}
+	builds := make(chan build)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watch(func() []string {
+			var out bytes.Buffer
+			files := watchBuild(&out, opts, stageLogger{})
+			builds <- build{files, out.String()}
+			return files
+		}, 10*time.Millisecond, stop)
+		close(done)
+	}()
+
+	first := <-builds
+	if !strings.Contains(first.out, "Type errors:") {
+		t.Fatalf("expected the first build to report a type error, got:\n%s", first.out)
+	}
+	if len(first.files) != 2 || first.files[1] != module {
+		t.Fatalf("expected the entry and %s to be watched, got %v", module, first.files)
+	}
+
+	// the watch keeps going after a failed build and rebuilds on a change
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(module, later, later); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-builds:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a rebuild after the module changed")
+	}
+	close(stop)
+	<-done
+}
+
+func TestImportDirective(t *testing.T) {
+	src := `//pisuke:import "path"
+print(path.Base("a/b"))`
+	opts := cliOptions{useAny: true}.generateOptions()
+	if err := applyDirectives(src, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Imports) != 1 || opts.Imports[0] != "path" || !opts.Format {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	code, errs := codegen.GenerateWith(program, opts)
+	if len(errs) != 0 {
+		t.Fatalf("codegen errors: %v", errs)
+	}
+	if !strings.Contains(code, "\t\"path\"\n") || !strings.Contains(code, "fmt.Println(path.Base(\"a/b\"))") {
+		t.Fatalf("expected the path import to be usable, got:\n%s", code)
+	}
+
+	if err := applyDirectives("//pisuke:nofmt", &opts); err != nil || opts.Format {
+		t.Errorf("expected nofmt to turn formatting off, got %v", err)
+	}
+	for src, want := range map[string]string{
+		"//pisuke:import path": `//pisuke:import expects a quoted import path, got "path"`,
+		"//pisuke:nofmt now":   `//pisuke:nofmt takes no argument, got "now"`,
+		"  //pisuke:inline":    "unknown directive //pisuke:inline",
+	} {
+		if err := applyDirectives(src, &opts); err == nil || err.Error() != want {
+			t.Errorf("%s: expected %q, got %v", src, want, err)
+		}
+	}
+}
+
+func TestPackageFlagSelectsPackage(t *testing.T) {
+	opts, err := parseArgs([]string{"build", "--package", "geometry", "geometry.psk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.New(lexer.New(`fn area(w: int, h: int): int {
+    return w * h
+}`))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	code, errs := codegen.GenerateWith(program, opts.generateOptions())
+	if len(errs) != 0 {
+		t.Fatalf("codegen errors: %v", errs)
+	}
+	if !strings.HasPrefix(code, "package geometry\n") || strings.Contains(code, "func main()") {
+		t.Fatalf("expected package geometry without main, got:\n%s", code)
+	}
+}
+
+func TestAnyFlagRespectsTargetGoVersion(t *testing.T) {
+	p := parser.New(lexer.New(`let xs = [1, 2]`))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"debug", "--go", "main.psk"}, "[]interface{}{1, 2}"},
+		{[]string{"debug", "--go", "--any", "main.psk"}, "[]any{1, 2}"},
+		{[]string{"debug", "--go", "--target-go-version", "1.22", "main.psk"}, "[]any{1, 2}"},
+		{[]string{"debug", "--go", "--any", "--target-go-version", "1.16", "main.psk"}, "[]interface{}{1, 2}"},
+	}
+	for _, tt := range tests {
+		opts, err := parseArgs(tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, errs := codegen.GenerateWith(program, opts.generateOptions())
+		if len(errs) != 0 {
+			t.Fatalf("codegen errors: %v", errs)
+		}
+		if !strings.Contains(code, tt.want) {
+			t.Errorf("%v: expected %s, got:\n%s", tt.args, tt.want, code)
+		}
+	}
+}
+
+func TestFormatToken(t *testing.T) {
+	l := lexer.New("let x = \"hi\"")
+	want := []string{
+		`LET "let" (1:1)`,
+		`IDENT "x" (1:5)`,
+		`= "=" (1:7)`,
+		`STRING "hi" (1:9)`,
+		`EOF "" (1:13)`,
+	}
+	for _, w := range want {
+		if got := formatToken(l.NextToken()); got != w {
+			t.Errorf("formatToken = %s, want %s", got, w)
+		}
+	}
+}
+
+func TestStageLoggerQuietByDefault(t *testing.T) {
+	var buf strings.Builder
+	stageLogger{w: &buf}.logf("parse done: %d statements", 3)
+	if buf.Len() != 0 {
+		t.Fatalf("expected no output when not verbose, got %q", buf.String())
+	}
+	stageLogger{w: &buf, enabled: true}.logf("parse done: %d statements", 3)
+	if buf.String() != "[pisuke] parse done: 3 statements\n" {
+		t.Fatalf("unexpected verbose output %q", buf.String())
+	}
+}
+
+func TestCheckReportsTypeErrors(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `import { limit } from "config"
+let n: int = limit
+print(n)`
+	writeFile(t, entry, src)
+	writeFile(t, filepath.Join(dir, "config.psk"), `let limit: string = "ten"`)
+
+	processed, err := preprocessImports(entry, src, newModuleCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if checkSource(&buf, entry, processed) {
+		t.Fatalf("expected check to fail, got:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Type errors:") || !strings.Contains(buf.String(), entry+":2:1: n: cannot use string value as int") {
+		t.Fatalf("expected the type error to be reported, got:\n%s", buf.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "main")); !os.IsNotExist(err) {
+		t.Fatalf("check must not build a binary")
+	}
+
+	buf.Reset()
+	if !checkSource(&buf, entry, `let n: int = 10
+print(n)`) || buf.Len() != 0 {
+		t.Fatalf("expected a clean check to pass silently, got:\n%s", buf.String())
+	}
+}
+
+// goBuild compiles the Go files in dir, skipping the test when no Go
+// toolchain is available.
+func goBuild(t *testing.T, dir string) {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+	cmd := exec.Command("go", "build", "-o", filepath.Join(dir, "out"), ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %v\n%s", err, out)
+	}
+}
+
+func TestWebServerExampleBuilds(t *testing.T) {
+	src, err := ioutil.ReadFile(filepath.Join("..", "..", "examples", "04_web_server.psk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.New(lexer.New(string(src)))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	code, errs := codegen.GenerateWith(program, cliOptions{}.generateOptions())
+	if len(errs) != 0 {
+		t.Fatalf("codegen errors: %v", errs)
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "main.go"), code)
+	goBuild(t, dir)
+}
+
+func TestInlinedModuleCommentsSurvive(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `// entry comment
+import { greet } from "greet" // trailing comment
+print(greet("pisuke"))`
+	writeFile(t, entry, src)
+	// the module has a leading comment, a commented-out import, a comment
+	// inside a function body and ends in a comment without a newline
+	writeFile(t, filepath.Join(dir, "greet.psk"), `// greet module
+// import { missing } from "does/not/exist"
+fn greet(name: string): string {
+    // build the greeting
+    return "hello " + name
+}
+// end of greet`)
+
+	processed, err := preprocessImports(entry, src, newModuleCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(processed, `// import { missing } from "does/not/exist"`) {
+		t.Fatalf("expected commented-out import to be kept verbatim, got:\n%s", processed)
+	}
+
+	p := parser.New(lexer.New(processed))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v\n%s", p.Errors, processed)
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements (fn greet and print), got %d: %s", len(program.Statements), program.String())
+	}
+
+	writeFile(t, filepath.Join(dir, "gen", "main.go"), codegen.Generate(program))
+	goBuild(t, filepath.Join(dir, "gen"))
+}
+
+func TestMultiFileBuild(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `import { add, User } from "math"
+import * as greet from "lib/greet"
+let u:User = { "id": add(1, 2), "name": "Alice" }
+print(u.name)
+print(greet.hello(u.name))`
+	writeFile(t, entry, src)
+	writeFile(t, filepath.Join(dir, "math.psk"), `type User = { id: int, name: string }
+fn add(a: int, b: int): int {
+    return a + b
+}
+const ZERO: int = 0
+print("math loaded")
+`)
+	writeFile(t, filepath.Join(dir, "lib", "greet.psk"), `let prefix = "hello "
+fn hello(name: string): string {
+    return prefix + name
+}
+`)
+
+	modules, err := collectModules(entry, src, newModuleCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, m := range modules {
+		names = append(names, m.goName)
+	}
+	if strings.Join(names, " ") != "pisuke_lib_greet.go pisuke_math.go pisuke_main.go" {
+		t.Fatalf("unexpected files: %v", names)
+	}
+	if !strings.Contains(modules[2].src, "greet_hello(u.name)") {
+		t.Fatalf("expected namespaced reference in entry, got:\n%s", modules[2].src)
+	}
+
+	files, errs := parseModules(modules)
+	if len(errs) > 0 {
+		t.Fatalf("parser errors: %v", errs)
+	}
+	gen := filepath.Join(dir, "gen")
+	for _, gf := range codegen.NewGenerator().GeneratePackage(files) {
+		writeFile(t, filepath.Join(gen, gf.Name), gf.Source)
+	}
+
+	math, err := ioutil.ReadFile(filepath.Join(gen, "pisuke_math.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"func add(a int, b int) int {", "type User struct {", "const ZERO int = 0", "func init() {"} {
+		if !strings.Contains(string(math), want) {
+			t.Errorf("expected %q in math module, got:\n%s", want, math)
+		}
+	}
+	goBuild(t, gen)
+}
+
+func TestMultiFileTypeErrorsNameTheirFile(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `import { half } from "math"
+let n: int = "one"
+print(half(n))`
+	writeFile(t, entry, src)
+	writeFile(t, filepath.Join(dir, "math.psk"), `fn half(x: int): int {
+    return x / 2
+}
+let two: string = 2
+`)
+
+	modules, err := collectModules(entry, src, newModuleCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, lines := typecheckModules(modules)
+	var out bytes.Buffer
+	printTypeErrors(&out, errs, lines)
+	for _, want := range []string{
+		filepath.Join(dir, "math.psk") + ":4:",
+		entry + ":2:",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMultiFileDirectives(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.psk")
+	src := `import { base } from "paths"
+print(base("a/b"))`
+	writeFile(t, entry, src)
+	writeFile(t, filepath.Join(dir, "paths.psk"), `//pisuke:import "path"
+fn base(p: string): string {
+    return path.Base(p)
+}
+`)
+
+	modules, err := collectModules(entry, src, newModuleCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, errs := parseModules(modules)
+	if len(errs) > 0 {
+		t.Fatalf("parser errors: %v", errs)
+	}
+	opts := cliOptions{}.generateOptions()
+	if err := applyModuleDirectives(modules, files, &opts); err != nil {
+		t.Fatal(err)
+	}
+	gen := filepath.Join(dir, "gen")
+	for _, gf := range codegen.NewGeneratorWith(opts).GeneratePackage(files) {
+		formatted, err := format.Source([]byte(gf.Source))
+		if err != nil || string(formatted) != gf.Source {
+			t.Errorf("expected %s to be formatted, got:\n%s", gf.Name, gf.Source)
+		}
+		if imported := strings.Contains(gf.Source, "\t\"path\"\n"); imported != (gf.Name == "pisuke_paths.go") {
+			t.Errorf("expected the path import in the paths module only, got %s:\n%s", gf.Name, gf.Source)
+		}
+		writeFile(t, filepath.Join(gen, gf.Name), gf.Source)
+	}
+	goBuild(t, gen)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pisuke/codegen"
+	"pisuke/lexer"
+	"pisuke/parser"
+	"pisuke/typecheck"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// buildMultiFile implements `pisuke build --multi-file`: every module becomes
+// its own Go file of package main (see codegen.GeneratePackage) and the files
+// are compiled together. It exits the process on failure like main.
+func buildMultiFile(opts cliOptions, content string, cache *moduleCache, stages stageLogger) {
+	inputFile := opts.inputFile
+	modules, err := collectModules(inputFile, content, cache)
+	if err != nil {
+		fmt.Printf("Error processing imports: %s\n", err)
+		os.Exit(1)
+	}
+	stages.logf("imports resolved: %d module(s) read, %d served from cache", cache.misses, cache.hits)
+	saveCache(cache, stages)
+
+	files, errs := parseModules(modules)
+	if len(errs) > 0 {
+		fmt.Println("Parser errors:")
+		for _, msg := range errs {
+			fmt.Println("\t" + msg)
+		}
+		os.Exit(1)
+	}
+	stages.logf("parse done: %d files", len(files))
+
+	if errs, lines := typecheckModules(modules); len(errs) > 0 {
+		printTypeErrors(os.Stdout, errs, lines)
+		os.Exit(1)
+	}
+	stages.logf("typecheck passed")
+
+	genOpts := opts.generateOptions()
+	if err := applyModuleDirectives(modules, files, &genOpts); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	g := codegen.NewGeneratorWith(genOpts)
+	generated := g.GeneratePackage(files)
+	if len(g.Errors) > 0 {
+		fmt.Println("Codegen errors:")
+		for _, msg := range g.Errors {
+			fmt.Println("\t" + msg)
+		}
+		os.Exit(1)
+	}
+
+	dir, err := ioutil.TempDir("", "pisuke")
+	if err != nil {
+		fmt.Printf("Error creating output directory: %s\n", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	goFiles := []string{}
+	for _, gf := range generated {
+		path := filepath.Join(dir, gf.Name)
+		if err := ioutil.WriteFile(path, []byte(gf.Source), 0644); err != nil {
+			fmt.Printf("Error writing temporary Go file: %s\n", err)
+			os.Exit(1)
+		}
+		goFiles = append(goFiles, path)
+		stages.logf("generated Go written to %s (%d bytes)", path, len(gf.Source))
+	}
+
+	outputName := strings.TrimSuffix(inputFile, filepath.Ext(inputFile))
+	cmd := exec.Command("go", append([]string{"build", "-o", outputName}, goFiles...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stages.logf("running: %s", strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Error compiling generated Go code: %s\n", err)
+		// os.Exit skips deferred calls
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully compiled %s to %s\n", inputFile, outputName)
+}
+
+// parseModules parses each module into a codegen.File. It returns the parser
+// errors of all files, prefixed with the file they occur in.
+func parseModules(modules []moduleFile) ([]codegen.File, []string) {
+	files := []codegen.File{}
+	errs := []string{}
+	for _, m := range modules {
+		p := parser.New(lexer.New(m.src))
+		program := p.ParseProgram()
+		for _, msg := range p.Errors {
+			errs = append(errs, m.path+": "+msg)
+		}
+		files = append(files, codegen.File{Name: m.goName, Program: program, Lines: codegen.SingleFile(m.path)})
+	}
+	return files, errs
+}
+
+// typecheckModules typechecks the modules together so calls across modules
+// are checked. The programs of parseModules all start at line 1, so the
+// modules are parsed again as one source for this, and the returned resolver
+// places a line of that source in its module.
+func typecheckModules(modules []moduleFile) (typecheck.Diagnostics, codegen.LineResolver) {
+	var src strings.Builder
+	starts := []int{} // the line each module starts on
+	line := 1
+	for _, m := range modules {
+		text := m.src
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		starts = append(starts, line)
+		src.WriteString(text)
+		line += strings.Count(text, "\n")
+	}
+	lines := func(line int) (string, int, bool) {
+		i := sort.Search(len(starts), func(i int) bool { return starts[i] > line }) - 1
+		if i < 0 {
+			return "", 0, false
+		}
+		return modules[i].path, line - starts[i] + 1, true
+	}
+
+	p := parser.New(lexer.New(src.String()))
+	program := p.ParseProgram()
+	errs := typecheck.Diagnostics{}
+	// every module parsed on its own, so joining them should not fail
+	for _, msg := range p.Errors {
+		errs = append(errs, typecheck.Diagnostic{Message: msg, Severity: typecheck.SeverityError})
+	}
+	return append(errs, typecheck.CheckProgram(program)...), lines
+}
+
+// applyModuleDirectives applies the //pisuke: directives of each module to
+// files, the modules parsed: an import is added to the file of its module
+// only, while nofmt in any module turns formatting off for the package, as
+// it does for inlined modules.
+func applyModuleDirectives(modules []moduleFile, files []codegen.File, opts *codegen.GenerateOptions) error {
+	for i, m := range modules {
+		fileOpts := codegen.GenerateOptions{Format: opts.Format}
+		if err := applyDirectives(m.src, &fileOpts); err != nil {
+			return fmt.Errorf("%s: %s", m.path, err)
+		}
+		files[i].Imports = fileOpts.Imports
+		opts.Format = fileOpts.Format
+	}
+	return nil
+}
+
+// moduleFile is one .psk file of a multi-file build with its import
+// statements removed. Import lines are blanked rather than deleted so line
+// numbers still match the original file.
+type moduleFile struct {
+	path   string // the module's resolved path (or the entry file), for //line directives
+	goName string // name of the generated Go file
+	src    string
+}
+
+// collectModules resolves the imports of entryFile like preprocessImports,
+// but keeps every module as a file of its own instead of inlining it. The
+// modules come first, each after the modules it imports, and the entry file
+// is last. Namespaced modules have their names prefixed as with inlining.
+func collectModules(entryFile, content string, cache *moduleCache) ([]moduleFile, error) {
+	files := []moduleFile{}
+	visited := make(map[string]bool)
+	src, err := collectModulesRecursive(filepath.Dir(entryFile), content, visited, cache, &files)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, moduleFile{path: entryFile, src: src})
+
+	// name the Go files after the modules' paths from the entry file's
+	// directory, keeping the names unique
+	entryDir, err := filepath.Abs(filepath.Dir(entryFile))
+	if err != nil {
+		return nil, err
+	}
+	taken := map[string]bool{}
+	for i := range files {
+		base := "pisuke_main"
+		if i < len(files)-1 {
+			rel, err := filepath.Rel(entryDir, files[i].path)
+			if err != nil {
+				rel = filepath.Base(files[i].path)
+			}
+			base = "pisuke_" + goFileNameRe.ReplaceAllString(strings.TrimSuffix(rel, ".psk"), "_")
+		}
+		name := base + ".go"
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s_%d.go", base, n)
+		}
+		taken[name] = true
+		files[i].goName = name
+	}
+	return files, nil
+}
+
+var goFileNameRe = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// collectModulesRecursive appends the modules imported by content (and,
+// first, their own imports) to files and returns content with its import
+// statements removed.
+func collectModulesRecursive(baseDir, content string, visited map[string]bool, cache *moduleCache, files *[]moduleFile) (string, error) {
+	result := content
+	for _, m := range namespaceImportRe.FindAllStringSubmatch(content, -1) {
+		namespace, modulePath := m[1], m[2]
+		abs, err := resolveModulePath(baseDir, modulePath)
+		if err != nil {
+			return "", err
+		}
+		key := abs + "#" + namespace
+		if !visited[key] {
+			data, err := cache.read(abs)
+			if err != nil {
+				return "", fmt.Errorf("cannot read module %s: %w", modulePath, err)
+			}
+			visited[key] = true
+			src, err := collectModulesRecursive(filepath.Dir(abs), data, visited, cache, files)
+			if err != nil {
+				return "", err
+			}
+			prefixed, names := namespaceModule(src, namespace)
+			*files = append(*files, moduleFile{path: abs, src: prefixed})
+			result = qualifyNamespaceReferences(result, namespace, names)
+		}
+		result = strings.Replace(result, m[0], "", -1)
+	}
+
+	for _, m := range importRe.FindAllStringSubmatch(content, -1) {
+		modulePath := m[1]
+		abs, err := resolveModulePath(baseDir, modulePath)
+		if err != nil {
+			return "", err
+		}
+		if !visited[abs] {
+			data, err := cache.read(abs)
+			if err != nil {
+				return "", fmt.Errorf("cannot read module %s: %w", modulePath, err)
+			}
+			visited[abs] = true
+			src, err := collectModulesRecursive(filepath.Dir(abs), data, visited, cache, files)
+			if err != nil {
+				return "", err
+			}
+			*files = append(*files, moduleFile{path: abs, src: src})
+		}
+		result = strings.Replace(result, m[0], "", -1)
+	}
+	return result, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// topLevelDeclRe matches declarations that start at the beginning of a line:
+// `let name`, `const name`, `fn name` and `type name`. Names may use any
+// letters, as in the lexer.
+var topLevelDeclRe = regexp.MustCompile(`(?m)^(?:let|const|fn|type)\s+([\p{L}_][\p{L}0-9_]*)`)
+
+var identRe = regexp.MustCompile(`[\p{L}_][\p{L}0-9_]*`)
+
+// namespaceModule prefixes every top-level name declared in src with
+// "<namespace>_" and rewrites the module's own references to match. It
+// returns the rewritten source and the set of original names.
+//
+// Only unindented declarations count as top-level. Property names after a
+// '.', keys of map literals and fields of type definitions, as in
+// {name: "x"}, and text inside strings or comments are left alone.
+func namespaceModule(src, namespace string) (string, map[string]bool) {
+	names := map[string]bool{}
+	for _, m := range topLevelDeclRe.FindAllStringSubmatch(src, -1) {
+		names[m[1]] = true
+	}
+	if len(names) == 0 {
+		return src, names
+	}
+	braces := braceTracker{}
+	out := mapCode(src, func(code string, prev byte) string {
+		var b strings.Builder
+		last, scanned := 0, 0
+		for _, loc := range identRe.FindAllStringIndex(code, -1) {
+			start, end := loc[0], loc[1]
+			braces.scan(code[scanned:start])
+			braces.word(code[start:end])
+			scanned = end
+			// skip identifiers glued to a preceding word character; the
+			// regex has no word boundaries so check by hand
+			before := prev
+			if start > 0 {
+				before = code[start-1]
+			}
+			if isWordByte(before) || before == '.' || !names[code[start:end]] {
+				continue
+			}
+			if braces.inLiteral() && strings.HasPrefix(strings.TrimLeft(code[end:], " \t"), ":") {
+				continue
+			}
+			b.WriteString(code[last:start])
+			b.WriteString(namespace + "_" + code[start:end])
+			last = end
+		}
+		braces.scan(code[scanned:])
+		b.WriteString(code[last:])
+		return b.String()
+	})
+	return out, names
+}
+
+// braceTracker follows the braces of source scanned in order and tells the
+// braces of map literals and type definitions, where a name followed by ':'
+// is a key or a field, apart from those of blocks. A brace opens a literal
+// unless it follows ')' or a word other than return, as in `fn f() {`,
+// `fn f(): int {` or `switch x {`.
+type braceTracker struct {
+	literals []bool
+	// prev is the last character scanned other than a space, or 0 after a
+	// word, whose text is then in prevWord
+	prev     byte
+	prevWord string
+}
+
+func (t *braceTracker) scan(code string) {
+	for i := 0; i < len(code); i++ {
+		switch ch := code[i]; ch {
+		case ' ', '\t', '\n', '\r':
+		case '{':
+			block := t.prev == ')' || t.prev == 0 && t.prevWord != "" && t.prevWord != "return"
+			t.literals = append(t.literals, !block)
+			t.prev = ch
+		case '}':
+			if len(t.literals) > 0 {
+				t.literals = t.literals[:len(t.literals)-1]
+			}
+			t.prev = ch
+		default:
+			t.prev = ch
+		}
+	}
+}
+
+func (t *braceTracker) word(w string) {
+	t.prev, t.prevWord = 0, w
+}
+
+// inLiteral reports whether the innermost open brace is a literal's.
+func (t *braceTracker) inLiteral() bool {
+	return len(t.literals) > 0 && t.literals[len(t.literals)-1]
+}
+
+// qualifyNamespaceReferences rewrites `namespace.name` to `namespace_name`
+// for each name exported by a namespaced module.
+func qualifyNamespaceReferences(src, namespace string, names map[string]bool) string {
+	re := regexp.MustCompile(regexp.QuoteMeta(namespace) + `\.([\p{L}_][\p{L}0-9_]*)`)
+	return mapCode(src, func(code string, prev byte) string {
+		var b strings.Builder
+		last := 0
+		for _, loc := range re.FindAllStringSubmatchIndex(code, -1) {
+			start, end := loc[0], loc[1]
+			before := prev
+			if start > 0 {
+				before = code[start-1]
+			}
+			if isWordByte(before) || before == '.' || !names[code[loc[2]:loc[3]]] {
+				continue
+			}
+			b.WriteString(code[last:start])
+			b.WriteString(namespace + "_" + code[loc[2]:loc[3]])
+			last = end
+		}
+		b.WriteString(code[last:])
+		return b.String()
+	})
+}
+
+// mapCode applies fn to the parts of src that are neither string literals nor
+// line comments. fn also receives the byte preceding the part (0 at the start).
+func mapCode(src string, fn func(code string, prev byte) string) string {
+	var out strings.Builder
+	start := 0
+	flush := func(end int) {
+		var prev byte
+		if start > 0 {
+			prev = src[start-1]
+		}
+		out.WriteString(fn(src[start:end], prev))
+	}
+	for i := 0; i < len(src); i++ {
+		switch {
+		case src[i] == '"':
+			flush(i)
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				j++
+			}
+			if j < len(src) {
+				j++
+			}
+			out.WriteString(src[i:j])
+			start, i = j, j-1
+		case src[i] == '/' && i+1 < len(src) && src[i+1] == '/':
+			flush(i)
+			j := i
+			for j < len(src) && src[j] != '\n' {
+				j++
+			}
+			out.WriteString(src[i:j])
+			start, i = j, j-1
+		}
+	}
+	flush(len(src))
+	return out.String()
+}
+
+// isWordByte reports whether ch may be part of an identifier. Bytes of
+// non-ASCII characters count, since identifiers may use any letters.
+func isWordByte(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || ch == '_' || ch >= utf8.RuneSelf
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"pisuke/codegen"
+	"strings"
+)
+
+const (
+	beginModuleMarker = "// begin inlined module: "
+	endModuleMarker   = "// end inlined module: "
+)
+
+// sourceLine is the origin of one line of preprocessed source.
+type sourceLine struct {
+	file string
+	line int
+}
+
+// buildLineMap reconstructs where each line of processed (the output of
+// preprocessImports for entryFile) originally came from, using the marker
+// comments written around inlined modules. Marker lines have no origin.
+func buildLineMap(entryFile, processed string) codegen.LineResolver {
+	type frame struct {
+		file   string
+		line   int
+		resume bool // the next line continues the line the import was on
+	}
+	stack := []*frame{{file: entryFile}}
+	origins := []sourceLine{{}} // index 0 is unused, lines are 1-based
+
+	for _, text := range strings.Split(processed, "\n") {
+		trimmed := strings.TrimSpace(text)
+		top := stack[len(stack)-1]
+		switch {
+		case strings.HasPrefix(trimmed, beginModuleMarker):
+			// the marker holds the path of the module's file; namespaced
+			// imports are marked as "<path> as <name>"
+			file := strings.TrimPrefix(trimmed, beginModuleMarker)
+			if i := strings.LastIndex(file, " as "); i >= 0 {
+				file = file[:i]
+			}
+			stack = append(stack, &frame{file: file})
+			origins = append(origins, sourceLine{})
+		case strings.HasPrefix(trimmed, endModuleMarker) && len(stack) > 1:
+			stack = stack[:len(stack)-1]
+			stack[len(stack)-1].resume = true
+			origins = append(origins, sourceLine{})
+		default:
+			if top.resume {
+				top.resume = false
+			} else {
+				top.line++
+			}
+			origins = append(origins, sourceLine{top.file, top.line})
+		}
+	}
+
+	return func(line int) (string, int, bool) {
+		if line <= 0 || line >= len(origins) || origins[line].file == "" {
+			return "", 0, false
+		}
+		return origins[line].file, origins[line].line, true
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// watchInterval is how often watch mode checks the watched files.
+const watchInterval = 500 * time.Millisecond
+
+// watch calls rebuild, which returns the files the build read, and calls it
+// again whenever one of those files changes. Files are polled every interval
+// until stop is closed; a nil stop watches forever.
+func watch(rebuild func() []string, interval time.Duration, stop <-chan struct{}) {
+	for {
+		files := rebuild()
+		seen := modTimes(files)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			if changed(seen, modTimes(files)) {
+				break
+			}
+		}
+	}
+}
+
+// modTimes returns the modification time of each file; a file that cannot
+// be read has time zero, so creating or deleting it counts as a change.
+func modTimes(files []string) map[string]int64 {
+	times := map[string]int64{}
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			times[f] = info.ModTime().UnixNano()
+		} else {
+			times[f] = 0
+		}
+	}
+	return times
+}
+
+func changed(before, after map[string]int64) bool {
+	for f, t := range after {
+		if before[f] != t {
+			return true
+		}
+	}
+	return false
+}
+
+// watchBuild runs one watch mode build of opts.inputFile, printing the result
+// to w, and returns the input file and the modules it imports. Imports are
+// resolved afresh each time through an in-memory cache, whose entries are
+// then exactly the modules this build read.
+func watchBuild(w io.Writer, opts cliOptions, stages stageLogger) []string {
+	files := []string{opts.inputFile}
+	fmt.Fprintf(w, "[%s] building %s\n", time.Now().Format("15:04:05"), opts.inputFile)
+	data, err := ioutil.ReadFile(opts.inputFile)
+	if err != nil {
+		fmt.Fprintf(w, "Error reading file: %s\n", err)
+		return files
+	}
+	cache := newModuleCache()
+	processed, err := preprocessImports(opts.inputFile, string(data), cache)
+	modules := []string{}
+	for abs := range cache.entries {
+		modules = append(modules, abs)
+	}
+	sort.Strings(modules)
+	files = append(files, modules...)
+	if err != nil {
+		fmt.Fprintf(w, "Error processing imports: %s\n", err)
+		return files
+	}
+	buildSource(w, opts, processed, stages)
+	fmt.Fprintf(w, "watching %d file(s) for changes\n", len(files))
+	return files
+}
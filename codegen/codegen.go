@@ -3,22 +3,71 @@ package codegen
 import (
 	"bytes"
 	"fmt"
+	"go/format"
+	"path"
 	"pisuke/ast"
+	"pisuke/eval"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// capitalizeFirst upper-cases the first rune of s, so that a field name
+// becomes an exported Go identifier.
 func capitalizeFirst(s string) string {
-	if s == "" {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
 		return s
 	}
-	return strings.ToUpper(string(s[0])) + s[1:]
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// LineResolver maps a line of the source handed to the parser back to the
+// .psk file and line it came from. It reports false for lines that have no
+// origin, such as marker comments added by import inlining.
+type LineResolver func(line int) (file string, origLine int, ok bool)
+
+// SingleFile returns a LineResolver for source that was parsed unmodified
+// from file.
+func SingleFile(file string) LineResolver {
+	return func(line int) (string, int, bool) {
+		return file, line, true
+	}
 }
 
 type Generator struct {
 	out         *bytes.Buffer
 	indentlevel int
 
+	// Lines, when set, makes the generator emit //line directives so Go
+	// compiler errors point back at the original .psk source.
+	Lines LineResolver
+	// TargetGoVersion is the Go release the output is compiled with, such as
+	// "1.22". Empty targets the oldest supported release. Go 1.18 and later
+	// get `any` instead of `interface{}`, and Go 1.22 and later route path
+	// parameters with ServeMux wildcard patterns.
+	TargetGoVersion string
+	// UseAny spells the empty interface `any` unless TargetGoVersion names
+	// a release before Go 1.18, which has no `any`.
+	UseAny bool
+	// CheckedArith makes int +, - and * call helpers that panic on overflow
+	// instead of wrapping around.
+	CheckedArith bool
+	// Package is the name of the generated Go package. Empty or "main"
+	// generates a program; any other name generates a library package with
+	// no main, whose top-level statements run in init().
+	Package string
+	// Format runs the generated code through gofmt. Code gofmt cannot parse
+	// is returned as generated so the Go compiler can report the problem.
+	Format bool
+	// Errors lists the problems found while generating, such as malformed
+	// server.route calls. The generated code is not usable when it is
+	// non-empty.
+	Errors []string
+
 	requiresHttp       bool
 	requiresLog        bool
 	requiresFmt        bool
@@ -28,10 +77,259 @@ type Generator struct {
 	requiresJson       bool
 	requiresIo         bool
 	requiresStrings    bool
+	// requiresMath imports math for the math.sqrt family of built-ins
+	requiresMath bool
+	// requiresOs imports os for the env built-in
+	requiresOs bool
+	// requiresTime imports time for the sleep built-in
+	requiresTime bool
+	// requiresStrconv imports strconv for the queryInt request accessor
+	requiresStrconv bool
+
+	// list helpers backing the map/filter/reduce built-ins, emitted after main
+	requiresMapHelper    bool
+	requiresFilterHelper bool
+	requiresReduceHelper bool
+	// membership helpers backing the in operator, emitted after main
+	requiresContainsHelper bool
+	requiresHasKeyHelper   bool
+	// requiresHTML emits the pskHTML type produced by the html built-in
+	requiresHTML     bool
+	requiresTemplate bool
+	// requiresCheckedArith emits the overflow checking helpers
+	requiresCheckedArith bool
+
+	// goPackages maps the package name of each `use "path"` directive to its
+	// import path, e.g. url -> net/url
+	goPackages map[string]string
+	// functions holds the named top-level functions, whose omitted trailing
+	// arguments are filled in from parameter defaults at each call
+	functions map[string]*ast.FunctionLiteral
+	// functionValues maps lets holding a named function, let f = double,
+	// to that function, so calls through them are typed like direct calls
+	functionValues map[string]*ast.FunctionLiteral
+	// constValues holds the folded values of the constants seen so far
+	constValues map[string]eval.Value
+	// valueTypes records the primitive type of lets, consts and parameters
+	// in scope, used to tell int arithmetic apart from string concatenation
+	valueTypes map[string]string
+	// collectionKinds records whether lets, consts and parameters in scope
+	// hold a list or a map, used to lower the in operator
+	collectionKinds map[string]string
+	// elementTypes records the primitive element type of lets and parameters
+	// in scope holding a list whose elements share one, used to type the
+	// callbacks of map, filter and reduce
+	elementTypes map[string]string
+	// mapNames holds the names the program uses as a map, see ast.MapNames,
+	// whose map literals stay maps rather than being inferred to be structs
+	mapNames map[string]bool
+	// routeHandlers holds the named functions passed to server.route, whose
+	// first parameter is the request map
+	routeHandlers map[string]bool
+
+	// routes maps each ServeMux pattern registered so far, with wildcard
+	// names blanked out, to the line registering it
+	routes map[string]int
+	// guarded is set while generating a `when` guarded statement
+	guarded bool
+	// returnType is the return type of the function whose body is being
+	// generated, checked by try
+	returnType string
+	// routePrefixes is the stack of server.group prefixes enclosing the
+	// routes being generated
+	routePrefixes []string
+	// requestParam is the name of the request parameter of the route
+	// handler whose body is being generated, whose typed accessors such as
+	// req.queryInt("page") read the URL query
+	requestParam string
+
+	// logFormat is the request log template of rich route handlers, set by
+	// the server.logFormat directive; an empty template disables logging
+	logFormat string
+	// logJSON makes rich route handlers log one JSON line per request with
+	// its method, path, status and duration instead of logFormat; set by the
+	// server.logJSON directive
+	logJSON bool
+	// gzip makes route handlers gzip-encode responses for clients that
+	// accept it; set by the server.gzip directive
+	gzip bool
+	// requiresGzip emits pskGzip, the handler wrapper used when gzip is set
+	requiresGzip bool
+	// requiresStatusWriter emits pskStatusWriter, which records the status
+	// code of a response for JSON request logging
+	requiresStatusWriter bool
+	// maxBodySize caps the JSON request body read by rich route handlers,
+	// set by the server.maxBodySize directive
+	maxBodySize int64
+	// recoverPanics makes route handlers turn panics into 500 responses; on
+	// unless disabled with server.recover(false)
+	recoverPanics bool
+	// middlewares are the server.use calls of the program in order; every
+	// route handler runs behind them, see genMiddlewares
+	middlewares []*ast.CallExpression
+
+	// packageLevel is set while emitting package-level declarations of a
+	// module file, where lets become package variables
+	packageLevel bool
+
+	// options holds the GenerateOptions without a Generator field of their
+	// own, the Imports and MaxBodySize, which Reset applies again
+	options GenerateOptions
 }
 
 func NewGenerator() *Generator {
-	return &Generator{out: &bytes.Buffer{}, variableTypes: map[string]string{}, typeDefs: map[string]*ast.TypeDefinition{}}
+	g := &Generator{}
+	g.Reset()
+	return g
+}
+
+// Reset discards everything g recorded while generating, its output, errors,
+// required imports, types and server settings, so that g can generate
+// another program. The exported settings and the options g was created with
+// are kept.
+func (g *Generator) Reset() {
+	*g = Generator{
+		Lines:           g.Lines,
+		TargetGoVersion: g.TargetGoVersion,
+		UseAny:          g.UseAny,
+		CheckedArith:    g.CheckedArith,
+		Package:         g.Package,
+		Format:          g.Format,
+		options:         g.options,
+		out:             &bytes.Buffer{},
+		variableTypes:   map[string]string{},
+		typeDefs:        map[string]*ast.TypeDefinition{},
+		goPackages:      map[string]string{},
+		functions:       map[string]*ast.FunctionLiteral{},
+		functionValues:  map[string]*ast.FunctionLiteral{},
+		valueTypes:      map[string]string{},
+		collectionKinds: map[string]string{},
+		elementTypes:    map[string]string{},
+		mapNames:        map[string]bool{},
+		routeHandlers:   map[string]bool{},
+		constValues:     map[string]eval.Value{},
+		routes:          map[string]int{},
+		logFormat:       defaultLogFormat,
+		maxBodySize:     defaultMaxBodySize,
+		recoverPanics:   true,
+	}
+	for _, imp := range g.options.Imports {
+		g.goPackages[goPackageName(imp)] = imp
+	}
+	if g.options.MaxBodySize > 0 {
+		g.maxBodySize = g.options.MaxBodySize
+	}
+}
+
+// child returns a generator for a body nested in the code g generates, such
+// as a function or route handler body. It has g's settings, shares the
+// program's type definitions, used packages, named functions and server
+// settings, and starts with copies of the types recorded for the names in
+// scope, so the body sees the variables it captures without leaking its own.
+// Hand it back to adopt once the body is generated.
+func (g *Generator) child() *Generator {
+	c := NewGenerator()
+	c.Lines = g.Lines
+	c.TargetGoVersion = g.TargetGoVersion
+	c.UseAny = g.UseAny
+	c.CheckedArith = g.CheckedArith
+	c.Package = g.Package
+	c.typeDefs = g.typeDefs
+	c.goPackages = g.goPackages
+	c.functions = g.functions
+	c.routes = g.routes
+	c.mapNames = g.mapNames
+	c.routeHandlers = g.routeHandlers
+	c.variableTypes = copyScope(g.variableTypes)
+	c.valueTypes = copyScope(g.valueTypes)
+	c.collectionKinds = copyScope(g.collectionKinds)
+	c.elementTypes = copyScope(g.elementTypes)
+	for k, v := range g.functionValues {
+		c.functionValues[k] = v
+	}
+	for k, v := range g.constValues {
+		c.constValues[k] = v
+	}
+	c.logFormat = g.logFormat
+	c.logJSON = g.logJSON
+	c.gzip = g.gzip
+	c.maxBodySize = g.maxBodySize
+	c.recoverPanics = g.recoverPanics
+	c.middlewares = g.middlewares
+	c.requiresMiddleware = g.requiresMiddleware
+	c.routePrefixes = g.routePrefixes
+	c.requestParam = g.requestParam
+	c.indentlevel = g.indentlevel
+	return c
+}
+
+// adopt takes over what the child generator c needed while generating: the
+// imports and runtime helpers it requires, and its errors.
+func (g *Generator) adopt(c *Generator) {
+	g.requiresHttp = g.requiresHttp || c.requiresHttp
+	g.requiresLog = g.requiresLog || c.requiresLog
+	g.requiresFmt = g.requiresFmt || c.requiresFmt
+	g.requiresMiddleware = g.requiresMiddleware || c.requiresMiddleware
+	g.requiresJson = g.requiresJson || c.requiresJson
+	g.requiresIo = g.requiresIo || c.requiresIo
+	g.requiresStrings = g.requiresStrings || c.requiresStrings
+	g.requiresMath = g.requiresMath || c.requiresMath
+	g.requiresOs = g.requiresOs || c.requiresOs
+	g.requiresTime = g.requiresTime || c.requiresTime
+	g.requiresStrconv = g.requiresStrconv || c.requiresStrconv
+	g.requiresMapHelper = g.requiresMapHelper || c.requiresMapHelper
+	g.requiresFilterHelper = g.requiresFilterHelper || c.requiresFilterHelper
+	g.requiresReduceHelper = g.requiresReduceHelper || c.requiresReduceHelper
+	g.requiresContainsHelper = g.requiresContainsHelper || c.requiresContainsHelper
+	g.requiresHasKeyHelper = g.requiresHasKeyHelper || c.requiresHasKeyHelper
+	g.requiresHTML = g.requiresHTML || c.requiresHTML
+	g.requiresTemplate = g.requiresTemplate || c.requiresTemplate
+	g.requiresCheckedArith = g.requiresCheckedArith || c.requiresCheckedArith
+	g.requiresGzip = g.requiresGzip || c.requiresGzip
+	g.requiresStatusWriter = g.requiresStatusWriter || c.requiresStatusWriter
+	g.Errors = append(g.Errors, c.Errors...)
+}
+
+// copyScope returns a copy of the per-name scope information m.
+func copyScope(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// anyType is the spelling of the empty interface in generated code. All code
+// emitting the empty interface goes through it. An explicit target before
+// Go 1.18 always gets interface{}, since `any` would not compile there.
+func (g *Generator) anyType() string {
+	if g.TargetGoVersion != "" && !goVersionAtLeast(g.TargetGoVersion, 18) {
+		return "interface{}"
+	}
+	if g.UseAny || goVersionAtLeast(g.TargetGoVersion, 18) {
+		return "any"
+	}
+	return "interface{}"
+}
+
+// goVersionAtLeast reports whether version ("1.22", "go1.22" or "1.22.3") is
+// Go 1.minor or later. An empty or malformed version reports false.
+func goVersionAtLeast(version string, minor int) bool {
+	parts := strings.Split(strings.TrimPrefix(version, "go"), ".")
+	if len(parts) < 2 || parts[0] != "1" {
+		return false
+	}
+	n, err := strconv.Atoi(parts[1])
+	return err == nil && n >= minor
+}
+
+// errorf records a generation error at the line of node.
+func (g *Generator) errorf(node ast.Node, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if line := ast.LineOf(node); line > 0 {
+		msg = fmt.Sprintf("line %d: %s", line, msg)
+	}
+	g.Errors = append(g.Errors, msg)
 }
 
 func (g *Generator) indent() {
@@ -48,253 +346,1422 @@ func (g *Generator) writeLine(s string) {
 	g.out.WriteString("\n")
 }
 
+// lineDirective writes a //line directive for node when line information is
+// available. Directives must start at the beginning of a line, so this is
+// called before indenting.
+func (g *Generator) lineDirective(node ast.Node) {
+	if g.Lines == nil {
+		return
+	}
+	line := ast.LineOf(node)
+	if line <= 0 {
+		return
+	}
+	if file, orig, ok := g.Lines(line); ok {
+		g.write(fmt.Sprintf("//line %s:%d\n", file, orig))
+	}
+}
+
+// GenerateOptions configures code generation. The zero value gives the
+// default settings.
+type GenerateOptions struct {
+	// Lines maps line numbers back to the source files; see Generator.Lines.
+	Lines LineResolver
+	// TargetGoVersion is the Go release the output is compiled with; see
+	// Generator.TargetGoVersion.
+	TargetGoVersion string
+	// UseAny spells the empty interface `any` unless TargetGoVersion is
+	// before Go 1.18.
+	UseAny bool
+	// CheckedArith makes int arithmetic panic on overflow.
+	CheckedArith bool
+	// MaxBodySize caps the JSON request body read by rich route handlers
+	// when the program has no server.maxBodySize directive. Zero keeps the
+	// 1MB default.
+	MaxBodySize int64
+	// Package is the name of the generated Go package; see
+	// Generator.Package.
+	Package string
+	// Format gofmts the generated code; see Generator.Format.
+	Format bool
+	// Imports lists Go import paths added to the generated code. Their
+	// packages can be called like those brought in with `use`.
+	Imports []string
+}
+
+// NewGeneratorWith returns a Generator configured by opts.
+func NewGeneratorWith(opts GenerateOptions) *Generator {
+	g := &Generator{
+		Lines:           opts.Lines,
+		TargetGoVersion: opts.TargetGoVersion,
+		UseAny:          opts.UseAny,
+		CheckedArith:    opts.CheckedArith,
+		Package:         opts.Package,
+		Format:          opts.Format,
+		options:         GenerateOptions{Imports: opts.Imports, MaxBodySize: opts.MaxBodySize},
+	}
+	g.Reset()
+	return g
+}
+
+// Generate transpiles program with the default settings. Generation errors
+// are dropped; use GenerateWith to get them.
 func Generate(program *ast.Program) string {
-	g := NewGenerator()
+	code, _ := GenerateWith(program, GenerateOptions{})
+	return code
+}
+
+// GenerateWith transpiles program with the settings in opts and returns the
+// Go source along with the generation errors, if any.
+func GenerateWith(program *ast.Program, opts GenerateOptions) (string, []string) {
+	return NewGeneratorWith(opts).Generate(program)
+}
+
+// Generate transpiles program into a Go source file using g's settings. It
+// also returns the errors recorded in g.Errors, such as unsupported nodes;
+// the code must not be used when there are any.
+func (g *Generator) Generate(program *ast.Program) (string, []string) {
 	var codeBuf bytes.Buffer
 	g.out = &codeBuf
-	g.genProgram(program)
+	if g.isLibrary() {
+		g.genLibrary(program)
+	} else {
+		g.genProgram(program)
+	}
+	return g.gofmt(g.assemble(codeBuf.Bytes())), g.Errors
+}
+
+// gofmt formats code when g.Format is set. Code that does not parse is
+// returned as is, for the Go compiler to report.
+func (g *Generator) gofmt(code string) string {
+	if !g.Format {
+		return code
+	}
+	if formatted, err := format.Source([]byte(code)); err == nil {
+		return string(formatted)
+	}
+	return code
+}
+
+// isLibrary reports whether g generates a library package rather than a
+// program.
+func (g *Generator) isLibrary() bool {
+	return g.Package != "" && g.Package != "main"
+}
 
+// packageName returns the name used in the package clause.
+func (g *Generator) packageName() string {
+	if g.isLibrary() {
+		return g.Package
+	}
+	return "main"
+}
+
+// assemble prefixes generated code with the package clause and the imports
+// the code requires.
+func (g *Generator) assemble(code []byte) string {
 	var finalBuf bytes.Buffer
-	finalBuf.WriteString("package main\n\n")
+	finalBuf.WriteString("package " + g.packageName() + "\n\n")
 
-	if g.requiresHttp || g.requiresLog || g.requiresFmt {
+	imports := g.imports()
+	if len(imports) > 0 {
 		finalBuf.WriteString("import (\n")
-		if g.requiresFmt {
-			finalBuf.WriteString("\t\"fmt\"\n")
+		for _, imp := range imports {
+			finalBuf.WriteString("\t\"" + imp + "\"\n")
 		}
-		if g.requiresLog {
-			finalBuf.WriteString("\t\"log\"\n")
+		finalBuf.WriteString(")\n\n")
+	}
+
+	finalBuf.Write(code)
+	return finalBuf.String()
+}
+
+// imports lists the packages the generated code needs: the standard library
+// packages required by built-ins followed by those added with `use`.
+func (g *Generator) imports() []string {
+	imports := []string{}
+	seen := map[string]bool{}
+	add := func(imp string, required bool) {
+		if required && !seen[imp] {
+			seen[imp] = true
+			imports = append(imports, imp)
 		}
-		if g.requiresHttp {
-			finalBuf.WriteString("\t\"net/http\"\n")
+	}
+	add("fmt", g.requiresFmt)
+	add("log", g.requiresLog)
+	add("net/http", g.requiresHttp)
+	add("encoding/json", g.requiresJson)
+	add("io/ioutil", g.requiresIo)
+	add("strings", g.requiresStrings)
+	add("math", g.requiresMath)
+	add("os", g.requiresOs)
+	add("time", g.requiresTime)
+	add("strconv", g.requiresStrconv)
+	add("compress/gzip", g.requiresGzip)
+	add("html/template", g.requiresTemplate)
+	used := []string{}
+	for _, imp := range g.goPackages {
+		used = append(used, imp)
+	}
+	sort.Strings(used)
+	for _, imp := range used {
+		add(imp, true)
+	}
+	return imports
+}
+
+// goPackageName returns the name a Go import path is referred to by: its last
+// element, skipping a major version suffix such as the v2 in math/rand/v2.
+func goPackageName(importPath string) string {
+	name := path.Base(importPath)
+	if len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		if parent := path.Dir(importPath); parent != "." {
+			return path.Base(parent)
 		}
-		if g.requiresJson {
-			finalBuf.WriteString("\t\"encoding/json\"\n")
+	}
+	return name
+}
+
+// defaultLogFormat is the request log template used unless the program sets
+// one with server.logFormat.
+const defaultLogFormat = "{method} {path}"
+
+// defaultMaxBodySize is the request body limit (1MB) used unless the program
+// sets one with server.maxBodySize.
+const defaultMaxBodySize = 1 << 20
+
+// logPlaceholders maps the placeholders of a server.logFormat template to
+// the request values they print.
+var logPlaceholders = map[string]string{
+	"method": "r.Method",
+	"path":   "r.URL.Path",
+	"query":  "r.URL.RawQuery",
+	"remote": "r.RemoteAddr",
+}
+
+// logPrintfCall turns a log template such as "{method} {path}" into the
+// matching log.Printf call. Unknown placeholders are printed as written.
+func logPrintfCall(template string) string {
+	var format strings.Builder
+	args := []string{}
+	for len(template) > 0 {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			break
 		}
-		if g.requiresIo {
-			finalBuf.WriteString("\t\"io/ioutil\"\n")
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 {
+			break
 		}
-		if g.requiresStrings {
-			finalBuf.WriteString("\t\"strings\"\n")
+		name := template[open+1 : open+end]
+		format.WriteString(strings.ReplaceAll(template[:open], "%", "%%"))
+		if expr, ok := logPlaceholders[name]; ok {
+			format.WriteString("%s")
+			args = append(args, expr)
+		} else {
+			format.WriteString(strings.ReplaceAll(template[open:open+end+1], "%", "%%"))
 		}
-		finalBuf.WriteString(")\n\n")
+		template = template[open+end+1:]
 	}
+	format.WriteString(strings.ReplaceAll(template, "%", "%%"))
+	call := "log.Printf(" + strconv.Quote(format.String())
+	for _, a := range args {
+		call += ", " + a
+	}
+	return call + ")"
+}
 
-	finalBuf.Write(codeBuf.Bytes())
-	return finalBuf.String()
+// isServerDirective reports whether expr is a server configuration call such
+// as server.logFormat(...). Directives are applied by applyServerDirectives
+// and produce no code of their own.
+func isServerDirective(expr ast.Expression) bool {
+	call, ok := expr.(*ast.CallExpression)
+	if !ok {
+		return false
+	}
+	mae, ok := call.Function.(*ast.MemberAccessExpression)
+	if !ok {
+		return false
+	}
+	obj, ok := mae.Object.(*ast.Identifier)
+	if !ok || obj.Value != "server" {
+		return false
+	}
+	switch mae.Property.Value {
+	case "logFormat", "logJSON", "gzip", "maxBodySize", "recover", "use":
+		return true
+	}
+	return false
 }
 
-func (g *Generator) genProgram(program *ast.Program) {
-	// Emit named functions first
+// applyServerDirectives records the settings of top-level server directives
+// so they apply to every route regardless of where they appear.
+func (g *Generator) applyServerDirectives(program *ast.Program) {
 	for _, stmt := range program.Statements {
-		// find top-level expressions that are function literals with names
-		if es, ok := stmt.(*ast.ExpressionStatement); ok {
-			if fl, ok := es.Expression.(*ast.FunctionLiteral); ok && fl.Name != nil {
-				// emit a top-level function
-				g.writeLine(g.genFunctionLiteralTopLevel(fl))
-			}
+		es, ok := stmt.(*ast.ExpressionStatement)
+		if !ok || !isServerDirective(es.Expression) {
+			continue
 		}
-		if ls, ok := stmt.(*ast.LetStatement); ok {
-			if fl, ok := ls.Value.(*ast.FunctionLiteral); ok && fl.Name != nil {
-				g.writeLine(g.genFunctionLiteralTopLevel(fl))
+		call := es.Expression.(*ast.CallExpression)
+		switch call.Function.(*ast.MemberAccessExpression).Property.Value {
+		case "logFormat":
+			if len(call.Arguments) == 1 {
+				if sl, ok := call.Arguments[0].(*ast.StringLiteral); ok {
+					g.logFormat = sl.Value
+				}
+			}
+		case "logJSON":
+			if len(call.Arguments) == 1 {
+				if ident, ok := call.Arguments[0].(*ast.Identifier); ok {
+					g.logJSON = ident.Value == "true"
+				}
+			}
+		case "gzip":
+			if len(call.Arguments) == 1 {
+				if ident, ok := call.Arguments[0].(*ast.Identifier); ok {
+					g.gzip = ident.Value == "true"
+				}
+			}
+		case "maxBodySize":
+			if len(call.Arguments) == 1 {
+				if il, ok := call.Arguments[0].(*ast.IntegerLiteral); ok && il.Value > 0 {
+					g.maxBodySize = il.Value
+				}
+			}
+		case "recover":
+			if len(call.Arguments) == 1 {
+				if ident, ok := call.Arguments[0].(*ast.Identifier); ok {
+					g.recoverPanics = ident.Value != "false"
+				}
+			}
+		case "use":
+			// the entry file of a package is scanned twice; record each
+			// call once
+			seen := false
+			for _, m := range g.middlewares {
+				seen = seen || m == call
+			}
+			if !seen {
+				g.middlewares = append(g.middlewares, call)
+				g.requiresMiddleware = true
 			}
 		}
 	}
+}
 
-	// If middleware groundwork requested, emit helper before main
-	if g.requiresMiddleware {
-		g.writeLine("var middlewares []func(http.HandlerFunc) http.HandlerFunc")
-		g.writeLine("func wrapHandler(h http.HandlerFunc) http.HandlerFunc {")
-		g.indentlevel++
-		g.writeLine("for i := len(middlewares)-1; i >= 0; i-- {")
-		g.indentlevel++
-		g.writeLine("h = middlewares[i](h)")
-		g.indentlevel--
-		g.writeLine("}")
-		g.writeLine("return h")
-		g.indentlevel--
-		g.writeLine("}")
-	}
+func (g *Generator) genProgram(program *ast.Program) {
+	g.recordDeclarations(program)
+	g.applyServerDirectives(program)
+
+	// Emit named functions first
+	g.genNamedFunctions(program)
 
 	g.writeLine("func main() {")
 	g.indentlevel++
 	for _, stmt := range program.Statements {
 		g.genStatement(stmt)
 	}
+	// a user-defined main runs after the top-level statements
+	if fl, ok := g.functions["main"]; ok {
+		if len(fl.Parameters) > 0 {
+			g.errorf(fl, "fn main must not take parameters")
+		}
+		g.writeLine(userMainName + "()")
+	}
 	g.indentlevel--
 	g.writeLine("}")
+
+	g.genRuntimeHelpers()
 }
 
-// genFunctionLiteralTopLevel emits a named Go function declaration for a FunctionLiteral
-func (g *Generator) genFunctionLiteralTopLevel(node *ast.FunctionLiteral) string {
-	var b bytes.Buffer
-	params := []string{}
-	for _, p := range node.Parameters {
-		if node.ParamTypes != nil {
-			if t, ok := node.ParamTypes[p.Value]; ok {
-				goType := mapTypeToGo(t)
-				params = append(params, p.Value+" "+goType)
-				continue
-			}
-		}
-		params = append(params, p.Value+" interface{}")
+// genLibrary emits program as a library package: its declarations are
+// generated like those of a module file, so a program made only of
+// functions, types and constants has no main or init at all.
+func (g *Generator) genLibrary(program *ast.Program) {
+	g.genModule(program)
+	g.genRuntimeHelpers()
+}
+
+// genRuntimeHelpers emits the helpers and types the generated code uses.
+func (g *Generator) genRuntimeHelpers() {
+	g.genMiddlewares()
+	g.genListHelpers()
+	g.genCheckedArithHelpers()
+	if g.requiresGzip {
+		g.genGzipHelpers()
 	}
-	retType := "interface{}"
-	if node.ReturnType != "" {
-		retType = mapTypeToGo(node.ReturnType)
+	if g.requiresStatusWriter {
+		g.writeLine("// pskStatusWriter records the status code written through it")
+		g.writeLine("type pskStatusWriter struct {")
+		g.indentlevel++
+		g.writeLine("http.ResponseWriter")
+		g.writeLine("status int")
+		g.indentlevel--
+		g.writeLine("}")
+		g.writeLine("func (w *pskStatusWriter) WriteHeader(code int) {")
+		g.indentlevel++
+		g.writeLine("w.status = code")
+		g.writeLine("w.ResponseWriter.WriteHeader(code)")
+		g.indentlevel--
+		g.writeLine("}")
 	}
-	b.WriteString(fmt.Sprintf("func %s(%s) %s {", node.Name.Value, strings.Join(params, ", "), retType))
-
-	bodyGen := NewGenerator()
-	bodyGen.indentlevel = 0
-	for _, s := range node.Body.Statements {
-		bodyGen.genStatement(s)
+	if g.requiresHTML {
+		g.writeLine("// pskHTML is a string that route handlers write as text/html")
+		g.writeLine("type pskHTML string")
 	}
-	b.WriteString("\n")
-	b.Write(bodyGen.out.Bytes())
-	b.WriteString("}")
-	return b.String()
 }
 
-func (g *Generator) genStatement(stmt ast.Statement) {
-	g.indent()
-	switch node := stmt.(type) {
-	case *ast.LetStatement:
-		g.genLetStatement(node)
-	case *ast.ConstStatement:
-		g.genConstStatement(node)
-	case *ast.TypeDefinition:
-		g.genTypeDefinition(node)
-	case *ast.ReturnStatement:
-		g.genReturnStatement(node)
-	case *ast.ExpressionStatement:
-		// If this is a named top-level function literal, it has already been
-		// emitted before main by genProgram; skip emitting the literal again.
-		if fl, ok := node.Expression.(*ast.FunctionLiteral); ok && fl.Name != nil {
-			return
+// recordDeclarations records type definitions and used Go packages up front
+// so aliases resolve in function signatures emitted before main and package
+// calls resolve anywhere in the program.
+func (g *Generator) recordDeclarations(program *ast.Program) {
+	for _, stmt := range program.Statements {
+		if td, ok := stmt.(*ast.TypeDefinition); ok {
+			g.typeDefs[td.Name.Value] = td
 		}
-		g.genExpression(node.Expression)
-		g.write("\n")
-	}
-}
-
-func (g *Generator) genExpression(expr ast.Expression) {
-	switch node := expr.(type) {
-	case *ast.IntegerLiteral:
-		g.write(fmt.Sprintf("%d", node.Value))
-	case *ast.StringLiteral:
-		g.write(fmt.Sprintf("\"%s\"", node.Value))
-	case *ast.Identifier:
-		g.write(node.Value)
-	case *ast.ListLiteral:
-		elements := []string{}
-		for _, el := range node.Elements {
-			elements = append(elements, g.captureExpression(el))
+		if us, ok := stmt.(*ast.UseStatement); ok {
+			g.goPackages[goPackageName(us.Path)] = us.Path
 		}
-		g.write(fmt.Sprintf("[]interface{}{%s}", strings.Join(elements, ", ")))
-	case *ast.MapLiteral:
-		pairs := []string{}
-		for key, value := range node.Pairs {
-			// ensure key is a string literal in generated Go map literal
-			var keyStr string
-			if ks, ok := key.(*ast.StringLiteral); ok {
-				keyStr = fmt.Sprintf("\"%s\"", ks.Value)
-			} else if ident, ok := key.(*ast.Identifier); ok {
-				keyStr = fmt.Sprintf("\"%s\"", ident.Value)
-			} else {
-				keyStr = fmt.Sprintf("\"%s\"", g.captureExpression(key))
-			}
-			valStr := g.captureExpression(value)
-			pairs = append(pairs, fmt.Sprintf("%s: %s", keyStr, valStr))
+		if fl := namedFunction(stmt); fl != nil {
+			g.functions[fl.Name.Value] = fl
 		}
-		g.write(fmt.Sprintf("map[string]interface{}{%s}", strings.Join(pairs, ", ")))
-	case *ast.IndexExpression:
-		// If left side is itself an indexed/map access (e.g. req["params"]),
-		// cast it to map[string]interface{} before performing another index:
-		// req["params"].(map[string]interface{})["id"]
-		leftStr := g.captureExpression(node.Left)
-		idxStr := g.captureExpression(node.Index)
-		if strings.Contains(leftStr, "[") {
-			g.write(fmt.Sprintf("%s.(map[string]interface{})[%s]", leftStr, idxStr))
-		} else {
-			g.write(fmt.Sprintf("%s[%s]", leftStr, idxStr))
+	}
+	for name := range ast.MapNames(program.Statements) {
+		g.mapNames[name] = true
+	}
+	ast.Inspect(program.Statements, func(n ast.Node) {
+		call, ok := n.(*ast.CallExpression)
+		if !ok || len(call.Arguments) != 2 {
+			return
 		}
-	case *ast.MemberAccessExpression:
-		// Determine if the object expression is a struct (named or nested)
-		if isStruct, _, _ := g.resolveStructInfo(node.Object); isStruct {
-			g.genExpression(node.Object)
-			g.write(".")
-			g.write(capitalizeFirst(node.Property.Value))
+		mae, ok := call.Function.(*ast.MemberAccessExpression)
+		if !ok || mae.Property.Value != "route" {
 			return
 		}
-		// fallback: map-style access
-		leftStr := g.captureExpression(node.Object)
-		if strings.Contains(leftStr, "[") {
-			// e.g. req["params"] -> req["params"].(map[string]interface{})["prop"]
-			g.write(fmt.Sprintf("%s.(map[string]interface{})[\"%s\"]", leftStr, node.Property.Value))
-		} else {
-			g.write(fmt.Sprintf("%s[\"%s\"]", leftStr, node.Property.Value))
+		if obj, ok := mae.Object.(*ast.Identifier); !ok || obj.Value != "server" {
+			return
 		}
-	case *ast.InfixExpression:
-		g.write("(")
-		g.genExpression(node.Left)
-		g.write(fmt.Sprintf(" %s ", node.Operator))
-		g.genExpression(node.Right)
-		g.write(")")
-	case *ast.FunctionLiteral:
-		g.write(g.genFunctionLiteral(node))
-	case *ast.CallExpression:
-		g.genCallExpression(node)
+		if h, ok := call.Arguments[1].(*ast.Identifier); ok {
+			g.routeHandlers[h.Value] = true
+		}
+	})
+}
+
+// namedFunction returns the named function literal declared by a top-level
+// `fn name() {}` or `let x = fn name() {}` statement, or nil.
+func namedFunction(stmt ast.Statement) *ast.FunctionLiteral {
+	var expr ast.Expression
+	switch s := stmt.(type) {
+	case *ast.ExpressionStatement:
+		expr = s.Expression
+	case *ast.LetStatement:
+		expr = s.Value
+	}
+	if fl, ok := expr.(*ast.FunctionLiteral); ok && fl.Name != nil {
+		return fl
 	}
+	return nil
 }
 
-func (g *Generator) genLetStatement(letStmt *ast.LetStatement) {
-	// If a type annotation exists and the value is a MapLiteral,
-	// emit a typed Go struct literal: TypeName{ Field: value, ... }
-	if letStmt.TypeName != "" {
-		if ml, ok := letStmt.Value.(*ast.MapLiteral); ok {
-			// collect key -> expression map deterministically
-			type pair struct {
-				key     string
-				valExpr ast.Expression
-			}
-			pairs := []pair{}
-			for k, v := range ml.Pairs {
-				keyStr := ""
-				if ks, ok := k.(*ast.StringLiteral); ok {
-					keyStr = ks.Value
-				} else if ident, ok := k.(*ast.Identifier); ok {
-					keyStr = ident.Value
-				} else {
-					keyStr = g.captureExpression(k)
-				}
-				pairs = append(pairs, pair{keyStr, v})
-			}
-			sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
-			fields := []string{}
-			td, hasTypeDef := g.typeDefs[letStmt.TypeName]
-			// build quick lookup from pairs
-			kv := map[string]ast.Expression{}
-			for _, p := range pairs {
-				kv[p.key] = p.valExpr
+// userMainName is the Go name of a user-defined fn main, which would
+// otherwise clash with the generated entrypoint.
+const userMainName = "pskMain"
+
+// funcName returns the Go name of the named function or value name.
+func (g *Generator) funcName(name string) string {
+	if _, ok := g.functions[name]; ok && name == "main" {
+		return userMainName
+	}
+	return name
+}
+
+// genNamedFunctions emits every named top-level function literal as a Go
+// function declaration.
+func (g *Generator) genNamedFunctions(program *ast.Program) {
+	for _, stmt := range program.Statements {
+		if fl := namedFunction(stmt); fl != nil {
+			g.lineDirective(fl)
+			g.writeLine(g.genFunctionLiteralTopLevel(fl))
+		}
+	}
+}
+
+// genListHelpers emits the runtime helpers used by the map, filter and reduce
+// built-ins and the in operator. Lists are []interface{}, so callbacks take
+// and return interface{}.
+func (g *Generator) genListHelpers() {
+	a := g.anyType()
+	if g.requiresMapHelper {
+		g.writeLine(fmt.Sprintf("func pskMap(list %[1]s, f func(%[1]s) %[1]s) []%[1]s {", a))
+		g.indentlevel++
+		g.writeLine(fmt.Sprintf("items, _ := list.([]%s)", a))
+		g.writeLine(fmt.Sprintf("out := make([]%s, 0, len(items))", a))
+		g.writeLine("for _, item := range items {")
+		g.indentlevel++
+		g.writeLine("out = append(out, f(item))")
+		g.indentlevel--
+		g.writeLine("}")
+		g.writeLine("return out")
+		g.indentlevel--
+		g.writeLine("}")
+	}
+	if g.requiresFilterHelper {
+		g.writeLine(fmt.Sprintf("func pskFilter(list %[1]s, f func(%[1]s) %[1]s) []%[1]s {", a))
+		g.indentlevel++
+		g.writeLine(fmt.Sprintf("items, _ := list.([]%s)", a))
+		g.writeLine(fmt.Sprintf("out := make([]%s, 0, len(items))", a))
+		g.writeLine("for _, item := range items {")
+		g.indentlevel++
+		g.writeLine("if keep, _ := f(item).(bool); keep {")
+		g.indentlevel++
+		g.writeLine("out = append(out, item)")
+		g.indentlevel--
+		g.writeLine("}")
+		g.indentlevel--
+		g.writeLine("}")
+		g.writeLine("return out")
+		g.indentlevel--
+		g.writeLine("}")
+	}
+	if g.requiresReduceHelper {
+		g.writeLine(fmt.Sprintf("func pskReduce(list %[1]s, f func(%[1]s, %[1]s) %[1]s, acc %[1]s) %[1]s {", a))
+		g.indentlevel++
+		g.writeLine(fmt.Sprintf("items, _ := list.([]%s)", a))
+		g.writeLine("for _, item := range items {")
+		g.indentlevel++
+		g.writeLine("acc = f(acc, item)")
+		g.indentlevel--
+		g.writeLine("}")
+		g.writeLine("return acc")
+		g.indentlevel--
+		g.writeLine("}")
+	}
+	if g.requiresContainsHelper {
+		g.writeLine(fmt.Sprintf("func pskContains(list %[1]s, v %[1]s) bool {", a))
+		g.indentlevel++
+		g.writeLine(fmt.Sprintf("items, _ := list.([]%s)", a))
+		g.writeLine("for _, item := range items {")
+		g.indentlevel++
+		g.writeLine("if item == v {")
+		g.indentlevel++
+		g.writeLine("return true")
+		g.indentlevel--
+		g.writeLine("}")
+		g.indentlevel--
+		g.writeLine("}")
+		g.writeLine("return false")
+		g.indentlevel--
+		g.writeLine("}")
+	}
+	if g.requiresHasKeyHelper {
+		g.writeLine(fmt.Sprintf("func pskHasKey(m %[1]s, key %[1]s) bool {", a))
+		g.indentlevel++
+		g.writeLine(fmt.Sprintf("entries, _ := m.(map[string]%s)", a))
+		g.writeLine("k, ok := key.(string)")
+		g.writeLine("if !ok {")
+		g.indentlevel++
+		g.writeLine("return false")
+		g.indentlevel--
+		g.writeLine("}")
+		g.writeLine("_, ok = entries[k]")
+		g.writeLine("return ok")
+		g.indentlevel--
+		g.writeLine("}")
+	}
+}
+
+// checkedArithHelpers maps the int operators checked in CheckedArith mode to
+// their helper functions.
+var checkedArithHelpers = map[string]string{
+	"+": "pskCheckedAdd",
+	"-": "pskCheckedSub",
+	"*": "pskCheckedMul",
+}
+
+// isIntExpr reports whether expr is known to produce an int: integer
+// literals, names recorded as int, calls of functions returning int and
+// arithmetic on those.
+func (g *Generator) isIntExpr(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral:
+		return true
+	case *ast.Identifier:
+		return g.valueTypes[e.Value] == "int"
+	case *ast.InfixExpression:
+		_, arith := checkedArithHelpers[e.Operator]
+		return arith && g.isIntExpr(e.Left) && g.isIntExpr(e.Right)
+	case *ast.CallExpression:
+		if fl := g.namedFunctionValue(e.Function); fl != nil {
+			return g.resolvePrimitive(fl.ReturnType) == "int"
+		}
+	}
+	return false
+}
+
+// resolvePrimitive follows type aliases down to a primitive type name, or
+// returns "" when t is not a primitive type.
+func (g *Generator) resolvePrimitive(t string) string {
+	switch t = g.resolveAlias(t); t {
+	case "int", "float", "string", "bool":
+		return t
+	}
+	return ""
+}
+
+// valueType returns the primitive type (int, string or bool) expr is known
+// to produce, or "" when it is not known: literals, true and false, names
+// with a recorded type, calls of functions with a primitive return type,
+// arithmetic, concatenation, comparisons and &&.
+func (g *Generator) valueType(expr ast.Expression) string {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral:
+		return "int"
+	case *ast.FloatLiteral:
+		return "float"
+	case *ast.StringLiteral:
+		return "string"
+	case *ast.Identifier:
+		if e.Value == "true" || e.Value == "false" {
+			return "bool"
+		}
+		return g.valueTypes[e.Value]
+	case *ast.InfixExpression:
+		switch e.Operator {
+		case "<", ">", "<=", ">=", "==", "!=", "&&", "in":
+			return "bool"
+		case "+", "-", "*", "/":
+			left, right := g.valueType(e.Left), g.valueType(e.Right)
+			if left == "int" && right == "int" || e.Operator == "+" && left == "string" && right == "string" {
+				return left
+			}
+			if e.Operator == "+" && g.concatAssertion(e) != nil {
+				return "string"
+			}
+		}
+	case *ast.CallExpression:
+		if fl := g.namedFunctionValue(e.Function); fl != nil {
+			return g.resolvePrimitive(fl.ReturnType)
+		}
+		if ident, ok := e.Function.(*ast.Identifier); ok && ident.Value == "format" {
+			return "string"
+		}
+		if mae, ok := e.Function.(*ast.MemberAccessExpression); ok {
+			if accessor := g.requestAccessor(mae); accessor != "" {
+				return requestAccessors[accessor]
+			}
+		}
+	case *ast.MemberAccessExpression:
+		if g.isLengthAccess(e) {
+			return "int"
+		}
+	case *ast.CastExpression:
+		return g.resolvePrimitive(e.Type)
+	}
+	return ""
+}
+
+// concatAssertion returns the operand of a string concatenation that is an
+// interface{} value, when the other operand is a known string: an entry of
+// an interface{} map such as req["query"]["name"], or a dynamic value, see
+// isDynamic. It returns nil otherwise.
+func (g *Generator) concatAssertion(e *ast.InfixExpression) ast.Expression {
+	if e.Operator != "+" {
+		return nil
+	}
+	if g.valueType(e.Left) == "string" && (g.isMapEntry(e.Right) || g.isDynamic(e.Right)) {
+		return e.Right
+	}
+	if g.valueType(e.Right) == "string" && (g.isMapEntry(e.Left) || g.isDynamic(e.Left)) {
+		return e.Left
+	}
+	return nil
+}
+
+// isDynamic reports whether expr is a name or a call whose Go type is
+// interface{} as far as is known: a let or parameter of no known type, such
+// as `let name = req.query.name`, or a call of a named function without a
+// primitive return type.
+func (g *Generator) isDynamic(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.Identifier:
+		if g.valueType(e) != "" || g.collectionKind(e) != "" || g.isGoPackage(e) {
+			return false
+		}
+		if isStruct, _, _ := g.resolveStructInfo(e); isStruct {
+			return false
+		}
+		return g.namedFunctionValue(e) == nil
+	case *ast.CallExpression:
+		fl := g.namedFunctionValue(e.Function)
+		return fl != nil && g.resolvePrimitive(fl.ReturnType) == ""
+	}
+	return false
+}
+
+// isLengthAccess reports whether mae is the length property of a string or a
+// list; on structs and maps length is an ordinary field or key.
+func (g *Generator) isLengthAccess(mae *ast.MemberAccessExpression) bool {
+	return mae.Property.Value == "length" && (g.valueType(mae.Object) == "string" || g.collectionKind(mae.Object) == "list")
+}
+
+// isMapEntry reports whether expr reads an entry of an interface{} map:
+// indexing or member access on anything but a string or a struct.
+func (g *Generator) isMapEntry(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.IndexExpression:
+		return g.valueType(e.Left) == "" && g.collectionKind(e.Left) != "list"
+	case *ast.MemberAccessExpression:
+		isStruct, _, _ := g.resolveStructInfo(e.Object)
+		return !isStruct && g.valueType(e.Object) == ""
+	}
+	return false
+}
+
+// collectionKind returns "list" or "map" when expr is known to produce a
+// list or a map: literals, names recorded as one, and annotations of list
+// and map types.
+func (g *Generator) collectionKind(expr ast.Expression) string {
+	switch e := expr.(type) {
+	case *ast.ListLiteral:
+		return "list"
+	case *ast.MapLiteral:
+		return "map"
+	case *ast.Identifier:
+		return g.collectionKinds[e.Value]
+	}
+	return ""
+}
+
+// listElementType returns the primitive type shared by the elements of the
+// list expr, or "" when it is not known.
+func (g *Generator) listElementType(expr ast.Expression) string {
+	switch e := expr.(type) {
+	case *ast.ListLiteral:
+		elem := ""
+		for i, el := range e.Elements {
+			t := g.valueType(el)
+			if t == "" || i > 0 && t != elem {
+				return ""
+			}
+			elem = t
+		}
+		return elem
+	case *ast.Identifier:
+		return g.elementTypes[e.Value]
+	}
+	return ""
+}
+
+// annotationKind returns "list" or "map" when the type annotation t, after
+// resolving aliases, is a list or map type.
+func (g *Generator) annotationKind(t string) string {
+	t = g.resolveAlias(t)
+	if _, ok := ast.ListElementType(t); ok {
+		return "list"
+	}
+	if _, _, ok := ast.MapElementTypes(t); ok {
+		return "map"
+	}
+	return ""
+}
+
+// recordValueType remembers the primitive type of name, and whether it holds
+// a list or a map; an untyped let takes the type of its value when that is
+// known.
+func (g *Generator) recordValueType(name, typeName string, value ast.Expression) {
+	kind := g.annotationKind(typeName)
+	if typeName == "" && value != nil {
+		kind = g.collectionKind(value)
+	}
+	if kind != "" {
+		g.collectionKinds[name] = kind
+	} else {
+		delete(g.collectionKinds, name)
+	}
+	elem, _ := ast.ListElementType(g.resolveAlias(typeName))
+	if typeName == "" {
+		elem = g.listElementType(value)
+	}
+	if t := g.resolvePrimitive(elem); t != "" {
+		g.elementTypes[name] = t
+	} else {
+		delete(g.elementTypes, name)
+	}
+	if fl := g.namedFunctionValue(value); fl != nil && typeName == "" {
+		g.functionValues[name] = fl
+	} else {
+		delete(g.functionValues, name)
+	}
+	if typeName == "" && value != nil {
+		typeName = g.valueType(value)
+	}
+	if t := g.resolvePrimitive(typeName); t != "" {
+		g.valueTypes[name] = t
+	} else {
+		delete(g.valueTypes, name)
+	}
+}
+
+// namedFunctionValue returns the named function expr refers to, either by
+// its own name or through a let holding it, or nil.
+func (g *Generator) namedFunctionValue(expr ast.Expression) *ast.FunctionLiteral {
+	ident, ok := expr.(*ast.Identifier)
+	if !ok {
+		return nil
+	}
+	if fl, ok := g.functionValues[ident.Value]; ok {
+		return fl
+	}
+	if _, shadowed := g.valueTypes[ident.Value]; shadowed {
+		return nil
+	}
+	return g.functions[ident.Value]
+}
+
+// paramScope returns the value types visible in the body of node: those of
+// the enclosing scope plus the typed parameters.
+func (g *Generator) paramScope(node *ast.FunctionLiteral) map[string]string {
+	scope := map[string]string{}
+	for k, v := range g.valueTypes {
+		scope[k] = v
+	}
+	for _, p := range node.Parameters {
+		if t := g.resolvePrimitive(node.ParamTypes[p.Value]); t != "" {
+			scope[p.Value] = t
+		} else {
+			delete(scope, p.Value)
+		}
+	}
+	return scope
+}
+
+// structScope returns the struct-typed variables of the enclosing scope
+// that stay visible in the body of node, which a closure captures.
+// Parameters shadow them: struct parameters are passed as interface{}.
+func (g *Generator) structScope(node *ast.FunctionLiteral) map[string]string {
+	scope := map[string]string{}
+	for k, v := range g.variableTypes {
+		scope[k] = v
+	}
+	for _, p := range node.Parameters {
+		delete(scope, p.Value)
+	}
+	return scope
+}
+
+// elementScope returns the list element types visible in the body of node:
+// those of the enclosing scope plus the parameters annotated as a list of a
+// primitive type.
+func (g *Generator) elementScope(node *ast.FunctionLiteral) map[string]string {
+	scope := copyScope(g.elementTypes)
+	for _, p := range node.Parameters {
+		elem, _ := ast.ListElementType(g.resolveAlias(node.ParamTypes[p.Value]))
+		if t := g.resolvePrimitive(elem); t != "" {
+			scope[p.Value] = t
+		} else {
+			delete(scope, p.Value)
+		}
+	}
+	return scope
+}
+
+// collectionScope returns the collection kinds visible in the body of node:
+// those of the enclosing scope plus the parameters annotated as a list or map.
+func (g *Generator) collectionScope(node *ast.FunctionLiteral) map[string]string {
+	scope := map[string]string{}
+	for k, v := range g.collectionKinds {
+		scope[k] = v
+	}
+	for _, p := range node.Parameters {
+		if kind := g.annotationKind(node.ParamTypes[p.Value]); kind != "" {
+			scope[p.Value] = kind
+		} else {
+			delete(scope, p.Value)
+		}
+	}
+	return scope
+}
+
+// genCheckedArithHelpers emits the overflow checking helpers used in
+// CheckedArith mode.
+func (g *Generator) genCheckedArithHelpers() {
+	if !g.requiresCheckedArith {
+		return
+	}
+	g.writeLine("func pskCheckedAdd(a, b int) int {")
+	g.indentlevel++
+	g.writeLine("c := a + b")
+	g.writeLine("if (b > 0 && c < a) || (b < 0 && c > a) {")
+	g.indentlevel++
+	g.writeLine("panic(\"integer overflow in addition\")")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("return c")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("func pskCheckedSub(a, b int) int {")
+	g.indentlevel++
+	g.writeLine("c := a - b")
+	g.writeLine("if (b > 0 && c > a) || (b < 0 && c < a) {")
+	g.indentlevel++
+	g.writeLine("panic(\"integer overflow in subtraction\")")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("return c")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("func pskCheckedMul(a, b int) int {")
+	g.indentlevel++
+	g.writeLine("if a == 0 || b == 0 {")
+	g.indentlevel++
+	g.writeLine("return 0")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("c := a * b")
+	// MinInt * -1 wraps to MinInt, which the division check cannot see
+	g.writeLine("if c/b != a || (b == -1 && a < 0 && c < 0) {")
+	g.indentlevel++
+	g.writeLine("panic(\"integer overflow in multiplication\")")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("return c")
+	g.indentlevel--
+	g.writeLine("}")
+}
+
+// genFunctionLiteralTopLevel emits a named Go function declaration for a
+// FunctionLiteral. The untyped first parameter of a function used as a route
+// handler is the request map.
+func (g *Generator) genFunctionLiteralTopLevel(node *ast.FunctionLiteral) string {
+	var b bytes.Buffer
+	params := []string{}
+	request := ""
+	for i, p := range node.Parameters {
+		if node.ParamTypes != nil {
+			if t, ok := node.ParamTypes[p.Value]; ok {
+				goType := g.mapTypeToGo(t)
+				params = append(params, p.Value+" "+goType)
+				continue
+			}
+		}
+		if i == 0 && g.routeHandlers[node.Name.Value] {
+			request = p.Value
+			params = append(params, p.Value+" map[string]"+g.anyType())
+			continue
+		}
+		params = append(params, p.Value+" "+g.anyType())
+	}
+	retType := g.anyType()
+	if node.ReturnType != "" {
+		retType = g.mapTypeToGo(node.ReturnType)
+	}
+	b.WriteString(fmt.Sprintf("func %s(%s) %s {", g.funcName(node.Name.Value), strings.Join(params, ", "), retType))
+
+	bodyGen := g.child()
+	bodyGen.valueTypes = g.paramScope(node)
+	bodyGen.collectionKinds = g.collectionScope(node)
+	bodyGen.variableTypes = g.structScope(node)
+	bodyGen.elementTypes = g.elementScope(node)
+	if request != "" {
+		bodyGen.collectionKinds[request] = "map"
+	}
+	bodyGen.returnType = node.ReturnType
+	bodyGen.indentlevel = 0
+	for _, s := range node.Body.Statements {
+		bodyGen.genStatement(s)
+	}
+	g.adopt(bodyGen)
+	// Go requires a terminating return; fall back to the zero value
+	if !endsWithReturn(node.Body) {
+		bodyGen.writeLine("return " + g.zeroValueForType(node.ReturnType))
+	}
+	b.WriteString("\n")
+	b.Write(bodyGen.out.Bytes())
+	b.WriteString("}")
+	return b.String()
+}
+
+// genCast emits `x as T` as the type assertion x.(T). A value already known
+// to have type T is left as it is, and one known to have another primitive
+// type cannot be asserted.
+func (g *Generator) genCast(node *ast.CastExpression) {
+	value := g.captureExpression(node.Value)
+	if from := g.valueType(node.Value); from != "" {
+		if from != g.resolvePrimitive(node.Type) {
+			g.errorf(node, "cannot cast %s of type %s to %s", node.Value.String(), from, node.Type)
+		}
+		g.write(value)
+		return
+	}
+	goType := g.mapTypeToGo(node.Type)
+	if td, ok := g.typeDefs[g.resolveAlias(node.Type)]; ok && td.Alias == "" {
+		goType = td.Name.Value
+	}
+	g.write(fmt.Sprintf("%s.(%s)", value, goType))
+}
+
+// genTryLet emits `let name = try f()` as a call of f, which returns a value
+// and an error, followed by returning the error when it is not nil.
+func (g *Generator) genTryLet(name string, te *ast.TryExpression) {
+	if g.resolveAlias(g.returnType) != "error" {
+		g.errorf(te, "try is only allowed in a function with return type error")
+		g.write("\n")
+		return
+	}
+	if _, ok := te.Call.(*ast.CallExpression); !ok {
+		g.errorf(te, "try expects a function call, got %s", te.Call.String())
+		g.write("\n")
+		return
+	}
+	g.write(fmt.Sprintf("%s, err := %s\n", name, g.captureExpression(te.Call)))
+	g.writeLine("if err != nil {")
+	g.indentlevel++
+	g.writeLine("return err")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("_ = " + name)
+}
+
+// endsWithReturn reports whether the last statement of body is a return.
+func endsWithReturn(body *ast.BlockStatement) bool {
+	if len(body.Statements) == 0 {
+		return false
+	}
+	_, ok := body.Statements[len(body.Statements)-1].(*ast.ReturnStatement)
+	return ok
+}
+
+// zeroValueForType returns the Go zero value literal for a Pisuke type name.
+func (g *Generator) zeroValueForType(t string) string {
+	switch g.mapTypeToGo(t) {
+	case "int", "float64":
+		return "0"
+	case "string":
+		return `""`
+	case "bool":
+		return "false"
+	default:
+		return "nil"
+	}
+}
+
+// zeroValueForField returns the zero value literal of a struct field. Nested
+// object fields are anonymous structs whose zero value is an empty literal.
+func (g *Generator) zeroValueForField(f *ast.Field) string {
+	if f.Nested != nil {
+		return g.nestedStructType(f.Nested) + "{}"
+	}
+	return g.zeroValueForType(f.Type)
+}
+
+// fieldValue returns the Go expression for value assigned to the struct
+// field f. A list or map literal for a list- or map-typed field takes the
+// field's Go type, e.g. []string{"a", "b"} or map[string]string{"k": "v"}
+// instead of a collection of interface values.
+func (g *Generator) fieldValue(f *ast.Field, value ast.Expression) string {
+	switch v := value.(type) {
+	case *ast.ListLiteral:
+		if _, ok := ast.ListElementType(g.resolveAlias(f.Type)); ok {
+			elements := []string{}
+			for _, el := range v.Elements {
+				elements = append(elements, g.captureExpression(el))
+			}
+			return g.mapTypeToGo(f.Type) + "{" + strings.Join(elements, ", ") + "}"
+		}
+	case *ast.MapLiteral:
+		if _, _, ok := ast.MapElementTypes(g.resolveAlias(f.Type)); ok {
+			pairs := []string{}
+			for key, val := range v.Pairs {
+				keyStr := g.captureExpression(key)
+				if ident, ok := key.(*ast.Identifier); ok {
+					keyStr = fmt.Sprintf("\"%s\"", ident.Value)
+				}
+				pairs = append(pairs, keyStr+": "+g.captureExpression(val))
+			}
+			// v.Pairs is a Go map; sort for a stable output
+			sort.Strings(pairs)
+			return g.mapTypeToGo(f.Type) + "{" + strings.Join(pairs, ", ") + "}"
+		}
+	}
+	return g.captureExpression(value)
+}
+
+func (g *Generator) genStatement(stmt ast.Statement) {
+	// A named top-level function literal has already been emitted before
+	// main by genProgram; skip emitting the literal again.
+	if es, ok := stmt.(*ast.ExpressionStatement); ok && (isNamedFunction(es.Expression) || isServerDirective(es.Expression)) {
+		return
+	}
+	// use directives only contribute imports
+	if _, ok := stmt.(*ast.UseStatement); ok {
+		return
+	}
+	g.lineDirective(stmt)
+	g.indent()
+	switch node := stmt.(type) {
+	case *ast.LetStatement:
+		g.genLetStatement(node)
+	case *ast.ConstStatement:
+		g.genConstStatement(node)
+	case *ast.TypeDefinition:
+		g.genTypeDefinition(node)
+	case *ast.ReturnStatement:
+		g.genReturnStatement(node)
+	case *ast.CompoundAssignStatement:
+		g.genCompoundAssign(node)
+	case *ast.BreakStatement, *ast.ContinueStatement:
+		// the language has no loops yet, so only a switch case may break
+		g.errorf(node, "%s outside of a loop", node.TokenLiteral())
+		g.write("\n")
+	case *ast.SwitchStatement:
+		g.genSwitchStatement(node)
+	case *ast.FallthroughStatement:
+		g.errorf(node, "fallthrough outside of a switch case")
+		g.write("\n")
+	case *ast.ExpressionStatement:
+		if call := assertCall(node.Expression); call != nil && node.Guard == nil {
+			g.genAssert(call)
+			return
+		}
+		if node.Guard != nil {
+			g.write(fmt.Sprintf("if %s {\n", g.captureExpression(node.Guard)))
+			g.indentlevel++
+			g.indent()
+			g.guarded = true
+			g.discardValue(node.Expression)
+			g.genExpression(node.Expression)
+			g.guarded = false
+			g.write("\n")
+			g.indentlevel--
+			g.writeLine("}")
+			return
+		}
+		g.discardValue(node.Expression)
+		g.genExpression(node.Expression)
+		g.write("\n")
+	default:
+		g.errorf(stmt, "unsupported statement %T", stmt)
+		g.write("\n")
+	}
+}
+
+// discardValue assigns the value of an expression statement other than a
+// call, such as `x == 1` or `f() == 1`, to the blank identifier, since Go
+// rejects a value that is evaluated but not used. The assignment still
+// evaluates the expression, so its side effects are kept.
+func (g *Generator) discardValue(expr ast.Expression) {
+	if _, call := expr.(*ast.CallExpression); !call {
+		g.write("_ = ")
+	}
+}
+
+// genSwitchStatement emits a Go switch. Go cases already end without running
+// the next one, so only an explicit fallthrough needs translating; it must be
+// the last statement of a case that has a case after it.
+func (g *Generator) genSwitchStatement(ss *ast.SwitchStatement) {
+	g.write(fmt.Sprintf("switch %s {\n", g.captureExpression(ss.Value)))
+	cases := ss.Cases
+	if ss.Default != nil {
+		cases = append(cases[:len(cases):len(cases)], ss.Default)
+	}
+	for i, c := range cases {
+		if len(c.Values) == 0 {
+			g.writeLine("default:")
+		} else {
+			values := []string{}
+			for _, v := range c.Values {
+				values = append(values, g.captureExpression(v))
+			}
+			g.writeLine(fmt.Sprintf("case %s:", strings.Join(values, ", ")))
+		}
+		g.indentlevel++
+		for j, s := range c.Body {
+			if ft, ok := s.(*ast.FallthroughStatement); ok {
+				switch {
+				case j != len(c.Body)-1:
+					g.errorf(ft, "fallthrough must be the last statement of a case")
+				case i == len(cases)-1:
+					g.errorf(ft, "cannot fallthrough the final case of a switch")
+				}
+				g.writeLine("fallthrough")
+				continue
+			}
+			// a break ends the case early
+			if _, ok := s.(*ast.BreakStatement); ok {
+				g.writeLine("break")
+				continue
+			}
+			g.genStatement(s)
+		}
+		g.indentlevel--
+	}
+	g.writeLine("}")
+}
+
+func isNamedFunction(expr ast.Expression) bool {
+	fl, ok := expr.(*ast.FunctionLiteral)
+	return ok && fl.Name != nil
+}
+
+func (g *Generator) genExpression(expr ast.Expression) {
+	switch node := expr.(type) {
+	case *ast.IntegerLiteral:
+		g.write(fmt.Sprintf("%d", node.Value))
+	case *ast.FloatLiteral:
+		// the literal forms, 2.5, .5 and 1.5e10, are Go float literals too
+		g.write(strings.ReplaceAll(node.Token.Literal, "_", ""))
+	case *ast.StringLiteral:
+		g.write(fmt.Sprintf("\"%s\"", node.Value))
+	case *ast.Identifier:
+		g.write(g.funcName(node.Value))
+	case *ast.ListLiteral:
+		elements := []string{}
+		for _, el := range node.Elements {
+			elements = append(elements, g.captureExpression(el))
+		}
+		g.write(fmt.Sprintf("[]%s{%s}", g.anyType(), strings.Join(elements, ", ")))
+	case *ast.MapLiteral:
+		keyType := g.mapKeyType(node)
+		// node.Pairs is a Go map; sort the emitted pairs by key so the
+		// generated code is the same on every run
+		type pair struct {
+			key, value string
+		}
+		pairs := []pair{}
+		for key, value := range node.Pairs {
+			var keyStr string
+			if ks, ok := key.(*ast.StringLiteral); ok {
+				keyStr = fmt.Sprintf("\"%s\"", ks.Value)
+			} else if ident, ok := key.(*ast.Identifier); ok {
+				keyStr = fmt.Sprintf("\"%s\"", ident.Value)
+			} else if il, ok := key.(*ast.IntegerLiteral); ok {
+				keyStr = fmt.Sprintf("%d", il.Value)
+			} else {
+				keyStr = fmt.Sprintf("\"%s\"", g.captureExpression(key))
+			}
+			pairs = append(pairs, pair{keyStr, g.captureExpression(value)})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+		entries := []string{}
+		for _, p := range pairs {
+			entries = append(entries, fmt.Sprintf("%s: %s", p.key, p.value))
+		}
+		g.write(fmt.Sprintf("map[%s]%s{%s}", keyType, g.anyType(), strings.Join(entries, ", ")))
+	case *ast.IndexExpression:
+		// If left side is itself an indexed/map access (e.g. req["params"]),
+		// cast it to map[string]interface{} before performing another index:
+		// req["params"].(map[string]interface{})["id"]
+		leftStr := g.captureExpression(node.Left)
+		idxStr := g.captureExpression(node.Index)
+		// indexing a string gives its i-th character as a string, counted
+		// in runes so multi-byte characters stay whole
+		if g.valueType(node.Left) == "string" {
+			g.write(fmt.Sprintf("string([]rune(%s)[%s])", leftStr, idxStr))
+			return
+		}
+		if strings.Contains(leftStr, "[") {
+			g.write(fmt.Sprintf("%s.(map[string]%s)[%s]", leftStr, g.anyType(), idxStr))
+		} else {
+			g.write(fmt.Sprintf("%s[%s]", leftStr, idxStr))
+		}
+	case *ast.SliceExpression:
+		// a slice of an indexed/map value needs the []interface{} assertion first
+		leftStr := g.captureExpression(node.Left)
+		if strings.Contains(leftStr, "[") {
+			leftStr += ".([]" + g.anyType() + ")"
+		}
+		start, end := "", ""
+		if node.Start != nil {
+			start = g.captureExpression(node.Start)
+		}
+		if node.End != nil {
+			end = g.captureExpression(node.End)
+		}
+		g.write(fmt.Sprintf("%s[%s:%s]", leftStr, start, end))
+	case *ast.MemberAccessExpression:
+		// pkg.Fn for packages brought in with `use`
+		if g.isGoPackage(node.Object) {
+			g.write(node.Object.(*ast.Identifier).Value + "." + node.Property.Value)
+			return
+		}
+		// list.length is len(list); s.length counts runes, like indexing
+		// a string does
+		if g.isLengthAccess(node) {
+			if g.valueType(node.Object) == "string" {
+				g.write(fmt.Sprintf("len([]rune(%s))", g.captureExpression(node.Object)))
+				return
+			}
+			g.write(fmt.Sprintf("len(%s)", g.captureExpression(node.Object)))
+			return
+		}
+		// ints, strings and bools have no members
+		if t := g.valueType(node.Object); t != "" {
+			g.errorf(node, "cannot access %s on %s of type %s", node.Property.Value, node.Object.String(), t)
+			return
+		}
+		// Determine if the object expression is a struct (named or nested)
+		if isStruct, _, _ := g.resolveStructInfo(node.Object); isStruct {
+			g.genExpression(node.Object)
+			g.write(".")
+			g.write(capitalizeFirst(node.Property.Value))
+			return
+		}
+		// fallback: map-style access
+		leftStr := g.captureExpression(node.Object)
+		if node.Optional && strings.Contains(leftStr, "[") {
+			// a failed comma-ok assertion leaves m nil, and indexing a nil
+			// map yields nil instead of panicking
+			g.write(fmt.Sprintf("func() %s { m, _ := %s.(map[string]%s); return m[\"%s\"] }()", g.anyType(), leftStr, g.anyType(), node.Property.Value))
+		} else if strings.Contains(leftStr, "[") {
+			// e.g. req["params"] -> req["params"].(map[string]interface{})["prop"]
+			g.write(fmt.Sprintf("%s.(map[string]%s)[\"%s\"]", leftStr, g.anyType(), node.Property.Value))
+		} else {
+			g.write(fmt.Sprintf("%s[\"%s\"]", leftStr, node.Property.Value))
+		}
+	case *ast.InfixExpression:
+		if helper, ok := checkedArithHelpers[node.Operator]; ok && g.CheckedArith && g.isIntExpr(node) {
+			g.requiresCheckedArith = true
+			g.write(fmt.Sprintf("%s(%s, %s)", helper, g.captureExpression(node.Left), g.captureExpression(node.Right)))
+			return
+		}
+		// left ?? right falls back to right when left is nil, e.g. a missing
+		// map entry
+		if node.Operator == "??" {
+			g.write(fmt.Sprintf("func() %s { v := %s(%s); if v == nil { return %s }; return v }()", g.anyType(), g.anyType(), g.captureExpression(node.Left), g.captureExpression(node.Right)))
+			return
+		}
+		// x in m looks a key up in a map, x in list scans the list
+		if node.Operator == "in" {
+			helper := "pskContains"
+			if g.collectionKind(node.Right) == "map" {
+				g.requiresHasKeyHelper, helper = true, "pskHasKey"
+			} else {
+				g.requiresContainsHelper = true
+			}
+			g.write(fmt.Sprintf("%s(%s, %s)", helper, g.captureExpression(node.Right), g.captureExpression(node.Left)))
+			return
+		}
+		// "Hello, " + req["query"]["name"]: Go cannot add an interface{}
+		// value to a string, so assert a map entry is a string and format
+		// any other value
+		if dynamic := g.concatAssertion(node); dynamic != nil {
+			operand := g.captureExpression(dynamic)
+			if g.isMapEntry(dynamic) {
+				operand += ".(string)"
+			} else {
+				g.requiresFmt = true
+				operand = "fmt.Sprint(" + operand + ")"
+			}
+			if dynamic == node.Left {
+				g.write(fmt.Sprintf("(%s + %s)", operand, g.captureExpression(node.Right)))
+			} else {
+				g.write(fmt.Sprintf("(%s + %s)", g.captureExpression(node.Left), operand))
+			}
+			return
+		}
+		g.write("(")
+		g.genExpression(node.Left)
+		g.write(fmt.Sprintf(" %s ", node.Operator))
+		g.genExpression(node.Right)
+		g.write(")")
+	case *ast.FunctionLiteral:
+		g.write(g.genFunctionLiteral(node))
+	case *ast.CallExpression:
+		g.genCallExpression(node)
+	case *ast.CastExpression:
+		g.genCast(node)
+	case *ast.TryExpression:
+		g.errorf(node, "try is only allowed as the value of a let")
+	default:
+		g.errorf(expr, "unsupported expression %T", expr)
+	}
+}
+
+func (g *Generator) genLetStatement(letStmt *ast.LetStatement) {
+	defer g.recordValueType(letStmt.Name.Value, letStmt.TypeName, letStmt.Value)
+	// comma-ok map access: let val, ok = m["key"]
+	if len(letStmt.Names) == 2 {
+		if _, ok := letStmt.Value.(*ast.IndexExpression); ok {
+			val, okName := letStmt.Names[0].Value, letStmt.Names[1].Value
+			if g.packageLevel {
+				g.write(fmt.Sprintf("var %s, %s = %s\n", val, okName, g.captureExpression(letStmt.Value)))
+				return
+			}
+			g.write(fmt.Sprintf("%s, %s := %s\n", val, okName, g.captureExpression(letStmt.Value)))
+			g.indent()
+			g.write(fmt.Sprintf("_, _ = %s, %s\n", val, okName))
+			return
+		}
+	}
+
+	if te, ok := letStmt.Value.(*ast.TryExpression); ok {
+		g.genTryLet(letStmt.Name.Value, te)
+		return
+	}
+
+	if elem, size, ok := ast.ArrayType(g.resolveAlias(letStmt.TypeName)); ok {
+		g.genArrayLet(letStmt, elem, size)
+		return
+	}
+
+	// empty list/map literals take their Go type from a list or map
+	// annotation: let xs: [int] = [] -> []int{}
+	if lit, ok := g.typedEmptyLiteral(letStmt.TypeName, letStmt.Value); ok {
+		g.write(fmt.Sprintf("var %s = %s\n", letStmt.Name.Value, lit))
+		if !g.packageLevel {
+			g.indent()
+			g.write(fmt.Sprintf("_ = %s\n", letStmt.Name.Value))
+		}
+		return
+	}
+
+	// If a type annotation exists and the value is a MapLiteral,
+	// emit a typed Go struct literal: TypeName{ Field: value, ... }. Without
+	// an annotation, a map literal whose keys are exactly the fields of a
+	// type is a literal of that type, unless the variable is used as a map.
+	typeName := letStmt.TypeName
+	if ml, ok := letStmt.Value.(*ast.MapLiteral); ok && typeName == "" && !g.mapNames[letStmt.Name.Value] {
+		typeName = ast.InferStructType(ml, g.typeDefs)
+	}
+	if typeName != "" {
+		if ml, ok := letStmt.Value.(*ast.MapLiteral); ok {
+			// collect key -> expression map deterministically
+			type pair struct {
+				key     string
+				valExpr ast.Expression
+			}
+			pairs := []pair{}
+			for k, v := range ml.Pairs {
+				keyStr := ""
+				if ks, ok := k.(*ast.StringLiteral); ok {
+					keyStr = ks.Value
+				} else if ident, ok := k.(*ast.Identifier); ok {
+					keyStr = ident.Value
+				} else {
+					keyStr = g.captureExpression(k)
+				}
+				pairs = append(pairs, pair{keyStr, v})
+			}
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+			fields := []string{}
+			td, hasTypeDef := g.typeDefs[typeName]
+			// build quick lookup from pairs
+			kv := map[string]ast.Expression{}
+			for _, p := range pairs {
+				kv[p.key] = p.valExpr
 			}
 			if hasTypeDef {
 				for _, tf := range td.Fields {
 					valExpr, ok := kv[tf.Name]
 					if !ok {
-						// missing value -> zero value via captureExpression of nil? fallback to zero-value literal
-						fields = append(fields, fmt.Sprintf("%s: %s", capitalizeFirst(tf.Name), "nil"))
+						// missing value -> zero value of the field's type
+						fields = append(fields, fmt.Sprintf("%s: %s", capitalizeFirst(tf.Name), g.zeroValueForField(tf)))
 						continue
 					}
 					if tf.Nested != nil {
 						// expect valExpr to be a MapLiteral
 						if nestedMap, ok := valExpr.(*ast.MapLiteral); ok {
-							// build nested struct type string
-							nestedTypeParts := []string{}
-							for _, nf := range tf.Nested.Fields {
-								nestedTypeParts = append(nestedTypeParts, fmt.Sprintf("%s %s", capitalizeFirst(nf.Name), mapTypeToGo(nf.Type)))
-							}
-							nestedTypeStr := "struct{" + strings.Join(nestedTypeParts, ", ") + "}"
+							nestedTypeStr := g.nestedStructType(tf.Nested)
 							// build nested literal fields
 							nestedPairs := []string{}
 							// build map from nestedMap pairs
@@ -311,10 +1778,10 @@ func (g *Generator) genLetStatement(letStmt *ast.LetStatement) {
 							for _, nf := range tf.Nested.Fields {
 								nev, ok := nkv[nf.Name]
 								if !ok {
-									nestedPairs = append(nestedPairs, fmt.Sprintf("%s: %s", capitalizeFirst(nf.Name), "nil"))
+									nestedPairs = append(nestedPairs, fmt.Sprintf("%s: %s", capitalizeFirst(nf.Name), g.zeroValueForField(nf)))
 									continue
 								}
-								nestedPairs = append(nestedPairs, fmt.Sprintf("%s: %s", capitalizeFirst(nf.Name), g.captureExpression(nev)))
+								nestedPairs = append(nestedPairs, fmt.Sprintf("%s: %s", capitalizeFirst(nf.Name), g.fieldValue(nf, nev)))
 							}
 							nestedLiteral := nestedTypeStr + "{" + strings.Join(nestedPairs, ", ") + "}"
 							fields = append(fields, fmt.Sprintf("%s: %s", capitalizeFirst(tf.Name), nestedLiteral))
@@ -322,7 +1789,7 @@ func (g *Generator) genLetStatement(letStmt *ast.LetStatement) {
 						}
 					}
 					// non-nested field
-					fields = append(fields, fmt.Sprintf("%s: %s", capitalizeFirst(tf.Name), g.captureExpression(valExpr)))
+					fields = append(fields, fmt.Sprintf("%s: %s", capitalizeFirst(tf.Name), g.fieldValue(tf, valExpr)))
 				}
 			} else {
 				// fallback: iterate pairs in deterministic order
@@ -330,240 +1797,1292 @@ func (g *Generator) genLetStatement(letStmt *ast.LetStatement) {
 					fields = append(fields, fmt.Sprintf("%s: %s", capitalizeFirst(p.key), g.captureExpression(p.valExpr)))
 				}
 			}
-			g.write(fmt.Sprintf("var %s %s = %s{%s}\n", letStmt.Name.Value, letStmt.TypeName, letStmt.TypeName, strings.Join(fields, ", ")))
-			// record variable's type for later member access generation
-			g.variableTypes[letStmt.Name.Value] = letStmt.TypeName
-			g.indent()
-			g.write(fmt.Sprintf("_ = %s\n", letStmt.Name.Value))
-			return
+			g.write(fmt.Sprintf("var %s %s = %s{%s}\n", letStmt.Name.Value, typeName, typeName, strings.Join(fields, ", ")))
+			// record variable's type for later member access generation
+			g.variableTypes[letStmt.Name.Value] = typeName
+			if !g.packageLevel {
+				g.indent()
+				g.write(fmt.Sprintf("_ = %s\n", letStmt.Name.Value))
+			}
+			return
+		}
+	}
+
+	// fallback: untyped or non-map values
+	g.write(fmt.Sprintf("var %s = ", letStmt.Name.Value))
+	g.genExpression(letStmt.Value)
+	g.write("\n")
+	// unused locals do not compile; package variables need no such guard
+	if !g.packageLevel {
+		g.indent()
+		g.write(fmt.Sprintf("_ = %s\n", letStmt.Name.Value))
+	}
+}
+
+// typedEmptyLiteral returns the Go literal of an empty list or map value
+// annotated with a list or map type.
+func (g *Generator) typedEmptyLiteral(typeName string, value ast.Expression) (string, bool) {
+	resolved := g.resolveAlias(typeName)
+	switch v := value.(type) {
+	case *ast.ListLiteral:
+		if _, ok := ast.ListElementType(resolved); ok && len(v.Elements) == 0 {
+			return g.mapTypeToGo(resolved) + "{}", true
+		}
+	case *ast.MapLiteral:
+		if _, _, ok := ast.MapElementTypes(resolved); ok && len(v.Pairs) == 0 {
+			return g.mapTypeToGo(resolved) + "{}", true
+		}
+	}
+	return "", false
+}
+
+// genArrayLet emits a let annotated with the fixed-size array type [elem;
+// size]. The empty list leaves the array zeroed and a list literal fills
+// its first elements.
+func (g *Generator) genArrayLet(letStmt *ast.LetStatement, elem, size string) {
+	n, ok := g.arrayLen(size)
+	if !ok {
+		g.errorf(letStmt, "%s: array size %s is not a constant int", letStmt.Name.Value, size)
+		g.write("\n")
+		return
+	}
+	goType := fmt.Sprintf("[%d]%s", n, g.mapTypeToGo(elem))
+	switch v := letStmt.Value.(type) {
+	case *ast.ListLiteral:
+		if int64(len(v.Elements)) > n {
+			g.errorf(letStmt, "%s: %d elements do not fit in array of size %d", letStmt.Name.Value, len(v.Elements), n)
+		}
+		if len(v.Elements) == 0 {
+			g.write(fmt.Sprintf("var %s %s\n", letStmt.Name.Value, goType))
+			break
+		}
+		elements := []string{}
+		for _, el := range v.Elements {
+			elements = append(elements, g.captureExpression(el))
+		}
+		g.write(fmt.Sprintf("var %s = %s{%s}\n", letStmt.Name.Value, goType, strings.Join(elements, ", ")))
+	default:
+		g.write(fmt.Sprintf("var %s %s = %s\n", letStmt.Name.Value, goType, g.captureExpression(v)))
+	}
+	if !g.packageLevel {
+		g.indent()
+		g.write(fmt.Sprintf("_ = %s\n", letStmt.Name.Value))
+	}
+}
+
+// arrayLen folds the size of an array type: an integer or the name of a
+// constant holding a non-negative int.
+func (g *Generator) arrayLen(size string) (int64, bool) {
+	n, err := strconv.ParseInt(strings.ReplaceAll(size, "_", ""), 0, 64)
+	if err != nil {
+		v, ok := g.constValues[size].(int64)
+		if !ok {
+			return 0, false
+		}
+		n = v
+	}
+	return n, n >= 0
+}
+
+func (g *Generator) genConstStatement(constStmt *ast.ConstStatement) {
+	defer g.recordValueType(constStmt.Name.Value, constStmt.TypeName, constStmt.Value)
+	if constStmt.TypeName != "" {
+		if ml, ok := constStmt.Value.(*ast.MapLiteral); ok {
+			type pair struct{ key, val string }
+			pairs := []pair{}
+			for k, v := range ml.Pairs {
+				keyStr := ""
+				if ks, ok := k.(*ast.StringLiteral); ok {
+					keyStr = ks.Value
+				} else {
+					keyStr = g.captureExpression(k)
+				}
+				valStr := g.captureExpression(v)
+				pairs = append(pairs, pair{keyStr, valStr})
+			}
+			sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+			fields := []string{}
+			for _, p := range pairs {
+				fields = append(fields, fmt.Sprintf("%s: %s", capitalizeFirst(p.key), p.val))
+			}
+			g.write(fmt.Sprintf("const %s = %s{%s}\n", constStmt.Name.Value, constStmt.TypeName, strings.Join(fields, ", ")))
+			g.variableTypes[constStmt.Name.Value] = constStmt.TypeName
+			return
+		}
+	}
+
+	// primitive annotations become explicitly typed Go constants
+	if constStmt.TypeName != "" {
+		if goType := g.mapTypeToGo(constStmt.TypeName); goType != g.anyType() {
+			g.write(fmt.Sprintf("const %s %s = %s\n", constStmt.Name.Value, goType, g.foldConst(constStmt)))
+			return
+		}
+	}
+
+	g.write(fmt.Sprintf("const %s = %s\n", constStmt.Name.Value, g.foldConst(constStmt)))
+}
+
+// foldConst returns the Go source of a const's value, evaluated at transpile
+// time when it is a pure int or string expression.
+func (g *Generator) foldConst(constStmt *ast.ConstStatement) string {
+	v, err := eval.Eval(constStmt.Value, g.constValues)
+	if err != nil {
+		// leave it to Go, which reports the same problems
+		delete(g.constValues, constStmt.Name.Value)
+		return g.captureExpression(constStmt.Value)
+	}
+	g.constValues[constStmt.Name.Value] = v
+	return eval.Literal(v)
+}
+
+func (g *Generator) genCompoundAssign(stmt *ast.CompoundAssignStatement) {
+	name, op := stmt.Name.Value, strings.TrimSuffix(stmt.Operator, "=")
+	if helper, ok := checkedArithHelpers[op]; ok && g.CheckedArith && g.isIntExpr(stmt.Name) && g.isIntExpr(stmt.Value) {
+		g.requiresCheckedArith = true
+		g.write(fmt.Sprintf("%s = %s(%s, %s)\n", name, helper, name, g.captureExpression(stmt.Value)))
+		return
+	}
+	g.write(fmt.Sprintf("%s %s %s\n", name, stmt.Operator, g.captureExpression(stmt.Value)))
+}
+
+func (g *Generator) genReturnStatement(returnStmt *ast.ReturnStatement) {
+	g.write("return ")
+	g.genExpression(returnStmt.ReturnValue)
+	g.write("\n")
+}
+
+func (g *Generator) genFunctionLiteral(node *ast.FunctionLiteral) string {
+	var b bytes.Buffer
+	params := []string{}
+	for _, p := range node.Parameters {
+		if node.ParamTypes != nil {
+			if t, ok := node.ParamTypes[p.Value]; ok {
+				// map simple Pisuke types to Go types; default to interface{}
+				goType := g.mapTypeToGo(t)
+				params = append(params, p.Value+" "+goType)
+				continue
+			}
 		}
+		params = append(params, p.Value+" "+g.anyType())
 	}
+	retType := g.anyType()
+	if node.ReturnType != "" {
+		retType = g.mapTypeToGo(node.ReturnType)
+	}
+	b.WriteString(fmt.Sprintf("func(%s) %s {", strings.Join(params, ", "), retType))
 
-	// fallback: untyped or non-map values
-	g.write(fmt.Sprintf("var %s = ", letStmt.Name.Value))
-	g.genExpression(letStmt.Value)
-	g.write("\n")
-	g.indent()
-	g.write(fmt.Sprintf("_ = %s\n", letStmt.Name.Value))
+	bodyGen := g.child()
+	bodyGen.valueTypes = g.paramScope(node)
+	bodyGen.collectionKinds = g.collectionScope(node)
+	bodyGen.variableTypes = g.structScope(node)
+	bodyGen.elementTypes = g.elementScope(node)
+	bodyGen.returnType = node.ReturnType
+	bodyGen.indentlevel = g.indentlevel + 1
+	for _, s := range node.Body.Statements {
+		bodyGen.genStatement(s)
+	}
+	g.adopt(bodyGen)
+	// if function body does not end in a return, add a default one to satisfy Go
+	if !endsWithReturn(node.Body) {
+		bodyGen.writeLine("return " + g.zeroValueForType(node.ReturnType))
+	}
+	b.WriteString("\n")
+	b.Write(bodyGen.out.Bytes())
+	// the closing brace lines up with the line the literal appears on
+	b.WriteString(strings.Repeat("\t", g.indentlevel))
+	b.WriteString("}")
+	return b.String()
 }
 
-func (g *Generator) genConstStatement(constStmt *ast.ConstStatement) {
-	if constStmt.TypeName != "" {
-		if ml, ok := constStmt.Value.(*ast.MapLiteral); ok {
-			type pair struct{ key, val string }
-			pairs := []pair{}
-			for k, v := range ml.Pairs {
-				keyStr := ""
-				if ks, ok := k.(*ast.StringLiteral); ok {
-					keyStr = ks.Value
-				} else {
-					keyStr = g.captureExpression(k)
+// mapKeyType decides the Go key type of a map literal from its keys: integer
+// keys produce int, string/identifier keys produce string, and a mix of both
+// falls back to interface{}.
+func (g *Generator) mapKeyType(ml *ast.MapLiteral) string {
+	hasInt, hasString := false, false
+	for key := range ml.Pairs {
+		if _, ok := key.(*ast.IntegerLiteral); ok {
+			hasInt = true
+		} else {
+			hasString = true
+		}
+	}
+	switch {
+	case hasInt && hasString:
+		return g.anyType()
+	case hasInt:
+		return "int"
+	default:
+		return "string"
+	}
+}
+
+func (g *Generator) mapTypeToGo(t string) string {
+	t = g.resolveAlias(t)
+	if elem, ok := ast.ListElementType(t); ok {
+		return "[]" + g.mapTypeToGo(elem)
+	}
+	if key, value, ok := ast.MapElementTypes(t); ok {
+		return "map[" + g.mapTypeToGo(key) + "]" + g.mapTypeToGo(value)
+	}
+	if elem, size, ok := ast.ArrayType(t); ok {
+		if n, ok := g.arrayLen(size); ok {
+			size = strconv.FormatInt(n, 10)
+		}
+		return "[" + size + "]" + g.mapTypeToGo(elem)
+	}
+	switch t {
+	case "int":
+		return "int"
+	case "float":
+		return "float64"
+	case "string":
+		return "string"
+	case "bool":
+		return "bool"
+	case "error":
+		return "error"
+	default:
+		return g.anyType()
+	}
+}
+
+// resolveAlias follows `type A = B` aliases until it reaches a type that is
+// not an alias. Alias cycles stop at the first repeated name.
+func (g *Generator) resolveAlias(t string) string {
+	seen := map[string]bool{}
+	for !seen[t] {
+		seen[t] = true
+		td, ok := g.typeDefs[t]
+		if !ok || td.Alias == "" {
+			break
+		}
+		t = td.Alias
+	}
+	return t
+}
+
+func (g *Generator) genTypeDefinition(td *ast.TypeDefinition) {
+	if td.Alias != "" {
+		g.write(fmt.Sprintf("type %s = %s\n", td.Name.Value, g.mapTypeToGo(td.Alias)))
+		g.typeDefs[td.Name.Value] = td
+		return
+	}
+	g.writeLine("type " + td.Name.Value + " struct {")
+	g.indentlevel++
+	for _, f := range td.Fields {
+		g.writeLine(g.structField(f))
+	}
+	g.indentlevel--
+	g.writeLine("}")
+	// record type definition for nested usage
+	g.typeDefs[td.Name.Value] = td
+}
+
+// structField returns the Go declaration of a struct field: the exported
+// field name, its type and a json tag keeping the Pisuke name, e.g.
+// Name string `json:"name"`. Type definitions and the struct literals built
+// from map literals share it, so nested struct types stay identical.
+func (g *Generator) structField(f *ast.Field) string {
+	typ := g.mapTypeToGo(f.Type)
+	if f.Nested != nil {
+		typ = g.nestedStructType(f.Nested)
+	}
+	return fmt.Sprintf("%s %s `json:\"%s\"`", capitalizeFirst(f.Name), typ, f.Name)
+}
+
+// nestedStructType returns the anonymous Go struct type of a nested object
+// field such as address: { city: string }.
+func (g *Generator) nestedStructType(td *ast.TypeDefinition) string {
+	fields := []string{}
+	for _, f := range td.Fields {
+		fields = append(fields, g.structField(f))
+	}
+	return "struct{" + strings.Join(fields, "; ") + "}"
+}
+
+func (g *Generator) genCallExpression(node *ast.CallExpression) {
+	if mae, ok := node.Function.(*ast.MemberAccessExpression); ok {
+		if obj, ok := mae.Object.(*ast.Identifier); ok && obj.Value == "server" {
+			switch mae.Property.Value {
+			case "serve":
+				g.requiresHttp, g.requiresLog = true, true
+				g.write(fmt.Sprintf("log.Fatal(http.ListenAndServe(\":%s\", nil))", g.captureExpression(node.Arguments[0])))
+				return
+			case "static":
+				g.requiresHttp = true
+				g.registerRoute(node, "/")
+				fileServer := fmt.Sprintf("http.FileServer(http.Dir(%s))", g.captureExpression(node.Arguments[0]))
+				if g.requiresMiddleware {
+					fileServer = "wrapHandler(" + fileServer + ".ServeHTTP)"
 				}
-				valStr := g.captureExpression(v)
-				pairs = append(pairs, pair{keyStr, valStr})
+				g.write(fmt.Sprintf("http.Handle(\"/\", %s)", fileServer))
+				return
+			case "route":
+				g.genRouteExpression(node)
+				return
+			case "group":
+				g.genRouteGroup(node)
+				return
 			}
-			sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
-			fields := []string{}
-			for _, p := range pairs {
-				fields = append(fields, fmt.Sprintf("%s: %s", capitalizeFirst(p.key), p.val))
+		}
+		if g.genMathBuiltin(mae, node.Arguments) {
+			return
+		}
+		if g.genRequestAccessor(mae, node.Arguments) {
+			return
+		}
+	}
+
+	if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "print" {
+		g.requiresFmt = true
+		args := []string{}
+		for _, a := range node.Arguments {
+			args = append(args, g.printArg(a))
+		}
+		g.write(fmt.Sprintf("fmt.Println(%s)", strings.Join(args, ", ")))
+		return
+	}
+
+	// format(spec, values...) formats like fmt.Sprintf and, unlike print,
+	// returns the string instead of writing it
+	if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "format" {
+		if len(node.Arguments) == 0 {
+			g.errorf(node, "format expects a format string, got no args")
+			return
+		}
+		if t := g.valueType(node.Arguments[0]); t != "" && t != "string" {
+			g.errorf(node, "format expects a format string first, got %s", t)
+		}
+		g.requiresFmt = true
+		args := []string{}
+		for _, a := range node.Arguments {
+			args = append(args, g.captureExpression(a))
+		}
+		g.write(fmt.Sprintf("fmt.Sprintf(%s)", strings.Join(args, ", ")))
+		return
+	}
+
+	// env(name) reads an environment variable; env(name, fallback) returns
+	// fallback when the variable is not set
+	if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "env" && len(node.Arguments) >= 1 && len(node.Arguments) <= 2 {
+		g.requiresOs = true
+		name := g.captureExpression(node.Arguments[0])
+		if len(node.Arguments) == 1 {
+			g.write(fmt.Sprintf("os.Getenv(%s)", name))
+		} else {
+			g.write(fmt.Sprintf("func() string { if v, ok := os.LookupEnv(%s); ok { return v }; return %s }()", name, g.captureExpression(node.Arguments[1])))
+		}
+		return
+	}
+
+	// sleep(ms) pauses for a number of milliseconds
+	if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "sleep" && len(node.Arguments) == 1 {
+		g.requiresTime = true
+		ms := g.captureExpression(node.Arguments[0])
+		if _, lit := node.Arguments[0].(*ast.IntegerLiteral); !lit {
+			ms = "time.Duration(" + ms + ")"
+		}
+		g.write(fmt.Sprintf("time.Sleep(%s * time.Millisecond)", ms))
+		return
+	}
+
+	// readFile(path) returns the contents of a file as a string
+	if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "readFile" && len(node.Arguments) == 1 {
+		g.requiresIo = true
+		g.write(fmt.Sprintf("func() string { b, _ := ioutil.ReadFile(%s); return string(b) }()", g.captureExpression(node.Arguments[0])))
+		return
+	}
+
+	// writeFile(path, contents) replaces the contents of a file
+	if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "writeFile" && len(node.Arguments) == 2 {
+		g.requiresIo = true
+		g.write(fmt.Sprintf("ioutil.WriteFile(%s, []byte(%s), 0644)", g.captureExpression(node.Arguments[0]), g.captureExpression(node.Arguments[1])))
+		return
+	}
+
+	// status(code) only makes sense as a route handler's result
+	if statusCall(node) != nil {
+		g.errorf(node, "status can only be returned from a route handler")
+		return
+	}
+
+	// respond(status, body) only makes sense as a route handler's result
+	if respondCall(node) != nil {
+		g.errorf(node, "respond can only be returned from a route handler")
+		return
+	}
+
+	// assert(...) is a statement, handled by genStatement
+	if assertCall(node) != nil {
+		g.errorf(node, "assert can only be used as a statement")
+		return
+	}
+
+	// html(str) marks a handler's return value as an HTML page
+	if isHTMLCall(node) {
+		g.requiresHTML = true
+		if sl, ok := node.Arguments[0].(*ast.StringLiteral); ok {
+			g.write(fmt.Sprintf("pskHTML(\"%s\")", sl.Value))
+		} else {
+			g.requiresFmt = true
+			g.write(fmt.Sprintf("pskHTML(fmt.Sprint(%s))", g.captureExpression(node.Arguments[0])))
+		}
+		return
+	}
+
+	// map(list, fn), filter(list, fn) and reduce(list, fn, seed) run through
+	// generated helpers
+	if ident, ok := node.Function.(*ast.Identifier); ok {
+		if g.genListBuiltin(ident.Value, node.Arguments) {
+			return
+		}
+	}
+
+	// method calls: list.map(fn).filter(fn) chains into the list built-ins,
+	// pkg.Fn(...) calls a `use`d Go package and anything else becomes a Go
+	// method call on the receiver value
+	if mae, ok := node.Function.(*ast.MemberAccessExpression); ok {
+		if !g.isGoPackage(mae.Object) {
+			if g.genListBuiltin(mae.Property.Value, append([]ast.Expression{mae.Object}, node.Arguments...)) {
+				return
 			}
-			g.write(fmt.Sprintf("const %s = %s{%s}\n", constStmt.Name.Value, constStmt.TypeName, strings.Join(fields, ", ")))
-			g.variableTypes[constStmt.Name.Value] = constStmt.TypeName
+			args := []string{}
+			for _, a := range node.Arguments {
+				args = append(args, g.captureExpression(a))
+			}
+			g.write(fmt.Sprintf("%s.%s(%s)", g.captureExpression(mae.Object), mae.Property.Value, strings.Join(args, ", ")))
 			return
 		}
 	}
 
-	g.write(fmt.Sprintf("const %s = ", constStmt.Name.Value))
-	g.genExpression(constStmt.Value)
-	g.write("\n")
+	g.genExpression(node.Function)
+	g.write("(")
+	args := []string{}
+	for _, a := range node.Arguments {
+		args = append(args, g.captureExpression(a))
+	}
+	// Go has no default arguments: pass the defaults of omitted parameters
+	if fl := g.namedFunctionValue(node.Function); fl != nil {
+		for _, p := range fl.Parameters[min(len(args), len(fl.Parameters)):] {
+			d, ok := fl.Defaults[p.Value]
+			if !ok {
+				break
+			}
+			args = append(args, g.captureExpression(d))
+		}
+	}
+	g.write(strings.Join(args, ", "))
+	g.write(")")
+}
+
+// printArg returns the Go expression print passes for expr. A struct value
+// prints with its Pisuke field names, {name: ann, age: 3}, rather than as
+// the bare Go struct {ann 3}.
+func (g *Generator) printArg(expr ast.Expression) string {
+	arg := g.captureExpression(expr)
+	ident, ok := expr.(*ast.Identifier)
+	if !ok {
+		return arg
+	}
+	td := g.typeDefs[g.resolveAlias(g.variableTypes[ident.Value])]
+	if td == nil || len(td.Fields) == 0 {
+		return arg
+	}
+	format, args := structFormat(arg, td.Fields)
+	return fmt.Sprintf("fmt.Sprintf(%s, %s)", strconv.Quote(format), strings.Join(args, ", "))
+}
+
+// structFormat returns a format string listing fields by their Pisuke names
+// and the Go expressions of their values in value, descending into nested
+// objects.
+func structFormat(value string, fields []*ast.Field) (string, []string) {
+	parts, args := []string{}, []string{}
+	for _, f := range fields {
+		access := value + "." + capitalizeFirst(f.Name)
+		if f.Nested != nil && len(f.Nested.Fields) > 0 {
+			format, nested := structFormat(access, f.Nested.Fields)
+			parts = append(parts, f.Name+": "+format)
+			args = append(args, nested...)
+			continue
+		}
+		parts = append(parts, f.Name+": %v")
+		args = append(args, access)
+	}
+	return "{" + strings.Join(parts, ", ") + "}", args
+}
+
+// genListBuiltin writes a call of the map, filter or reduce helper when name
+// and the argument count (receiver list included) match one of them, and
+// reports whether it did.
+func (g *Generator) genListBuiltin(name string, args []ast.Expression) bool {
+	helper := ""
+	switch {
+	case name == "map" && len(args) == 2:
+		g.requiresMapHelper, helper = true, "pskMap"
+	case name == "filter" && len(args) == 2:
+		g.requiresFilterHelper, helper = true, "pskFilter"
+	case name == "reduce" && len(args) == 3:
+		g.requiresReduceHelper, helper = true, "pskReduce"
+	default:
+		return false
+	}
+	parts := []string{}
+	for i, a := range args {
+		if i == 1 {
+			parts = append(parts, g.listCallback(name, args))
+			continue
+		}
+		parts = append(parts, g.captureExpression(a))
+	}
+	g.write(fmt.Sprintf("%s(%s)", helper, strings.Join(parts, ", ")))
+	return true
+}
+
+// listCallback returns the callback argument of a map, filter or reduce
+// call. The helpers call it with interface{} values, so a callback whose
+// parameters have known types is wrapped in one asserting them. Untyped
+// parameters take the element type of the list when that is known; reduce's
+// accumulator takes it too when the seed has the same type, as in a sum.
+func (g *Generator) listCallback(name string, args []ast.Expression) string {
+	want := []string{g.listElementType(args[0])}
+	if name == "reduce" {
+		acc := ""
+		if g.valueType(args[2]) == want[0] {
+			acc = want[0]
+		}
+		want = []string{acc, want[0]}
+	}
+	var params []*ast.Identifier
+	var paramTypes map[string]string
+	callee := ""
+	switch fn := args[1].(type) {
+	case *ast.FunctionLiteral:
+		typed := *fn
+		typed.ParamTypes = map[string]string{}
+		for i, p := range fn.Parameters {
+			if t, ok := fn.ParamTypes[p.Value]; ok {
+				typed.ParamTypes[p.Value] = t
+			} else if i < len(want) && want[i] != "" {
+				typed.ParamTypes[p.Value] = want[i]
+			}
+		}
+		params, paramTypes = fn.Parameters, typed.ParamTypes
+		callee = "(" + g.captureExpression(&typed) + ")"
+	default:
+		if fl := g.namedFunctionValue(args[1]); fl != nil {
+			params, paramTypes = fl.Parameters, fl.ParamTypes
+			callee = g.captureExpression(args[1])
+		}
+	}
+	if len(paramTypes) == 0 || len(params) != len(want) {
+		return g.captureExpression(args[1])
+	}
+	a := g.anyType()
+	decls, values := []string{}, []string{}
+	for i, p := range params {
+		arg := fmt.Sprintf("pskArg%d", i)
+		decls = append(decls, arg+" "+a)
+		if t, ok := paramTypes[p.Value]; ok {
+			arg += ".(" + g.mapTypeToGo(t) + ")"
+		}
+		values = append(values, arg)
+	}
+	return fmt.Sprintf("func(%s) %s { return %s(%s) }", strings.Join(decls, ", "), a, callee, strings.Join(values, ", "))
+}
+
+// requestAccessors maps the typed accessors of a route handler's request to
+// the type they return.
+var requestAccessors = map[string]string{
+	"queryString": "string",
+	"queryInt":    "int",
+}
+
+// requestAccessor returns the name of the typed request accessor called by
+// mae, such as queryInt in req.queryInt("page"), or "" when mae is not one.
+func (g *Generator) requestAccessor(mae *ast.MemberAccessExpression) string {
+	obj, ok := mae.Object.(*ast.Identifier)
+	if !ok || g.requestParam == "" || obj.Value != g.requestParam {
+		return ""
+	}
+	if _, ok := requestAccessors[mae.Property.Value]; !ok {
+		return ""
+	}
+	return mae.Property.Value
+}
+
+// genRequestAccessor writes a call of a typed request accessor and reports
+// whether mae was one. req.queryString(name) is the query parameter, or ""
+// when it is missing; req.queryInt(name) is the parameter parsed as an int,
+// or 0 when it is missing or malformed.
+func (g *Generator) genRequestAccessor(mae *ast.MemberAccessExpression, args []ast.Expression) bool {
+	accessor := g.requestAccessor(mae)
+	if accessor == "" {
+		return false
+	}
+	if len(args) != 1 {
+		g.errorf(mae, "%s.%s expects 1 arg (name), got %d", g.requestParam, accessor, len(args))
+		return true
+	}
+	value := fmt.Sprintf("r.URL.Query().Get(%s)", g.captureExpression(args[0]))
+	if accessor == "queryInt" {
+		g.requiresStrconv = true
+		g.write(fmt.Sprintf("func() int { n, _ := strconv.Atoi(%s); return n }()", value))
+		return true
+	}
+	g.write(value)
+	return true
+}
+
+// mathFuncs maps the functions of the built-in math module to their Go
+// counterparts and argument counts.
+var mathFuncs = map[string]struct {
+	goName string
+	arity  int
+}{
+	"sqrt":  {"Sqrt", 1},
+	"abs":   {"Abs", 1},
+	"pow":   {"Pow", 2},
+	"floor": {"Floor", 1},
+	"ceil":  {"Ceil", 1},
+}
+
+// genMathBuiltin writes math.sqrt(x) and friends as calls into Go's math
+// package, converting the arguments to float64, and reports whether it did.
+func (g *Generator) genMathBuiltin(mae *ast.MemberAccessExpression, args []ast.Expression) bool {
+	obj, ok := mae.Object.(*ast.Identifier)
+	if !ok || obj.Value != "math" {
+		return false
+	}
+	fn, ok := mathFuncs[mae.Property.Value]
+	if !ok || len(args) != fn.arity {
+		return false
+	}
+	g.requiresMath = true
+	parts := []string{}
+	for _, a := range args {
+		s := g.captureExpression(a)
+		// integer literals are untyped constants in Go and need no conversion
+		if _, lit := a.(*ast.IntegerLiteral); !lit {
+			s = "float64(" + s + ")"
+		}
+		parts = append(parts, s)
+	}
+	g.write(fmt.Sprintf("math.%s(%s)", fn.goName, strings.Join(parts, ", ")))
+	return true
+}
+
+// isGoPackage reports whether expr names a package brought in with `use`.
+func (g *Generator) isGoPackage(expr ast.Expression) bool {
+	if obj, ok := expr.(*ast.Identifier); ok {
+		_, isPkg := g.goPackages[obj.Value]
+		return isPkg
+	}
+	return false
+}
+
+// assertCall returns expr when it is a call of the assert built-in, or nil.
+func assertCall(expr ast.Expression) *ast.CallExpression {
+	call, ok := expr.(*ast.CallExpression)
+	if !ok || len(call.Arguments) < 1 || len(call.Arguments) > 2 {
+		return nil
+	}
+	if ident, ok := call.Function.(*ast.Identifier); ok && ident.Value == "assert" {
+		return call
+	}
+	return nil
+}
+
+// respondCall returns expr when it is a respond(status, body) call, or nil.
+func respondCall(expr ast.Expression) *ast.CallExpression {
+	call, ok := expr.(*ast.CallExpression)
+	if !ok || len(call.Arguments) != 2 {
+		return nil
+	}
+	if ident, ok := call.Function.(*ast.Identifier); ok && ident.Value == "respond" {
+		return call
+	}
+	return nil
+}
+
+// statusCall returns expr when it is a status(code) call, which responds with
+// the status code and no body, or nil.
+func statusCall(expr ast.Expression) *ast.CallExpression {
+	call, ok := expr.(*ast.CallExpression)
+	if !ok || len(call.Arguments) != 1 {
+		return nil
+	}
+	if ident, ok := call.Function.(*ast.Identifier); ok && ident.Value == "status" {
+		return call
+	}
+	return nil
+}
+
+// genAssert emits assert(cond) and assert(cond, message) as a check that
+// panics when cond is false. Without a message the panic names the failed
+// condition and its location.
+func (g *Generator) genAssert(call *ast.CallExpression) {
+	cond := call.Arguments[0]
+	msg := ""
+	if len(call.Arguments) == 2 {
+		msg = g.captureExpression(call.Arguments[1])
+	} else {
+		where := ""
+		if line := ast.LineOf(call); line > 0 {
+			where = fmt.Sprintf(" (line %d)", line)
+			if g.Lines != nil {
+				if file, orig, ok := g.Lines(line); ok {
+					where = fmt.Sprintf(" (%s:%d)", file, orig)
+				}
+			}
+		}
+		msg = strconv.Quote("assertion failed: " + cond.String() + where)
+	}
+	g.write(fmt.Sprintf("if !(%s) {\n", g.captureExpression(cond)))
+	g.indentlevel++
+	g.writeLine(fmt.Sprintf("panic(%s)", msg))
+	g.indentlevel--
+	g.writeLine("}")
+}
+
+// isHTMLCall reports whether expr is a call of the html built-in.
+func isHTMLCall(expr ast.Expression) bool {
+	call, ok := expr.(*ast.CallExpression)
+	if !ok || len(call.Arguments) != 1 {
+		return false
+	}
+	ident, ok := call.Function.(*ast.Identifier)
+	return ok && ident.Value == "html"
 }
 
-func (g *Generator) genReturnStatement(returnStmt *ast.ReturnStatement) {
-	g.write("return ")
-	g.genExpression(returnStmt.ReturnValue)
-	g.write("\n")
+// renderCall returns the render(file, data) call made by a handler statement,
+// either on its own or as the returned value, or nil.
+func renderCall(stmt ast.Statement) *ast.CallExpression {
+	var expr ast.Expression
+	switch s := stmt.(type) {
+	case *ast.ExpressionStatement:
+		expr = s.Expression
+	case *ast.ReturnStatement:
+		expr = s.ReturnValue
+	}
+	call, ok := expr.(*ast.CallExpression)
+	if !ok || len(call.Arguments) < 1 || len(call.Arguments) > 2 {
+		return nil
+	}
+	if ident, ok := call.Function.(*ast.Identifier); ok && ident.Value == "render" {
+		return call
+	}
+	return nil
 }
 
-func (g *Generator) genFunctionLiteral(node *ast.FunctionLiteral) string {
-	var b bytes.Buffer
-	params := []string{}
-	for _, p := range node.Parameters {
-		if node.ParamTypes != nil {
-			if t, ok := node.ParamTypes[p.Value]; ok {
-				// map simple Pisuke types to Go types; default to interface{}
-				goType := mapTypeToGo(t)
-				params = append(params, p.Value+" "+goType)
-				continue
-			}
+// genRender executes an html/template file into the handler's response and
+// ends the handler. Template errors are reported with a 500.
+func (g *Generator) genRender(call *ast.CallExpression) {
+	g.requiresTemplate = true
+	data := "nil"
+	if len(call.Arguments) == 2 {
+		data = g.captureExpression(call.Arguments[1])
+	}
+	g.writeLine(fmt.Sprintf("tmpl, err := template.ParseFiles(%s)", g.captureExpression(call.Arguments[0])))
+	g.writeLine("if err != nil {")
+	g.indentlevel++
+	g.writeLine("http.Error(w, \"failed to load template\", http.StatusInternalServerError)")
+	g.writeLine("return")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine(fmt.Sprintf("if err := tmpl.Execute(w, %s); err != nil {", data))
+	g.indentlevel++
+	g.writeLine("http.Error(w, \"failed to render template\", http.StatusInternalServerError)")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("return")
+}
+
+// genRecover emits the deferred recovery that answers a panicking handler with
+// a 500. The log line names the route and, when known, its .psk location.
+func (g *Generator) genRecover(route string, handler *ast.FunctionLiteral) {
+	g.requiresLog = true
+	where := route
+	if g.Lines != nil {
+		if file, line, ok := g.Lines(ast.LineOf(handler)); ok {
+			where = fmt.Sprintf("%s (%s:%d)", route, file, line)
 		}
-		params = append(params, p.Value+" interface{}")
 	}
-	retType := "interface{}"
-	if node.ReturnType != "" {
-		retType = mapTypeToGo(node.ReturnType)
+	g.writeLine("defer func() {")
+	g.indentlevel++
+	g.writeLine("if rec := recover(); rec != nil {")
+	g.indentlevel++
+	g.writeLine(fmt.Sprintf("log.Printf(\"panic in handler %%s: %%v\", %s, rec)", strconv.Quote(where)))
+	g.writeLine("http.Error(w, \"internal error\", http.StatusInternalServerError)")
+	g.indentlevel--
+	g.writeLine("}")
+	g.indentlevel--
+	g.writeLine("}()")
+}
+
+// genJSONRequestLog emits the start of a rich route handler that logs the
+// request as one JSON line on stderr, without the log package's timestamp
+// prefix, once the handler returns. w is replaced by a
+// pskStatusWriter recording the status; the log is deferred before the
+// panic recovery so a recovered panic is logged with its 500 status.
+func (g *Generator) genJSONRequestLog() {
+	g.requiresOs, g.requiresTime, g.requiresStatusWriter = true, true, true
+	g.writeLine("start := time.Now()")
+	g.writeLine("sw := &pskStatusWriter{ResponseWriter: w, status: http.StatusOK}")
+	g.writeLine("w = sw")
+	g.writeLine("defer func() {")
+	g.indentlevel++
+	g.writeLine(fmt.Sprintf("line, _ := json.Marshal(map[string]%s{\"method\": r.Method, \"path\": r.URL.Path, \"status\": sw.status, \"duration_ms\": time.Since(start).Milliseconds()})", g.anyType()))
+	g.writeLine("os.Stderr.Write(append(line, '\\n'))")
+	g.indentlevel--
+	g.writeLine("}()")
+}
+
+// handlerWrappers returns the functions a route handler is wrapped in, from
+// the outermost: the server.use chain and the gzip encoder.
+func (g *Generator) handlerWrappers() []string {
+	wrappers := []string{}
+	if g.requiresMiddleware {
+		wrappers = append(wrappers, "wrapHandler")
 	}
-	b.WriteString(fmt.Sprintf("func(%s) %s {", strings.Join(params, ", "), retType))
+	if g.gzip {
+		g.requiresGzip = true
+		wrappers = append(wrappers, "pskGzip")
+	}
+	return wrappers
+}
 
-	bodyGen := NewGenerator()
-	bodyGen.indentlevel = g.indentlevel + 1
-	for _, s := range node.Body.Statements {
-		bodyGen.genStatement(s)
+// openHandler writes the start of the http.HandleFunc call registering
+// handler for route under pattern, up to the handler's body, which closeHandler
+// ends. The handler function is wrapped in its handlerWrappers and starts with
+// the request log of a rich handler and the panic recovery. With server.use
+// middleware, the log and the recovery run in a function around the
+// middleware chain instead, so requests the middleware rejects are logged and
+// its panics recovered too.
+func (g *Generator) openHandler(pattern, route string, handler *ast.FunctionLiteral, rich bool) {
+	open := ""
+	for _, w := range g.handlerWrappers() {
+		open += w + "("
 	}
-	// if function body contains no return, add a default return nil to satisfy Go
-	hasReturn := false
-	for _, s := range node.Body.Statements {
-		if _, ok := s.(*ast.ReturnStatement); ok {
-			hasReturn = true
-			break
+	open += "func(w http.ResponseWriter, r *http.Request) {\n"
+	g.write(fmt.Sprintf("http.HandleFunc(%s, ", pattern))
+	if g.requiresMiddleware {
+		g.write("func(w http.ResponseWriter, r *http.Request) {\n")
+		g.indentlevel++
+		g.genRequestGuards(route, handler, rich)
+		if rich && g.logFormat != "" && !g.logJSON {
+			g.requiresLog = true
+			g.writeLine(logPrintfCall(g.logFormat))
 		}
+		g.indent()
+		g.write(open)
+		g.indentlevel++
+		return
+	}
+	g.write(open)
+	g.indentlevel++
+	g.genRequestGuards(route, handler, rich)
+}
+
+// genRequestGuards emits the JSON request log of a rich handler and the panic
+// recovery of a route handler, as far as they are enabled.
+func (g *Generator) genRequestGuards(route string, handler *ast.FunctionLiteral, rich bool) {
+	if rich && g.logJSON {
+		g.genJSONRequestLog()
 	}
-	if !hasReturn {
-		bodyGen.writeLine("return nil")
+	if g.recoverPanics {
+		g.genRecover(route, handler)
 	}
-	b.WriteString("\n")
-	b.Write(bodyGen.out.Bytes())
-	g.indent()
-	b.WriteString("}")
-	return b.String()
 }
 
-func mapTypeToGo(t string) string {
-	switch t {
-	case "int":
-		return "int"
-	case "string":
-		return "string"
-	default:
-		return "interface{}"
+// closeHandler ends the http.HandleFunc call started by openHandler.
+func (g *Generator) closeHandler() {
+	closing := "}" + strings.Repeat(")", len(g.handlerWrappers()))
+	g.indentlevel--
+	g.indent()
+	if g.requiresMiddleware {
+		g.write(closing + "(w, r)\n")
+		g.indentlevel--
+		g.indent()
+		g.write("})")
+		return
 	}
+	g.write(closing + ")")
 }
 
-func (g *Generator) genTypeDefinition(td *ast.TypeDefinition) {
-	g.writeLine("type " + td.Name.Value + " struct {")
+// genGzipHelpers emits pskGzip, which gzip-encodes the responses of a
+// handler when the request accepts gzip. The body is compressed as it is
+// written, so the Content-Length of the uncompressed body is dropped, and
+// a body without a Content-Type gets one sniffed from its uncompressed
+// bytes, as net/http would otherwise sniff the compressed ones.
+func (g *Generator) genGzipHelpers() {
+	g.requiresHttp, g.requiresStrings = true, true
+	g.writeLine("// pskGzipWriter gzip-encodes the body written through it")
+	g.writeLine("type pskGzipWriter struct {")
 	g.indentlevel++
-	for _, f := range td.Fields {
-		fieldName := capitalizeFirst(f.Name)
-		if f.Nested != nil {
-			// emit nested anonymous struct type
-			g.writeLine(fieldName + " struct {")
-			g.indentlevel++
-			for _, nf := range f.Nested.Fields {
-				nfName := capitalizeFirst(nf.Name)
-				nfType := mapTypeToGo(nf.Type)
-				g.writeLine(nfName + " " + nfType)
-			}
-			g.indentlevel--
-			g.writeLine("}")
-		} else {
-			fieldType := mapTypeToGo(f.Type)
-			g.writeLine(fieldName + " " + fieldType)
+	g.writeLine("http.ResponseWriter")
+	g.writeLine("zw *gzip.Writer")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("func (w *pskGzipWriter) WriteHeader(code int) {")
+	g.indentlevel++
+	g.writeLine("w.Header().Del(\"Content-Length\")")
+	g.writeLine("w.ResponseWriter.WriteHeader(code)")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("func (w *pskGzipWriter) Write(b []byte) (int, error) {")
+	g.indentlevel++
+	g.writeLine("if w.Header().Get(\"Content-Type\") == \"\" {")
+	g.indentlevel++
+	g.writeLine("w.Header().Set(\"Content-Type\", http.DetectContentType(b))")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("w.Header().Del(\"Content-Length\")")
+	g.writeLine("return w.zw.Write(b)")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("func pskGzip(h http.HandlerFunc) http.HandlerFunc {")
+	g.indentlevel++
+	g.writeLine("return func(w http.ResponseWriter, r *http.Request) {")
+	g.indentlevel++
+	g.writeLine("if !strings.Contains(r.Header.Get(\"Accept-Encoding\"), \"gzip\") {")
+	g.indentlevel++
+	g.writeLine("h(w, r)")
+	g.writeLine("return")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("w.Header().Set(\"Content-Encoding\", \"gzip\")")
+	g.writeLine("w.Header().Add(\"Vary\", \"Accept-Encoding\")")
+	g.writeLine("zw := gzip.NewWriter(w)")
+	g.writeLine("defer zw.Close()")
+	g.writeLine("h(&pskGzipWriter{ResponseWriter: w, zw: zw}, r)")
+	g.indentlevel--
+	g.writeLine("}")
+	g.indentlevel--
+	g.writeLine("}")
+}
+
+// genMiddlewares emits the middleware registered with server.use and
+// wrapHandler, which runs a route handler behind them in registration order.
+//
+// A middleware fn(req) runs before the route handler. req holds "query",
+// "headers" (keyed by lower-case header name), "method" and "path". The
+// middleware ends the request with a status code and no body by
+//   - status(code), usually guarded: status(401) when req["headers"]["auth"] == nil
+//   - return status(code), or return code
+//
+// and otherwise passes the request on once its body completes. Request
+// logging and panic recovery run outside the middleware, see openHandler.
+func (g *Generator) genMiddlewares() {
+	if !g.requiresMiddleware {
+		return
+	}
+	g.requiresHttp = true
+	g.writeLine("var middlewares = []func(http.HandlerFunc) http.HandlerFunc{")
+	g.indentlevel++
+	for _, call := range g.middlewares {
+		if len(call.Arguments) != 1 {
+			g.errorf(call, "server.use expects 1 arg (fn(req)), got %d", len(call.Arguments))
+			continue
+		}
+		fl, ok := call.Arguments[0].(*ast.FunctionLiteral)
+		if !ok || len(fl.Parameters) != 1 {
+			g.errorf(call, "server.use expects a function literal fn(req), got %s", call.Arguments[0].String())
+			continue
 		}
+		g.genMiddleware(fl)
 	}
 	g.indentlevel--
 	g.writeLine("}")
-	// record type definition for nested usage
-	g.typeDefs[td.Name.Value] = td
+	g.writeLine("func wrapHandler(h http.HandlerFunc) http.HandlerFunc {")
+	g.indentlevel++
+	g.writeLine("for i := len(middlewares)-1; i >= 0; i-- {")
+	g.indentlevel++
+	g.writeLine("h = middlewares[i](h)")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine("return h")
+	g.indentlevel--
+	g.writeLine("}")
 }
 
-func (g *Generator) genCallExpression(node *ast.CallExpression) {
-	if mae, ok := node.Function.(*ast.MemberAccessExpression); ok {
-		if obj, ok := mae.Object.(*ast.Identifier); ok && obj.Value == "server" {
-			switch mae.Property.Value {
-			case "serve":
-				g.requiresHttp, g.requiresLog = true, true
-				g.write(fmt.Sprintf("log.Fatal(http.ListenAndServe(\":%s\", nil))", g.captureExpression(node.Arguments[0])))
-				return
-			case "static":
-				g.requiresHttp = true
-				g.write(fmt.Sprintf("http.Handle(\"/\", http.FileServer(http.Dir(%s)))", g.captureExpression(node.Arguments[0])))
-				return
-			case "route":
-				g.genRouteExpression(node)
-				return
+// genMiddleware emits one server.use middleware as a
+// func(next http.HandlerFunc) http.HandlerFunc element of the middlewares
+// list; see genMiddlewares for the contract.
+func (g *Generator) genMiddleware(fl *ast.FunctionLiteral) {
+	g.requiresStrings = true
+	param := fl.Parameters[0].Value
+	g.writeLine("func(next http.HandlerFunc) http.HandlerFunc {")
+	g.indentlevel++
+	g.writeLine("return func(w http.ResponseWriter, r *http.Request) {")
+	g.indentlevel++
+	g.writeLine(fmt.Sprintf("query := make(map[string]%s)", g.anyType()))
+	g.writeLine("for k, v := range r.URL.Query() {")
+	g.indentlevel++
+	g.writeLine("if len(v) > 0 { query[k] = v[0] }")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine(fmt.Sprintf("headers := make(map[string]%s)", g.anyType()))
+	g.writeLine("for k, v := range r.Header {")
+	g.indentlevel++
+	g.writeLine("if len(v) > 0 { headers[strings.ToLower(k)] = v[0] }")
+	g.indentlevel--
+	g.writeLine("}")
+	g.writeLine(fmt.Sprintf("%s := map[string]%s{\"query\": query, \"headers\": headers, \"method\": r.Method, \"path\": r.URL.Path}", param, g.anyType()))
+	g.writeLine("_ = " + param)
+
+	var body bytes.Buffer
+	mg := g.child()
+	mg.out = &body
+	mg.requestParam = param
+
+	returned := false
+	for _, s := range fl.Body.Statements {
+		if es, ok := s.(*ast.ExpressionStatement); ok && statusCall(es.Expression) != nil {
+			code := mg.captureExpression(statusCall(es.Expression).Arguments[0])
+			if es.Guard != nil {
+				mg.writeLine("if " + mg.captureExpression(es.Guard) + " {")
+				mg.indentlevel++
 			}
+			mg.writeLine("w.WriteHeader(" + code + ")")
+			mg.writeLine("return")
+			if es.Guard != nil {
+				mg.indentlevel--
+				mg.writeLine("}")
+			}
+			continue
+		}
+		if rs, ok := s.(*ast.ReturnStatement); ok {
+			value := rs.ReturnValue
+			if call := statusCall(value); call != nil {
+				value = call.Arguments[0]
+			} else if _, ok := value.(*ast.IntegerLiteral); !ok && mg.valueType(value) != "int" {
+				mg.errorf(rs, "middleware must return a status code, got %s", value.String())
+			}
+			mg.writeLine("w.WriteHeader(" + mg.captureExpression(value) + ")")
+			mg.writeLine("return")
+			returned = true
+			break
 		}
+		mg.genStatement(s)
 	}
+	g.adopt(mg)
+	g.out.Write(body.Bytes())
 
-	if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "print" {
-		g.requiresFmt = true
-		args := []string{}
-		for _, a := range node.Arguments {
-			args = append(args, g.captureExpression(a))
+	if !returned {
+		g.writeLine("next(w, r)")
+	}
+	g.indentlevel--
+	g.writeLine("}")
+	g.indentlevel--
+	g.writeLine("},")
+}
+
+// wildcardName matches the name of a ServeMux wildcard such as {id}.
+var wildcardName = regexp.MustCompile(`\{[^}]*\}`)
+
+// registerRoute records the ServeMux pattern registered by node and reports
+// a pattern registered twice, which makes http.HandleFunc panic at startup.
+// Wildcards conflict whatever their names, so /users/{id} and /users/{name}
+// are duplicates. Routes under a `when` guard are not checked, as guards may
+// exclude each other.
+func (g *Generator) registerRoute(node ast.Node, pattern string) {
+	if g.guarded {
+		return
+	}
+	key := wildcardName.ReplaceAllString(pattern, "{}")
+	if line, ok := g.routes[key]; ok {
+		if line > 0 {
+			g.errorf(node, "duplicate route %s (already registered on line %d)", pattern, line)
+		} else {
+			g.errorf(node, "duplicate route %s", pattern)
 		}
-		g.write(fmt.Sprintf("fmt.Println(%s)", strings.Join(args, ", ")))
 		return
 	}
+	g.routes[key] = ast.LineOf(node)
+}
 
-	g.genExpression(node.Function)
-	g.write("(")
-	args := []string{}
-	for _, a := range node.Arguments {
-		args = append(args, g.captureExpression(a))
+// routeHandler returns the handler of a server.route call. A declared
+// function passed by name is wrapped in a literal that calls it with the
+// request, or with no arguments when it takes none. It returns nil when the
+// handler is neither.
+func (g *Generator) routeHandler(node *ast.CallExpression) *ast.FunctionLiteral {
+	switch h := node.Arguments[1].(type) {
+	case *ast.FunctionLiteral:
+		return h
+	case *ast.Identifier:
+		fn, ok := g.functions[h.Value]
+		if !ok {
+			return nil
+		}
+		wrapper := &ast.FunctionLiteral{Token: h.Token, Body: &ast.BlockStatement{Token: h.Token}}
+		call := &ast.CallExpression{Token: h.Token, Function: h}
+		if len(fn.Parameters) > 0 {
+			req := &ast.Identifier{Token: h.Token, Value: "req"}
+			wrapper.Parameters = []*ast.Identifier{req}
+			call.Arguments = []ast.Expression{req}
+		}
+		wrapper.Body.Statements = []ast.Statement{&ast.ReturnStatement{Token: h.Token, ReturnValue: call}}
+		return wrapper
 	}
-	g.write(strings.Join(args, ", "))
-	g.write(")")
+	return nil
+}
+
+// genRouteGroup emits server.group(prefix, fn() { ... }) as a Go block
+// holding the body of fn, whose routes get prefix prepended to their paths.
+func (g *Generator) genRouteGroup(node *ast.CallExpression) {
+	if len(node.Arguments) != 2 {
+		g.errorf(node, "server.group expects 2 args (prefix, fn), got %d", len(node.Arguments))
+		return
+	}
+	prefix, ok := node.Arguments[0].(*ast.StringLiteral)
+	if !ok {
+		g.errorf(node, "server.group prefix must be a string literal")
+		return
+	}
+	body, ok := node.Arguments[1].(*ast.FunctionLiteral)
+	if !ok || len(body.Parameters) > 0 {
+		g.errorf(node, "server.group(%q): body must be a function literal without parameters", prefix.Value)
+		return
+	}
+	g.routePrefixes = append(g.routePrefixes, strings.TrimSuffix(prefix.Value, "/"))
+	g.write("{\n")
+	g.indentlevel++
+	for _, s := range body.Body.Statements {
+		g.genStatement(s)
+	}
+	g.indentlevel--
+	g.indent()
+	g.write("}")
+	g.routePrefixes = g.routePrefixes[:len(g.routePrefixes)-1]
 }
 
 func (g *Generator) genRouteExpression(node *ast.CallExpression) {
+	if len(node.Arguments) != 2 {
+		g.errorf(node, "server.route expects 2 args (path, handler), got %d", len(node.Arguments))
+		return
+	}
 	rawPath := g.captureExpression(node.Arguments[0])
-	handler := node.Arguments[1].(*ast.FunctionLiteral)
+	if sl, ok := node.Arguments[0].(*ast.StringLiteral); ok && len(g.routePrefixes) > 0 {
+		rawPath = "\"" + strings.Join(g.routePrefixes, "") + sl.Value + "\""
+	}
+	handler := g.routeHandler(node)
+	if handler == nil {
+		g.errorf(node, "server.route(%s): handler must be a function literal or a declared function", rawPath)
+		return
+	}
+
+	// a trailing * segment matches the rest of the path
+	pathStr := strings.Trim(rawPath, "\"")
+	parts := strings.Split(strings.Trim(pathStr, "/"), "/")
+	catchAll := -1
+	for i, p := range parts {
+		if p == "*" {
+			catchAll = i
+		}
+	}
+	if catchAll >= 0 && catchAll != len(parts)-1 {
+		g.errorf(node, "server.route(%s): * must be the last path segment", rawPath)
+		return
+	}
 
 	// If handler has no parameters, emit the minimal handler (preserve existing tests)
 	if len(handler.Parameters) == 0 {
 		g.requiresHttp = true
-		g.requiresFmt = true
-		g.write(fmt.Sprintf("http.HandleFunc(%s, wrapHandler(func(w http.ResponseWriter, r *http.Request) {", rawPath))
-		g.indentlevel++
-		g.write("\n")
+		if catchAll >= 0 {
+			// a pattern ending in / matches every path below it
+			rawPath = fmt.Sprintf("\"%s\"", strings.TrimSuffix(pathStr, "*"))
+		}
+		g.registerRoute(node, strings.Trim(rawPath, "\""))
+		g.openHandler(rawPath, strings.Trim(rawPath, "\""), handler, false)
 		// generate simple handler body: evaluate return and print
 		var handlerLogicBuf bytes.Buffer
-		hg := NewGenerator()
+		hg := g.child()
 		hg.out = &handlerLogicBuf
-		hg.indentlevel = g.indentlevel
 
+		returnsHTML, rendered, responds := false, false, false
 		for _, s := range handler.Body.Statements {
+			if call := renderCall(s); call != nil {
+				hg.genRender(call)
+				rendered = true
+				break
+			}
+			// return status(204) writes the status and no body
+			if rs, ok := s.(*ast.ReturnStatement); ok && statusCall(rs.ReturnValue) != nil {
+				hg.writeLine("w.WriteHeader(" + hg.captureExpression(statusCall(rs.ReturnValue).Arguments[0]) + ")")
+				rendered = true
+				break
+			}
 			if rs, ok := s.(*ast.ReturnStatement); ok {
+				value := rs.ReturnValue
+				if call := respondCall(value); call != nil {
+					hg.writeLine("status := " + hg.captureExpression(call.Arguments[0]))
+					value, responds = call.Arguments[1], true
+				}
 				hg.indent()
 				hg.write("returnValue := ")
-				hg.write(hg.captureExpression(rs.ReturnValue))
+				hg.write(hg.captureExpression(value))
 				hg.write("\n")
+				returnsHTML = isHTMLCall(value)
 			} else {
 				hg.genStatement(s)
 			}
 		}
+		g.adopt(hg)
 
 		// append fmt line into handler buffer so indentation matches
-		hg.writeLine("fmt.Fprint(w, returnValue)")
+		if returnsHTML {
+			hg.writeLine("w.Header().Set(\"Content-Type\", \"text/html; charset=utf-8\")")
+		}
+		if responds {
+			hg.writeLine("w.WriteHeader(status)")
+		}
+		if !rendered {
+			g.requiresFmt = true
+			hg.writeLine("fmt.Fprint(w, returnValue)")
+		}
 		g.out.Write(handlerLogicBuf.Bytes())
 
-		g.indentlevel--
-		g.indent()
-		g.write("})")
+		g.closeHandler()
 		return
 	}
 
 	// Rich handler generation when handler accepts a parameter (req)
-	g.requiresHttp, g.requiresFmt, g.requiresLog, g.requiresJson, g.requiresIo = true, true, true, true, true
+	g.requiresHttp, g.requiresJson, g.requiresIo = true, true, true
 
-	// build path param names from rawPath (strip quotes)
-	pathStr := strings.Trim(rawPath, "\"")
-	paramNames := []string{}
-	// normalize template path parts by trimming leading/trailing slashes so
-	// that parts align with request pathParts which are produced by
+	// build path param names from the path parts, which are normalized by
+	// trimming leading/trailing slashes so that they align with request
+	// pathParts which are produced by
 	// strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	parts := strings.Split(strings.Trim(pathStr, "/"), "/")
+	paramNames := []string{}
 	for _, p := range parts {
 		if strings.HasPrefix(p, ":") {
 			paramNames = append(paramNames, p[1:])
 		}
 	}
+	dynamic := len(paramNames) > 0 || catchAll >= 0
+
+	// Go 1.22 ServeMux matches wildcards itself: /users/:id -> /users/{id}
+	// and /static/* -> /static/{wildcard...}
+	wildcards := dynamic && goVersionAtLeast(g.TargetGoVersion, 22)
 
 	// choose registration pattern: if path contains dynamic segments (:") use prefix up to first dynamic
 	regPattern := rawPath
-	if len(paramNames) > 0 {
+	if wildcards {
+		segments := []string{}
+		for _, p := range parts {
+			if strings.HasPrefix(p, ":") {
+				p = "{" + p[1:] + "}"
+			}
+			if p == "*" {
+				p = "{wildcard...}"
+			}
+			segments = append(segments, p)
+		}
+		regPattern = fmt.Sprintf("\"/%s\"", strings.Join(segments, "/"))
+	} else if dynamic {
 		firstDyn := -1
 		for i, p := range parts {
-			if strings.HasPrefix(p, ":") {
+			if strings.HasPrefix(p, ":") || p == "*" {
 				firstDyn = i
 				break
 			}
@@ -588,25 +3107,30 @@ func (g *Generator) genRouteExpression(node *ast.CallExpression) {
 		}
 		regPattern = fmt.Sprintf("\"%s\"", prefix)
 	}
-	g.write(fmt.Sprintf("http.HandleFunc(%s, func(w http.ResponseWriter, r *http.Request) {", regPattern))
-	g.indentlevel++
-	g.write("\n")
+	g.registerRoute(node, strings.Trim(regPattern, "\""))
+	g.openHandler(regPattern, pathStr, handler, true)
 
 	// prepare req map
-	g.writeLine("query := make(map[string]interface{})")
+	g.writeLine(fmt.Sprintf("query := make(map[string]%s)", g.anyType()))
 	g.writeLine("for k, v := range r.URL.Query() {")
 	g.indentlevel++
 	g.writeLine("if len(v) > 0 { query[k] = v[0] }")
 	g.indentlevel--
 	g.writeLine("}")
-	g.writeLine("req := make(map[string]interface{})")
+	g.writeLine(fmt.Sprintf("req := make(map[string]%s)", g.anyType()))
 	g.writeLine("req[\"query\"] = query")
 
 	// path params
-	if len(paramNames) > 0 {
+	if wildcards && len(paramNames) > 0 {
+		g.writeLine(fmt.Sprintf("params := make(map[string]%s)", g.anyType()))
+		for _, name := range paramNames {
+			g.writeLine(fmt.Sprintf("params[\"%s\"] = r.PathValue(\"%s\")", name, name))
+		}
+		g.writeLine("req[\"params\"] = params")
+	} else if len(paramNames) > 0 {
 		g.requiresStrings = true
 		g.writeLine("pathParts := strings.Split(strings.Trim(r.URL.Path, \"/\"), \"/\")")
-		g.writeLine("params := make(map[string]interface{})")
+		g.writeLine(fmt.Sprintf("params := make(map[string]%s)", g.anyType()))
 		g.writeLine("// naive mapping: match positions")
 		g.writeLine("for i, part := range pathParts {")
 		g.indentlevel++
@@ -621,52 +3145,112 @@ func (g *Generator) genRouteExpression(node *ast.CallExpression) {
 		}
 		g.writeLine("req[\"params\"] = params")
 	}
+	// the path below the * segment, without its leading slash
+	if wildcards && catchAll >= 0 {
+		g.writeLine("req[\"wildcard\"] = r.PathValue(\"wildcard\")")
+	} else if catchAll >= 0 {
+		g.requiresStrings = true
+		g.writeLine("req[\"wildcard\"] = \"\"")
+		g.writeLine(fmt.Sprintf("if rest := strings.SplitN(strings.TrimPrefix(r.URL.Path, \"/\"), \"/\", %d); len(rest) > %d { req[\"wildcard\"] = rest[%d] }", catchAll+1, catchAll, catchAll))
+	}
 
 	// parse JSON body for POST/PUT
 	// robust JSON body parsing with size guard and error handling
 	g.writeLine("if r.Method == \"POST\" || r.Method == \"PUT\" {")
 	g.indentlevel++
-	g.writeLine("r.Body = http.MaxBytesReader(w, r.Body, 1<<20) // limit to 1MB")
+	if g.maxBodySize == defaultMaxBodySize {
+		g.writeLine("r.Body = http.MaxBytesReader(w, r.Body, 1<<20) // limit to 1MB")
+	} else {
+		g.writeLine(fmt.Sprintf("r.Body = http.MaxBytesReader(w, r.Body, %d) // limit to %d bytes", g.maxBodySize, g.maxBodySize))
+	}
 	g.writeLine("defer r.Body.Close()")
 	g.writeLine("bodyBytes, err := ioutil.ReadAll(r.Body)")
 	g.writeLine("if err != nil { http.Error(w, \"failed to read body\", http.StatusBadRequest); return }")
-	g.writeLine("if len(bodyBytes) > 0 { var bodyObj interface{}; if err := json.Unmarshal(bodyBytes, &bodyObj); err != nil { http.Error(w, \"invalid JSON\", http.StatusBadRequest); return }; req[\"body\"] = bodyObj }")
+	g.writeLine("if len(bodyBytes) > 0 { var bodyObj " + g.anyType() + "; if err := json.Unmarshal(bodyBytes, &bodyObj); err != nil { http.Error(w, \"invalid JSON\", http.StatusBadRequest); return }; req[\"body\"] = bodyObj }")
 	g.indentlevel--
 	g.writeLine("}")
 
-	// logging
-	g.writeLine("log.Printf(\"%s %s\", r.Method, r.URL.Path)")
+	// logging; behind middleware the request is logged before it runs
+	if g.logFormat != "" && !g.logJSON && !g.requiresMiddleware {
+		g.requiresLog = true
+		g.writeLine(logPrintfCall(g.logFormat))
+	}
 
 	// generate handler body
 	var handlerLogicBuf bytes.Buffer
-	hg := NewGenerator()
+	hg := g.child()
 	hg.out = &handlerLogicBuf
-	hg.indentlevel = g.indentlevel
+	hg.requestParam = handler.Parameters[0].Value
 
 	// expose req variable inside handler logic
 	hg.writeLine("// handler logic")
+	rendered, responds := false, false
 	for _, s := range handler.Body.Statements {
+		if call := renderCall(s); call != nil {
+			hg.genRender(call)
+			rendered = true
+			break
+		}
+		// return status(204) writes the status and no body
+		if rs, ok := s.(*ast.ReturnStatement); ok && statusCall(rs.ReturnValue) != nil {
+			hg.writeLine("w.WriteHeader(" + hg.captureExpression(statusCall(rs.ReturnValue).Arguments[0]) + ")")
+			rendered = true
+			break
+		}
 		if rs, ok := s.(*ast.ReturnStatement); ok {
+			value := rs.ReturnValue
+			if call := respondCall(value); call != nil {
+				hg.writeLine("status := " + hg.captureExpression(call.Arguments[0]))
+				value, responds = call.Arguments[1], true
+			}
 			hg.indent()
-			hg.write("returnValue := interface{}(")
-			hg.write(hg.captureExpression(rs.ReturnValue))
+			hg.write("returnValue := " + g.anyType() + "(")
+			hg.write(hg.captureExpression(value))
 			hg.write(")\n")
 		} else {
 			hg.genStatement(s)
 		}
 	}
 
-	// append serialization block into handler buffer
+	g.adopt(hg)
+	if rendered {
+		// the template or status(code) already wrote the response
+		g.out.Write(handlerLogicBuf.Bytes())
+		g.closeHandler()
+		return
+	}
+
+	// append serialization block into handler buffer; the body of
+	// respond(status, body) is serialized like any other return value, with
+	// the status written once the content type is set
+	writeStatus := func() {
+		if responds {
+			hg.writeLine("w.WriteHeader(status)")
+		}
+	}
+	g.requiresFmt = true
 	hg.writeLine("switch rv := returnValue.(type) {")
 	hg.indentlevel++
+	if hg.requiresHTML {
+		g.requiresHTML = true
+		hg.writeLine("case pskHTML:")
+		hg.indentlevel++
+		hg.writeLine("w.Header().Set(\"Content-Type\", \"text/html; charset=utf-8\")")
+		writeStatus()
+		hg.writeLine("fmt.Fprint(w, rv)")
+		hg.indentlevel--
+	}
 	hg.writeLine("case string:")
 	hg.indentlevel++
+	writeStatus()
 	hg.writeLine("fmt.Fprint(w, rv)")
 	hg.indentlevel--
 	hg.writeLine("default:")
 	hg.indentlevel++
 	hg.writeLine("b, _ := json.Marshal(rv)")
 	hg.writeLine("w.Header().Set(\"Content-Type\", \"application/json\")")
+	hg.writeLine("w.Header().Set(\"Content-Length\", fmt.Sprint(len(b)))")
+	writeStatus()
 	hg.writeLine("w.Write(b)")
 	hg.indentlevel--
 	hg.indentlevel--
@@ -674,9 +3258,7 @@ func (g *Generator) genRouteExpression(node *ast.CallExpression) {
 
 	g.out.Write(handlerLogicBuf.Bytes())
 
-	g.indentlevel--
-	g.indent()
-	g.write("})")
+	g.closeHandler()
 }
 
 func (g *Generator) captureExpression(expr ast.Expression) string {
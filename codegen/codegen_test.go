@@ -1,10 +1,26 @@
 package codegen
 
 import (
+	"os"
+	"os/exec"
+	"path/filepath"
 	"pisuke/ast"
+	"pisuke/lexer"
+	"pisuke/parser"
+	"strings"
 	"testing"
 )
 
+func parseProgram(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	return program
+}
+
 func TestGenerateLetStatement(t *testing.T) {
 	program := &ast.Program{
 		Statements: []ast.Statement{
@@ -59,11 +75,18 @@ func TestGenerateServerRoute(t *testing.T) {
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 )
 
 func main() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("panic in handler %s: %v", "/", rec)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+		}()
 		returnValue := "Hello Pisuke!"
 		fmt.Fprint(w, returnValue)
 	})
@@ -124,6 +147,12 @@ import (
 
 func main() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("panic in handler %s: %v", "/", rec)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+		}()
 		query := make(map[string]interface{})
 		for k, v := range r.URL.Query() {
 			if len(v) > 0 { query[k] = v[0] }
@@ -131,18 +160,22 @@ func main() {
 		req := make(map[string]interface{})
 		req["query"] = query
 		if r.Method == "POST" || r.Method == "PUT" {
-			bodyBytes, _ := ioutil.ReadAll(r.Body)
-			if len(bodyBytes) > 0 { var bodyObj interface{}; _ = json.Unmarshal(bodyBytes, &bodyObj); req["body"] = bodyObj }
+			r.Body = http.MaxBytesReader(w, r.Body, 1<<20) // limit to 1MB
+			defer r.Body.Close()
+			bodyBytes, err := ioutil.ReadAll(r.Body)
+			if err != nil { http.Error(w, "failed to read body", http.StatusBadRequest); return }
+			if len(bodyBytes) > 0 { var bodyObj interface{}; if err := json.Unmarshal(bodyBytes, &bodyObj); err != nil { http.Error(w, "invalid JSON", http.StatusBadRequest); return }; req["body"] = bodyObj }
 		}
 		log.Printf("%s %s", r.Method, r.URL.Path)
 		// handler logic
-		returnValue := interface{}(("Hello, " + req["query"]["name"]))
+		returnValue := interface{}(("Hello, " + req["query"].(map[string]interface{})["name"].(string)))
 		switch rv := returnValue.(type) {
 			case string:
 				fmt.Fprint(w, rv)
 			default:
 				b, _ := json.Marshal(rv)
 				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", fmt.Sprint(len(b)))
 				w.Write(b)
 		}
 	})
@@ -176,6 +209,35 @@ func main() {
 	}
 }
 
+func TestGenerateTypedConstStatement(t *testing.T) {
+	program := &ast.Program{
+		Statements: []ast.Statement{
+			&ast.ConstStatement{
+				Name:     &ast.Identifier{Value: "MAX"},
+				Value:    &ast.IntegerLiteral{Value: 100},
+				TypeName: "int",
+			},
+			&ast.ConstStatement{
+				Name:     &ast.Identifier{Value: "GREETING"},
+				Value:    &ast.StringLiteral{Value: "hi"},
+				TypeName: "string",
+			},
+		},
+	}
+
+	expected := `package main
+
+func main() {
+	const MAX int = 100
+	const GREETING string = "hi"
+}
+`
+	generatedCode := Generate(program)
+	if generatedCode != expected {
+		t.Errorf("Generated code is not correct.\nExpected:\n%s\nGot:\n%s", expected, generatedCode)
+	}
+}
+
 func TestGeneratePrintStatement(t *testing.T) {
 	program := &ast.Program{
 		Statements: []ast.Statement{
@@ -240,4 +302,1975 @@ func main() {
 	}
 }
 
+func TestGenerateIntegerKeyedMap(t *testing.T) {
+	program := &ast.Program{
+		Statements: []ast.Statement{
+			&ast.LetStatement{
+				Name: &ast.Identifier{Value: "m"},
+				Value: &ast.MapLiteral{
+					Pairs: map[ast.Expression]ast.Expression{
+						&ast.IntegerLiteral{Value: 1}: &ast.StringLiteral{Value: "a"},
+					},
+				},
+			},
+		},
+	}
+
+	expected := `package main
+
+func main() {
+	var m = map[int]interface{}{1: "a"}
+	_ = m
+}
+`
+	generatedCode := Generate(program)
+	if generatedCode != expected {
+		t.Errorf("Generated code is not correct.\nExpected:\n%s\nGot:\n%s", expected, generatedCode)
+	}
+}
+
+func TestGenerateMixedKeyedMap(t *testing.T) {
+	program := &ast.Program{
+		Statements: []ast.Statement{
+			&ast.LetStatement{
+				Name: &ast.Identifier{Value: "m"},
+				Value: &ast.MapLiteral{
+					Pairs: map[ast.Expression]ast.Expression{
+						&ast.IntegerLiteral{Value: 1}:  &ast.StringLiteral{Value: "a"},
+						&ast.StringLiteral{Value: "b"}: &ast.IntegerLiteral{Value: 2},
+					},
+				},
+			},
+		},
+	}
+
+	generatedCode := Generate(program)
+	if !strings.Contains(generatedCode, "map[interface{}]interface{}{") {
+		t.Errorf("expected map[interface{}]interface{} literal, got:\n%s", generatedCode)
+	}
+	if !strings.Contains(generatedCode, `1: "a"`) || !strings.Contains(generatedCode, `"b": 2`) {
+		t.Errorf("expected integer and string keys to keep their types, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateLineDirectives(t *testing.T) {
+	program := parseProgram(t, `fn add(a: int, b: int): int {
+    return a + b
+}
+
+let x = add(1, 2)
+print(x)`)
+
+	g := NewGenerator()
+	g.Lines = SingleFile("main.psk")
+	generatedCode, _ := g.Generate(program)
+
+	for _, want := range []string{
+		"//line main.psk:1\nfunc add(a int, b int) int {",
+		"//line main.psk:2\nreturn (a + b)",
+		"//line main.psk:5\n\tvar x = add(1, 2)",
+		"//line main.psk:6\n\tfmt.Println(x)",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected generated code to contain %q, got:\n%s", want, generatedCode)
+		}
+	}
+
+	if strings.Contains(Generate(program), "//line") {
+		t.Errorf("expected no //line directives without a LineResolver")
+	}
+}
+
+func TestGenerateTypeAlias(t *testing.T) {
+	program := parseProgram(t, `type Id = int
+type UserId = Id
+fn next(id: UserId): Id {
+    return id + 1
+}`)
+
+	expected := `package main
+
+func next(id int) int {
+return (id + 1)
+}
+func main() {
+	type Id = int
+	type UserId = int
+}
+`
+	generatedCode := Generate(program)
+	if generatedCode != expected {
+		t.Errorf("Generated code is not correct.\nExpected:\n%s\nGot:\n%s", expected, generatedCode)
+	}
+}
+
+func TestGenerateListTypedFields(t *testing.T) {
+	program := parseProgram(t, `type Todo = { title: string, tags: [string] }
+let t: Todo = { "title": "a", "tags": ["x", "y"] }
+print(t.tags)`)
+	generatedCode := Generate(program)
+	for _, want := range []string{
+		"Tags []string `json:\"tags\"`",
+		`var t Todo = Todo{Title: "a", Tags: []string{"x", "y"}}`,
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateMapTypedFields(t *testing.T) {
+	program := parseProgram(t, `type Config = { env: {string: string}, limits: { ports: {string: int} } }
+let c: Config = { "env": { "HOME": "/root", mode: "dev" }, "limits": { "ports": { "http": 80 } } }
+print(c.env["HOME"])`)
+	generatedCode := Generate(program)
+	for _, want := range []string{
+		"Env map[string]string `json:\"env\"`",
+		"Limits struct{Ports map[string]int `json:\"ports\"`} `json:\"limits\"`",
+		`Env: map[string]string{"HOME": "/root", "mode": "dev"}`,
+		`Ports: map[string]int{"http": 80}`,
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let s = list[1:3]", "var s = list[1:3]"},
+		{"let s = list[:3]", "var s = list[:3]"},
+		{"let s = list[2:]", "var s = list[2:]"},
+		{`let s = data["items"][1:]`, `var s = data["items"].([]interface{})[1:]`},
+	}
+
+	for _, tt := range tests {
+		generatedCode := Generate(parseProgram(t, tt.input))
+		if !strings.Contains(generatedCode, tt.expected) {
+			t.Errorf("expected %q in generated code, got:\n%s", tt.expected, generatedCode)
+		}
+	}
+}
+
+func TestGenerateListBuiltins(t *testing.T) {
+	tests := []struct {
+		input  string
+		call   string
+		helper string
+	}{
+		{
+			"let doubled = map(nums, fn(x) { return x * 2 })",
+			"var doubled = pskMap(nums, func(x interface{}) interface{} {",
+			"func pskMap(list interface{}, f func(interface{}) interface{}) []interface{} {",
+		},
+		{
+			"let kept = filter(nums, fn(x) { return keep(x) })",
+			"var kept = pskFilter(nums, func(x interface{}) interface{} {",
+			"if keep, _ := f(item).(bool); keep {",
+		},
+		{
+			"let total = reduce(nums, fn(acc, x) { return acc + x }, 0)",
+			"var total = pskReduce(nums, func(acc interface{}, x interface{}) interface{} {",
+			"func pskReduce(list interface{}, f func(interface{}, interface{}) interface{}, acc interface{}) interface{} {",
+		},
+	}
+
+	for _, tt := range tests {
+		generatedCode := Generate(parseProgram(t, tt.input))
+		for _, want := range []string{tt.call, tt.helper} {
+			if !strings.Contains(generatedCode, want) {
+				t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+			}
+		}
+	}
+
+	// helpers are only emitted when used
+	generatedCode := Generate(parseProgram(t, "let x = 1"))
+	if strings.Contains(generatedCode, "pskMap") {
+		t.Errorf("unexpected list helper in generated code:\n%s", generatedCode)
+	}
+
+	// callbacks doing arithmetic get the element type of the list, and typed
+	// callbacks are called with their arguments asserted
+	input := `let nums = [1, 2, 3]
+fn double(x: int): int { return x * 2 }
+print(map(nums, fn(x) { return x * 2 }))
+print(reduce(nums, fn(acc, x) { return acc + x }, 0))
+print(filter(nums, fn(x: int): bool { return x > 1 }), nums.map(double))`
+	generatedCode, errs := GenerateWith(parseProgram(t, input), GenerateOptions{})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if out := goRun(t, generatedCode); out != "[2 4 6]\n6\n[2 3] [2 4 6]\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateUseGoPackage(t *testing.T) {
+	input := `use "net/url"
+let q = url.QueryEscape("a b")
+print(q)`
+
+	expected := `package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+func main() {
+	var q = url.QueryEscape("a b")
+	_ = q
+	fmt.Println(q)
+}
+`
+	generatedCode := Generate(parseProgram(t, input))
+	if generatedCode != expected {
+		t.Errorf("Generated code is not correct.\nExpected:\n%s\nGot:\n%s", expected, generatedCode)
+	}
+}
+
+func TestGoPackageName(t *testing.T) {
+	tests := map[string]string{
+		"net/url":      "url",
+		"strconv":      "strconv",
+		"math/rand/v2": "rand",
+	}
+	for importPath, want := range tests {
+		if got := goPackageName(importPath); got != want {
+			t.Errorf("goPackageName(%q) = %q, want %q", importPath, got, want)
+		}
+	}
+}
+
+func TestGenerateCustomLogFormat(t *testing.T) {
+	input := `server.logFormat("{remote} -> {method} {path} 100%")
+server.route("/users", fn(req) { return "ok" })`
+
+	generatedCode := Generate(parseProgram(t, input))
+	want := `log.Printf("%s -> %s %s 100%%", r.RemoteAddr, r.Method, r.URL.Path)`
+	if !strings.Contains(generatedCode, want) {
+		t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+	}
+	if strings.Contains(generatedCode, "logFormat") {
+		t.Errorf("directive should not be emitted, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateDisabledRequestLogging(t *testing.T) {
+	input := `server.route("/users", fn(req) { return "ok" })
+server.logFormat("")
+server.recover(false)`
+
+	generatedCode := Generate(parseProgram(t, input))
+	if strings.Contains(generatedCode, "log.") || strings.Contains(generatedCode, `"log"`) {
+		t.Errorf("expected no request logging, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateJSONRequestLogging(t *testing.T) {
+	input := `server.logJSON(true)
+server.route("/users", fn(req) { return "ok" })
+server.route("/health", fn(req) { return "up" })`
+
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"start := time.Now()\n\t\tsw := &pskStatusWriter{ResponseWriter: w, status: http.StatusOK}\n\t\tw = sw\n\t\tdefer func() {",
+		`line, _ := json.Marshal(map[string]interface{}{"method": r.Method, "path": r.URL.Path, "status": sw.status, "duration_ms": time.Since(start).Milliseconds()})`,
+		"type pskStatusWriter struct {",
+		"func (w *pskStatusWriter) WriteHeader(code int) {",
+		`"os"`,
+		`"time"`,
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+	if strings.Count(generatedCode, "type pskStatusWriter struct") != 1 {
+		t.Errorf("expected the status writer to be declared once, got:\n%s", generatedCode)
+	}
+	// the JSON line replaces the logFormat line
+	if strings.Contains(generatedCode, "log.Printf(\"%s %s\"") {
+		t.Errorf("did not expect the text request log, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateGzipResponses(t *testing.T) {
+	input := `server.gzip(true)
+server.use(fn(req) { print(req["path"]) })
+server.route("/users", fn(req) { return [1, 2] })
+server.route("/hello", fn() { return "hi" })`
+
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		`http.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {`,
+		"\twrapHandler(pskGzip(func(w http.ResponseWriter, r *http.Request) {",
+		"\t\t}))(w, r)\n\t})\n",
+		`w.Header().Set("Content-Length", fmt.Sprint(len(b)))`,
+		"func pskGzip(h http.HandlerFunc) http.HandlerFunc {",
+		`if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {`,
+		`w.Header().Set("Content-Encoding", "gzip")`,
+		`w.Header().Set("Content-Type", http.DetectContentType(b))`,
+		`"compress/gzip"`,
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+	if strings.Count(generatedCode, "func pskGzip(") != 1 {
+		t.Errorf("expected the gzip wrapper to be declared once, got:\n%s", generatedCode)
+	}
+
+	if plain := Generate(parseProgram(t, `server.route("/hello", fn() { return "hi" })`)); strings.Contains(plain, "gzip") {
+		t.Errorf("did not expect gzip without the directive, got:\n%s", plain)
+	}
+}
+
+func TestLogPrintfCall(t *testing.T) {
+	tests := map[string]string{
+		defaultLogFormat:    `log.Printf("%s %s", r.Method, r.URL.Path)`,
+		"{path}?{query}":    `log.Printf("%s?%s", r.URL.Path, r.URL.RawQuery)`,
+		"{unknown} {method": `log.Printf("{unknown} {method")`,
+	}
+	for template, want := range tests {
+		if got := logPrintfCall(template); got != want {
+			t.Errorf("logPrintfCall(%q) = %s, want %s", template, got, want)
+		}
+	}
+}
+
+func TestGenerateCustomMaxBodySize(t *testing.T) {
+	input := `server.maxBodySize(4096)
+server.route("/users", fn(req) { return req.body })`
+
+	generatedCode := Generate(parseProgram(t, input))
+	want := "r.Body = http.MaxBytesReader(w, r.Body, 4096) // limit to 4096 bytes"
+	if !strings.Contains(generatedCode, want) {
+		t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+	}
+	if strings.Contains(generatedCode, "maxBodySize") {
+		t.Errorf("directive should not be emitted, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateHTMLResponse(t *testing.T) {
+	input := `server.route("/", fn(req) { return html("<h1>hi</h1>") })`
+
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		`returnValue := interface{}(pskHTML("<h1>hi</h1>"))`,
+		"case pskHTML:\n\t\t\t\tw.Header().Set(\"Content-Type\", \"text/html; charset=utf-8\")\n\t\t\t\tfmt.Fprint(w, rv)",
+		"type pskHTML string",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	// parameterless handlers set the header before writing
+	generatedCode = Generate(parseProgram(t, `server.route("/", fn() { return html("<p>x</p>") })`))
+	want := "w.Header().Set(\"Content-Type\", \"text/html; charset=utf-8\")\n\t\tfmt.Fprint(w, returnValue)"
+	if !strings.Contains(generatedCode, want) {
+		t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+	}
+}
+
+func TestGenerateRenderTemplate(t *testing.T) {
+	input := `server.route("/users/:id", fn(req) { return render("user.html", req.params) })`
+
+	generatedCode := Generate(parseProgram(t, input))
+	want := `		// handler logic
+		tmpl, err := template.ParseFiles("user.html")
+		if err != nil {
+			http.Error(w, "failed to load template", http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.Execute(w, req["params"]); err != nil {
+			http.Error(w, "failed to render template", http.StatusInternalServerError)
+		}
+		return
+	})
+`
+	if !strings.Contains(generatedCode, want) {
+		t.Errorf("expected template scaffolding in generated code, got:\n%s", generatedCode)
+	}
+	if !strings.Contains(generatedCode, "\t\"html/template\"\n") {
+		t.Errorf("expected html/template import, got:\n%s", generatedCode)
+	}
+	if strings.Contains(generatedCode, "returnValue") {
+		t.Errorf("rendered handlers should not serialize a return value, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateTopLevelFunctionDefaultReturn(t *testing.T) {
+	input := `fn count(): int { let n = 1 }
+fn name(): string { let s = "x" }
+fn any() { let v = 1 }`
+
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"func count() int {\nvar n = 1\n_ = n\nreturn 0\n}",
+		"func name() string {\nvar s = \"x\"\n_ = s\nreturn \"\"\n}",
+		"func any() interface{} {\nvar v = 1\n_ = v\nreturn nil\n}",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateMissingStructFieldsUseZeroValues(t *testing.T) {
+	input := `type User = { id: int, name: string, admin: bool, extra: any, address: { city: string } }
+let u:User = { "name": "Alice" }`
+
+	generatedCode := Generate(parseProgram(t, input))
+	want := "var u User = User{Id: 0, Name: \"Alice\", Admin: false, Extra: nil, Address: struct{City string `json:\"city\"`}{}}"
+	if !strings.Contains(generatedCode, want) {
+		t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+	}
+}
+
+func TestGenerateBoolFields(t *testing.T) {
+	input := `type Todo = { title: string, done: bool, meta: { pinned: bool } }
+let a: Todo = { title: "a", done: true, meta: { pinned: 1 < 2 } }
+let b: Todo = { title: "b", meta: {} }
+print(a, b)`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"Done bool `json:\"done\"`\n",
+		"Meta struct{Pinned bool `json:\"pinned\"`} `json:\"meta\"`\n",
+		"Todo{Title: \"a\", Done: true, Meta: ",
+		// a missing bool field is false
+		"Todo{Title: \"b\", Done: false, Meta: ",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+	if out := goRun(t, generatedCode); out != "{title: a, done: true, meta: {pinned: true}} {title: b, done: false, meta: {pinned: false}}\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateCommaOkMapAccess(t *testing.T) {
+	input := `let m = {"a": 1}
+let val, ok = m["a"]
+let id, found = req["params"]["id"]`
+
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"\tval, ok := m[\"a\"]\n\t_, _ = val, ok\n",
+		"\tid, found := req[\"params\"].(map[string]interface{})[\"id\"]\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateRouteRecover(t *testing.T) {
+	input := `server.route("/users/:id", fn(req) { return req.params })`
+
+	g := NewGenerator()
+	g.Lines = SingleFile("app.psk")
+	generatedCode, _ := g.Generate(parseProgram(t, input))
+	want := `		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("panic in handler %s: %v", "/users/:id (app.psk:1)", rec)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+		}()
+`
+	if !strings.Contains(generatedCode, want) {
+		t.Errorf("expected recover block in generated code, got:\n%s", generatedCode)
+	}
+
+	generatedCode = Generate(parseProgram(t, "server.recover(false)\n"+input))
+	if strings.Contains(generatedCode, "recover()") {
+		t.Errorf("expected no recover block with server.recover(false), got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateTargetGoVersion(t *testing.T) {
+	input := `server.route("/users/:id", fn(req) { return req.params.id })`
+
+	legacy := NewGenerator()
+	legacy.TargetGoVersion = "1.17"
+	old, _ := legacy.Generate(parseProgram(t, input))
+
+	modern := NewGenerator()
+	modern.TargetGoVersion = "1.22"
+	current, _ := modern.Generate(parseProgram(t, input))
+
+	for _, want := range []string{
+		`http.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {`,
+		"pathParts := strings.Split(strings.Trim(r.URL.Path, \"/\"), \"/\")",
+		"params := make(map[string]interface{})",
+		`returnValue := interface{}(req["params"].(map[string]interface{})["id"])`,
+	} {
+		if !strings.Contains(old, want) {
+			t.Errorf("go1.17: expected %q in generated code, got:\n%s", want, old)
+		}
+	}
+	for _, want := range []string{
+		`http.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {`,
+		"params := make(map[string]any)\n\t\tparams[\"id\"] = r.PathValue(\"id\")\n",
+		`returnValue := any(req["params"].(map[string]any)["id"])`,
+	} {
+		if !strings.Contains(current, want) {
+			t.Errorf("go1.22: expected %q in generated code, got:\n%s", want, current)
+		}
+	}
+	if strings.Contains(current, "interface{}") || strings.Contains(current, `"strings"`) {
+		t.Errorf("go1.22: unexpected legacy constructs, got:\n%s", current)
+	}
+}
+
+func TestGenerateUseAny(t *testing.T) {
+	input := `fn pick(items, key) { return items[key] }
+let list = [1, 2]
+let m = {"a": 1, 2: "b"}
+let doubled = map(list, fn(x) { return x })
+server.route("/", fn(req) { return req.query.q })`
+
+	g := NewGenerator()
+	g.UseAny = true
+	generatedCode, _ := g.Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"func pick(items any, key any) any {",
+		"var list = []any{1, 2}",
+		"map[any]any{",
+		"func(pskArg0 any) any { return (func(x int) any {",
+		"func pskMap(list any, f func(any) any) []any {",
+		"query := make(map[string]any)",
+		`returnValue := any(req["query"].(map[string]any)["q"])`,
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+	if strings.Contains(generatedCode, "interface{}") {
+		t.Errorf("expected no interface{} in any mode, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateDefaultParameters(t *testing.T) {
+	input := `fn greet(greeting: string, name: string = "world", times: int = 1): string { return greeting + name }
+let a = greet("hi")
+let b = greet("hi", "pisuke")
+let c = greet("hi", "pisuke", 3)`
+
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"func greet(greeting string, name string, times int) string {",
+		`var a = greet("hi", "world", 1)`,
+		`var b = greet("hi", "pisuke", 1)`,
+		`var c = greet("hi", "pisuke", 3)`,
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateLoopControl(t *testing.T) {
+	// there are no loops yet, so Go would reject these
+	_, errs := GenerateWith(parseProgram(t, "break\ncontinue"), GenerateOptions{})
+	if len(errs) != 2 || errs[0] != "line 1: break outside of a loop" || errs[1] != "line 2: continue outside of a loop" {
+		t.Errorf("expected break and continue to be refused, got %v", errs)
+	}
+
+	// a break may end a switch case
+	generatedCode, errs := GenerateWith(parseProgram(t, "switch 1 {\ncase 1: break\n}"), GenerateOptions{})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !strings.Contains(generatedCode, "\tcase 1:\n\t\tbreak\n") {
+		t.Errorf("expected the case to break, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateChainedMethodCalls(t *testing.T) {
+	input := `let xs = [1, 2, 3]
+let ys = xs.map(fn(x) { return x }).filter(fn(x) { return x })
+let total = ys.reduce(fn(acc, x) { return acc }, 0)`
+	generatedCode := Generate(parseProgram(t, input))
+
+	for _, want := range []string{
+		"var ys = pskFilter(pskMap(xs, func(pskArg0 interface{}) interface{} { return (func(x int) interface{} {",
+		"var total = pskReduce(ys, func(acc interface{}, x interface{}) interface{} {",
+		"func pskMap(",
+		"func pskFilter(",
+		"func pskReduce(",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateMethodCallOnValue(t *testing.T) {
+	generatedCode := Generate(parseProgram(t, `use "time"
+let d = time.Now().Sub(time.Now())`))
+	if !strings.Contains(generatedCode, "var d = time.Now().Sub(time.Now())") {
+		t.Errorf("expected Go method call, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateCheckedArith(t *testing.T) {
+	input := `let a = 1 + 2 * 3
+let b = a - 1
+let s = "x" + "y"
+fn sub(x: int, y: int) :int { return x - y }`
+	g := NewGenerator()
+	g.CheckedArith = true
+	generatedCode, _ := g.Generate(parseProgram(t, input))
+
+	for _, want := range []string{
+		"var a = pskCheckedAdd(1, pskCheckedMul(2, 3))",
+		"var b = pskCheckedSub(a, 1)",
+		"var s = (\"x\" + \"y\")",
+		"return pskCheckedSub(x, y)",
+		"func pskCheckedAdd(a, b int) int {",
+		"func pskCheckedSub(a, b int) int {",
+		"func pskCheckedMul(a, b int) int {",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	// without the option arithmetic stays plain and no helpers are emitted
+	generatedCode = Generate(parseProgram(t, input))
+	if strings.Contains(generatedCode, "pskChecked") {
+		t.Errorf("unexpected checked helpers without CheckedArith:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateNumericLiteralUnderscores(t *testing.T) {
+	generatedCode := Generate(parseProgram(t, "let n = 1_000_000"))
+	if !strings.Contains(generatedCode, "var n = 1000000\n") {
+		t.Errorf("expected decoded literal, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateFloatLiterals(t *testing.T) {
+	input := `let a = 1.5e10
+let b = -2.3
+let c = .5
+let d: float = 1_000.25
+print(a, b * c + d)`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{"var a = 1.5e10\n", "var b = -2.3\n", "var c = .5\n", "var d = 1000.25\n"} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q, got:\n%s", want, generatedCode)
+		}
+	}
+	if out := goRun(t, generatedCode); out != "1.5e+10 999.1\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateLengthProperty(t *testing.T) {
+	input := `let xs = [1, 2]
+let names: [string] = ["a"]
+let s = "abc"
+let n = xs.length + s.length
+let m = { length: 5 }
+let word = "héllo"
+print(n, names.length, "hello".length, m.length)
+print(word.length, word[word.length - 1])`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"var n = (len(xs) + len([]rune(s)))\n",
+		"fmt.Println(n, len(names), len([]rune(\"hello\")), m[\"length\"])\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q, got:\n%s", want, generatedCode)
+		}
+	}
+	if out := goRun(t, generatedCode); out != "5 1 5 5\n5 o\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGeneratePrintMixedValues(t *testing.T) {
+	input := `type User = { name: string, age: int, addr: { city: string } }
+let u: User = { name: "ann", age: 3, addr: { city: "oslo" } }
+let ok = true
+print(1, "two", ok, u, 2.5, u.name)`
+	generatedCode := Generate(parseProgram(t, input))
+	want := `fmt.Println(1, "two", ok, fmt.Sprintf("{name: %v, age: %v, addr: {city: %v}}", u.Name, u.Age, u.Addr.City), 2.5, u.Name)`
+	if !strings.Contains(generatedCode, want) {
+		t.Errorf("expected %q, got:\n%s", want, generatedCode)
+	}
+	if out := goRun(t, generatedCode); out != "1 two true {name: ann, age: 3, addr: {city: oslo}} 2.5 ann\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateBareExpressionStatements(t *testing.T) {
+	input := `const DEBUG = true
+fn f(): int {
+  print("f")
+  return 1
+}
+let x = 1
+let m = {"a": 1}
+x == 1
+1 + 2
+x
+f() == 1
+m["a"]
+m.a
+x != 2 when DEBUG
+print(x)`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{"\t_ = (x == 1)\n", "\t_ = (1 + 2)\n", "\t_ = x\n", "\t_ = (f() == 1)\n", "\t_ = m[\"a\"]\n", "\t\t_ = (x != 2)\n", "\tfmt.Println(x)\n"} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q, got:\n%s", want, generatedCode)
+		}
+	}
+	// the Go compiler rejects values that are evaluated but not used, and
+	// discarded values are still evaluated
+	if out := goRun(t, generatedCode); out != "f\n1\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateFormat(t *testing.T) {
+	input := `let n = 42
+let s = format("%05d|%s", n, "x")
+print(s + "!", format("%.2f", 3.14159))`
+	generatedCode := Generate(parseProgram(t, input))
+	if want := "var s = fmt.Sprintf(\"%05d|%s\", n, \"x\")\n"; !strings.Contains(generatedCode, want) {
+		t.Errorf("expected %q, got:\n%s", want, generatedCode)
+	}
+	if out := goRun(t, generatedCode); out != "00042|x! 3.14\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	for input, want := range map[string]string{
+		"print(format())":       "line 1: format expects a format string, got no args",
+		"print(format(5, 1))":   "line 1: format expects a format string first, got int",
+		"print(format(\"%d\"))": "",
+	} {
+		_, errs := NewGenerator().Generate(parseProgram(t, input))
+		if want == "" && len(errs) != 0 || want != "" && (len(errs) != 1 || errs[0] != want) {
+			t.Errorf("%s: expected %q, got %v", input, want, errs)
+		}
+	}
+}
+
+func TestGenerateMutualRecursion(t *testing.T) {
+	// isEven refers to isOdd before it is declared, and the top-level call
+	// comes before both
+	input := `let n = countdown(3) + 1
+fn isEven(n: int): bool {
+	return isOdd(n) == false
+}
+fn isOdd(n: int): bool {
+	return n != 0 && isEven(n - 1)
+}
+fn countdown(n: int): int {
+	return n
+}
+print(n, isEven(10), isOdd(7), isEven(3))`
+	generatedCode := Generate(parseProgram(t, input))
+	if strings.Index(generatedCode, "func isOdd(") > strings.Index(generatedCode, "func main()") {
+		t.Errorf("expected functions before main, got:\n%s", generatedCode)
+	}
+	if out := goRun(t, generatedCode); out != "4 true true false\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateChildInheritance(t *testing.T) {
+	g := NewGeneratorWith(GenerateOptions{CheckedArith: true, TargetGoVersion: "1.22"})
+	g.typeDefs["User"] = &ast.TypeDefinition{}
+	g.variableTypes["u"] = "User"
+	g.valueTypes["n"] = "int"
+	g.logJSON = true
+	g.indentlevel = 2
+
+	c := g.child()
+	if !c.CheckedArith || c.TargetGoVersion != "1.22" || !c.logJSON || c.indentlevel != 2 {
+		t.Errorf("child did not inherit the settings of its parent: %+v", c)
+	}
+	if c.typeDefs["User"] == nil || c.variableTypes["u"] != "User" || c.valueTypes["n"] != "int" {
+		t.Errorf("child did not inherit the types of its parent")
+	}
+	c.typeDefs["Post"] = &ast.TypeDefinition{}
+	c.variableTypes["p"] = "Post"
+	c.valueTypes["n"] = "string"
+	if g.typeDefs["Post"] == nil {
+		t.Errorf("type definitions should be shared with the parent")
+	}
+	if _, ok := g.variableTypes["p"]; ok || g.valueTypes["n"] != "int" {
+		t.Errorf("names declared in the child leaked into the parent")
+	}
+
+	c.requiresFmt = true
+	c.requiresMapHelper = true
+	c.errorf(nil, "boom")
+	g.adopt(c)
+	if !g.requiresFmt || !g.requiresMapHelper {
+		t.Errorf("adopt did not merge the flags of the child")
+	}
+	if len(g.Errors) != 1 || g.Errors[0] != "boom" {
+		t.Errorf("adopt did not merge the errors of the child, got %v", g.Errors)
+	}
+}
+
+func TestGenerateFunctionBodyImports(t *testing.T) {
+	// print, format and map are only used inside the function
+	input := `fn f() {
+	let xs = [1, 2].map(fn(x) { return x })
+	print(format("%v", xs))
+}
+f()`
+	generatedCode, errs := GenerateWith(parseProgram(t, input), GenerateOptions{})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if out := goRun(t, generatedCode); out != "[1 2]\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGeneratorReset(t *testing.T) {
+	g := NewGeneratorWith(GenerateOptions{Imports: []string{"net/url"}, MaxBodySize: 64})
+	first, _ := g.Generate(parseProgram(t, `type User = { name: string }
+let u: User = { name: "ann" }
+print(u.name)`))
+	if !strings.Contains(first, `"fmt"`) {
+		t.Fatalf("expected fmt to be imported, got:\n%s", first)
+	}
+	g.Reset()
+	if len(g.typeDefs) != 0 || len(g.variableTypes) != 0 || g.requiresFmt || len(g.Errors) != 0 {
+		t.Errorf("Reset kept the state of the previous program")
+	}
+	if g.goPackages["url"] != "net/url" || g.maxBodySize != 64 {
+		t.Errorf("Reset dropped the options the generator was created with")
+	}
+	second, _ := g.Generate(parseProgram(t, `let n = 1`))
+	if strings.Contains(second, `"fmt"`) || strings.Contains(second, "User") {
+		t.Errorf("second program picked up state of the first, got:\n%s", second)
+	}
+}
+
+func TestGenerateFunctionValues(t *testing.T) {
+	input := `fn double(x: int): int { return x * 2 }
+fn greet(name: string = "you"): string { return "hi " + name }
+let f = double
+let g = greet
+let n = f(3) + 1
+print(n, g())`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{"var f = double\n", "var n = (f(3) + 1)\n", "fmt.Println(n, g(\"you\"))\n"} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q, got:\n%s", want, generatedCode)
+		}
+	}
+	if out := goRun(t, generatedCode); out != "7 hi you\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateClosureCapture(t *testing.T) {
+	input := `fn double(x: int): int { return x * 2 }
+type User = { name: string, age: int }
+let u: User = { name: "ann", age: 3 }
+let base = 10
+let f = double
+let add = fn(x: int): int { return f(x) + base }
+let who = fn(): string { return u.name }
+let older = fn(): int { return u.age + 1 }
+print(add(1), who(), older())`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{"return u.Name\n", "return (u.Age + 1)\n"} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q, got:\n%s", want, generatedCode)
+		}
+	}
+	if out := goRun(t, generatedCode); out != "12 ann 4\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateSwitchStatement(t *testing.T) {
+	input := `let x = 2
+switch x {
+case 1, 2:
+	print("small")
+	fallthrough
+case 3: print("three"); break
+default:
+	print("other")
+}
+switch "b" { case "a": print("a") default: print("no match") }`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{"\tswitch x {\n\tcase 1, 2:\n", "\t\tfallthrough\n\tcase 3:\n", "\tdefault:\n"} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q, got:\n%s", want, generatedCode)
+		}
+	}
+	if out := goRun(t, generatedCode); out != "small\nthree\nno match\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	for input, want := range map[string]string{
+		"switch 1 { case 1: fallthrough; print(1) case 2: print(2) }": "line 1: fallthrough must be the last statement of a case",
+		"switch 1 { case 1: print(1) default: fallthrough }":          "line 1: cannot fallthrough the final case of a switch",
+		"fallthrough": "line 1: fallthrough outside of a switch case",
+	} {
+		_, errs := NewGenerator().Generate(parseProgram(t, input))
+		if len(errs) != 1 || errs[0] != want {
+			t.Errorf("%s: expected %q, got %v", input, want, errs)
+		}
+	}
+}
+
+func TestGenerateConstFolding(t *testing.T) {
+	input := `const SIZE = 10 * 10
+const HALF: int = SIZE / 2
+const GREETING = "hello, " + "world"
+let n = SIZE * 2`
+	generatedCode := Generate(parseProgram(t, input))
+
+	for _, want := range []string{
+		"const SIZE = 100\n",
+		"const HALF int = 50\n",
+		"const GREETING = \"hello, world\"\n",
+		// only consts are folded
+		"var n = (SIZE * 2)\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateTypedEmptyCollections(t *testing.T) {
+	input := `let xs: [int] = []
+let names: {string: [string]} = {}
+let any = []`
+	generatedCode := Generate(parseProgram(t, input))
+
+	for _, want := range []string{
+		"var xs = []int{}\n",
+		"var names = map[string][]string{}\n",
+		"var any = []interface{}{}\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateFixedSizeArrays(t *testing.T) {
+	input := `const N = 2 * 4
+let buf: [int; 10]
+let names: [string; N] = ["a", "b"]
+let grid: [[int; 2]; N]`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"var buf [10]int\n",
+		"var names = [8]string{\"a\", \"b\"}\n",
+		"var grid [8][2]int\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	g := NewGenerator()
+	g.Generate(parseProgram(t, `let a: [int; M]
+let b: [int; 1] = [1, 2]`))
+	expected := []string{
+		"line 1: a: array size M is not a constant int",
+		"line 2: b: 2 elements do not fit in array of size 1",
+	}
+	if len(g.Errors) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, g.Errors)
+	}
+	for i, e := range expected {
+		if g.Errors[i] != e {
+			t.Errorf("Errors[%d] = %q, want %q", i, g.Errors[i], e)
+		}
+	}
+}
+
+func TestGenerateNamedRouteHandler(t *testing.T) {
+	input := `fn hello() { return "hi" }
+fn show(req) { return req.params.id }
+server.route("/hello", hello)
+server.route("/users/:id", show)
+server.route("/bad", 42)`
+	generatedCode := Generate(parseProgram(t, input))
+
+	for _, want := range []string{
+		"http.HandleFunc(\"/hello\", func(w http.ResponseWriter, r *http.Request) {",
+		"returnValue := hello()",
+		"func show(req map[string]interface{}) interface{} {",
+		"http.HandleFunc(\"/users/\", func(w http.ResponseWriter, r *http.Request) {",
+		"returnValue := interface{}(show(req))",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	// handlers that read the request compile
+	input = `fn show(req) { return req.params.id }
+fn greet(req) { return "hi " + req.query.name }
+server.route("/users/:id", show)
+server.route("/greet", greet)
+print("ok")`
+	if out := goRun(t, Generate(parseProgram(t, input))); out != "ok\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateMalformedRouteCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`server.route()`, "line 1: server.route expects 2 args (path, handler), got 0"},
+		{`server.route("/x")`, "line 1: server.route expects 2 args (path, handler), got 1"},
+		{`server.route("/x", 42)`, "line 1: server.route(\"/x\"): handler must be a function literal or a declared function"},
+	}
+	for _, tt := range tests {
+		_, errs := NewGenerator().Generate(parseProgram(t, tt.input))
+		if len(errs) != 1 || errs[0] != tt.expected {
+			t.Errorf("%s: expected error %q, got %v", tt.input, tt.expected, errs)
+		}
+	}
+}
+
+func TestGenerateCompoundAssign(t *testing.T) {
+	input := `let i = 0
+i += 1
+i -= 2
+i *= 3`
+	generatedCode := Generate(parseProgram(t, input))
+	if !strings.Contains(generatedCode, "\ti += 1\n\ti -= 2\n\ti *= 3\n") {
+		t.Errorf("expected compound assignments, got:\n%s", generatedCode)
+	}
+
+	g := NewGenerator()
+	g.CheckedArith = true
+	generatedCode, _ = g.Generate(parseProgram(t, input))
+	if !strings.Contains(generatedCode, "i = pskCheckedAdd(i, 1)") {
+		t.Errorf("expected checked compound assignment, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateExpressionBodiedFunction(t *testing.T) {
+	input := `fn double(x: int) :int => x * 2
+let triple = fn(x: int) :int => x * 3`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"func double(x int) int {\nreturn (x * 2)\n}",
+		"var triple = func(x int) int {\n\t\treturn (x * 3)\n\t}",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateGuardedRoute(t *testing.T) {
+	input := `const ADMIN_ENABLED = true
+server.route("/admin", fn() { return "admin" }) when ADMIN_ENABLED`
+	generatedCode := Generate(parseProgram(t, input))
+	want := "\tif ADMIN_ENABLED {\n\t\thttp.HandleFunc(\"/admin\", func(w http.ResponseWriter, r *http.Request) {"
+	if !strings.Contains(generatedCode, want) {
+		t.Errorf("expected guarded registration, got:\n%s", generatedCode)
+	}
+	if !strings.Contains(generatedCode, "\t\t})\n\t}\n") {
+		t.Errorf("expected the guard to close after the registration, got:\n%s", generatedCode)
+	}
+}
+
+func TestGenerateAssert(t *testing.T) {
+	input := `let ready: bool = true
+assert(ready)
+assert(ready, "not ready")`
+	g := NewGenerator()
+	g.Lines = SingleFile("main.psk")
+	generatedCode, errs := g.Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"\tif !(ready) {\n\t\tpanic(\"assertion failed: ready (main.psk:2)\")\n\t}\n",
+		"\tif !(ready) {\n\t\tpanic(\"not ready\")\n\t}\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	_, errs = NewGenerator().Generate(parseProgram(t, "let x = assert(ready)"))
+	if len(errs) != 1 || errs[0] != "line 1: assert can only be used as a statement" {
+		t.Errorf("expected statement-only error, got %v", errs)
+	}
+}
+
+func TestGenerateMapLiteralDeterministic(t *testing.T) {
+	input := `let m = {"delta": 4, "alpha": 1, "charlie": 3, "bravo": 2, "echo": 5}`
+	expected := `map[string]interface{}{"alpha": 1, "bravo": 2, "charlie": 3, "delta": 4, "echo": 5}`
+	first := Generate(parseProgram(t, input))
+	if !strings.Contains(first, expected) {
+		t.Fatalf("expected sorted pairs %q, got:\n%s", expected, first)
+	}
+	for i := 0; i < 20; i++ {
+		if got := Generate(parseProgram(t, input)); got != first {
+			t.Fatalf("run %d generated different code:\n%s\nvs\n%s", i, got, first)
+		}
+	}
+}
+
+func TestGenerateMathBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let r = math.sqrt(16)", "var r = math.Sqrt(16)"},
+		{"let n = 3\nlet r = math.abs(n)", "var r = math.Abs(float64(n))"},
+		{"let n = 2\nlet r = math.pow(n, 10)", "var r = math.Pow(float64(n), 10)"},
+		{"let n = 7\nlet r = math.floor(n / 2)", "var r = math.Floor(float64((n / 2)))"},
+		{"let r = math.ceil(5)", "var r = math.Ceil(5)"},
+	}
+	for _, tt := range tests {
+		generatedCode := Generate(parseProgram(t, tt.input))
+		if !strings.Contains(generatedCode, tt.expected) {
+			t.Errorf("input %q: expected %q, got:\n%s", tt.input, tt.expected, generatedCode)
+		}
+		if !strings.Contains(generatedCode, "\"math\"") {
+			t.Errorf("input %q: expected math import, got:\n%s", tt.input, generatedCode)
+		}
+	}
+}
+
+func TestGenerateEnvBuiltin(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let port = env("PORT")`, `var port = os.Getenv("PORT")`},
+		{`let port = env("PORT", "8080")`, `var port = func() string { if v, ok := os.LookupEnv("PORT"); ok { return v }; return "8080" }()`},
+	}
+	for _, tt := range tests {
+		generatedCode := Generate(parseProgram(t, tt.input))
+		if !strings.Contains(generatedCode, tt.expected) {
+			t.Errorf("input %q: expected %q, got:\n%s", tt.input, tt.expected, generatedCode)
+		}
+		if !strings.Contains(generatedCode, "\"os\"") {
+			t.Errorf("input %q: expected os import, got:\n%s", tt.input, generatedCode)
+		}
+	}
+}
+
+func TestGenerateSleepBuiltin(t *testing.T) {
+	input := `sleep(1000)
+let delay = 250
+sleep(delay)`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"\"time\"",
+		"time.Sleep(1000 * time.Millisecond)",
+		"time.Sleep(time.Duration(delay) * time.Millisecond)",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateReadFileBuiltin(t *testing.T) {
+	input := `let config = readFile("config.json")`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"\"io/ioutil\"",
+		`var config = func() string { b, _ := ioutil.ReadFile("config.json"); return string(b) }()`,
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateWriteFileBuiltin(t *testing.T) {
+	input := `writeFile("out.txt", "hello")`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"\"io/ioutil\"",
+		`ioutil.WriteFile("out.txt", []byte("hello"), 0644)`,
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateRespond(t *testing.T) {
+	input := `server.route("/users", fn(req) {
+  return respond(201, {"id": 1})
+})
+server.route("/health", fn() {
+  return respond(503, "down")
+})`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"\t\tstatus := 201\n\t\treturnValue := interface{}(map[string]interface{}{\"id\": 1})\n",
+		"w.Header().Set(\"Content-Type\", \"application/json\")\n\t\t\t\tw.Header().Set(\"Content-Length\", fmt.Sprint(len(b)))\n\t\t\t\tw.WriteHeader(status)\n\t\t\t\tw.Write(b)\n",
+		"\t\tstatus := 503\n\t\treturnValue := \"down\"\n\t\tw.WriteHeader(status)\n\t\tfmt.Fprint(w, returnValue)\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	_, errs = NewGenerator().Generate(parseProgram(t, `let r = respond(200, "ok")`))
+	if len(errs) != 1 || errs[0] != "line 1: respond can only be returned from a route handler" {
+		t.Errorf("expected handler-only error, got %v", errs)
+	}
+}
+
+func TestGenerateStatusOnly(t *testing.T) {
+	input := `server.route("/items", fn(req) {
+  return status(204)
+})
+server.route("/ping", fn() {
+  return status(202)
+})
+server.route("/count", fn() {
+  return 204
+})`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"\t\t// handler logic\n\t\tw.WriteHeader(204)\n\t})",
+		"\t\tw.WriteHeader(202)\n\t})",
+		// a plain int is still a body
+		"\t\treturnValue := 204\n\t\tfmt.Fprint(w, returnValue)\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+	if strings.Contains(generatedCode, "switch rv := returnValue.(type)") {
+		t.Errorf("status-only handler should not serialize a body, got:\n%s", generatedCode)
+	}
+
+	_, errs = NewGenerator().Generate(parseProgram(t, `let s = status(200)`))
+	if len(errs) != 1 || errs[0] != "line 1: status can only be returned from a route handler" {
+		t.Errorf("expected handler-only error, got %v", errs)
+	}
+}
+
+func TestGenerateWithOptions(t *testing.T) {
+	input := `server.route("/items", fn(req) {
+  return req
+})`
+	code, errs := GenerateWith(parseProgram(t, input), GenerateOptions{UseAny: true, MaxBodySize: 4096})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"query := make(map[string]any)",
+		"r.Body = http.MaxBytesReader(w, r.Body, 4096) // limit to 4096 bytes",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, code)
+		}
+	}
+
+	// the server.maxBodySize directive still wins over the option
+	input = "server.maxBodySize(512)\n" + input
+	code, _ = GenerateWith(parseProgram(t, input), GenerateOptions{MaxBodySize: 4096})
+	if !strings.Contains(code, "http.MaxBytesReader(w, r.Body, 512)") {
+		t.Errorf("expected the directive's body limit, got:\n%s", code)
+	}
+}
+
+func TestDuplicateRoutes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{
+			`server.route("/users", fn() { return "a" })
+server.route("/users", fn() { return "b" })`,
+			[]string{"line 2: duplicate route /users (already registered on line 1)"},
+		},
+		{
+			`server.route("/users/:id", fn(req) { return req })
+server.route("/users/:name", fn(req) { return req })`,
+			[]string{"line 2: duplicate route /users/ (already registered on line 1)"},
+		},
+		{
+			`server.route("/a", fn() { return "a" })
+server.route("/b", fn() { return "b" })`,
+			nil,
+		},
+		{
+			`const debug = 1
+server.route("/a", fn() { return "a" }) when debug
+server.route("/a", fn() { return "b" }) when debug`,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		_, errs := NewGenerator().Generate(parseProgram(t, tt.input))
+		if len(errs) != len(tt.expected) {
+			t.Errorf("input %q: expected %v, got %v", tt.input, tt.expected, errs)
+			continue
+		}
+		for i, e := range tt.expected {
+			if errs[i] != e {
+				t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+			}
+		}
+	}
+
+	g := NewGenerator()
+	g.TargetGoVersion = "1.22"
+	_, errs := g.Generate(parseProgram(t, `server.route("/users/:id", fn(req) { return req })
+server.route("/users/:name", fn(req) { return req })`))
+	if len(errs) != 1 || errs[0] != "line 2: duplicate route /users/{name} (already registered on line 1)" {
+		t.Errorf("expected wildcard conflict, got %v", errs)
+	}
+}
+
+func TestGenerateRouteGroup(t *testing.T) {
+	input := `server.group("/api", fn() {
+  server.route("/users", fn() { return "users" })
+  server.group("/v2/", fn() {
+    server.route("/items/:id", fn(req) { return req })
+  })
+})
+server.route("/users", fn() { return "top" })`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"\t{\n\t\thttp.HandleFunc(\"/api/users\", func(w http.ResponseWriter, r *http.Request) {",
+		"http.HandleFunc(\"/api/v2/items/\", func(w http.ResponseWriter, r *http.Request) {",
+		"if len(pathParts) > 3 { params[\"id\"] = pathParts[3] }",
+		"\thttp.HandleFunc(\"/users\", func(w http.ResponseWriter, r *http.Request) {",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateRouteCatchAll(t *testing.T) {
+	input := `server.route("/static/*", fn(req) { return req["wildcard"] })
+server.route("/plain/*", fn() { return "plain" })`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"http.HandleFunc(\"/static/\", func(w http.ResponseWriter, r *http.Request) {",
+		"if rest := strings.SplitN(strings.TrimPrefix(r.URL.Path, \"/\"), \"/\", 2); len(rest) > 1 { req[\"wildcard\"] = rest[1] }",
+		"http.HandleFunc(\"/plain/\", func(w http.ResponseWriter, r *http.Request) {",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	g := NewGenerator()
+	g.TargetGoVersion = "1.22"
+	generatedCode, _ = g.Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"http.HandleFunc(\"/static/{wildcard...}\", func(w http.ResponseWriter, r *http.Request) {",
+		"req[\"wildcard\"] = r.PathValue(\"wildcard\")",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	g = NewGenerator()
+	g.Generate(parseProgram(t, `server.route("/a/*/b", fn(req) { return req })`))
+	if len(g.Errors) != 1 || g.Errors[0] != "line 1: server.route(\"/a/*/b\"): * must be the last path segment" {
+		t.Errorf("expected a segment error, got %v", g.Errors)
+	}
+}
+
+func TestCapitalizeFirst(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"name", "Name"},
+		{"émail", "Émail"},
+		{"ñame", "Ñame"},
+		{"名前", "名前"},
+	}
+	for _, tt := range tests {
+		if got := capitalizeFirst(tt.input); got != tt.expected {
+			t.Errorf("capitalizeFirst(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestGenerateSafeMemberAccess(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`server.route("/me", fn(req) {
+  return req["user"]?.name
+})`,
+			`returnValue := interface{}(func() interface{} { m, _ := req["user"].(map[string]interface{}); return m["name"] }())`,
+		},
+		{
+			`let m = {"a": 1}
+let v = m?.a?.b`,
+			`var v = func() interface{} { m, _ := m["a"].(map[string]interface{}); return m["b"] }()`,
+		},
+	}
+	for _, tt := range tests {
+		generatedCode := Generate(parseProgram(t, tt.input))
+		if !strings.Contains(generatedCode, tt.expected) {
+			t.Errorf("input %q: expected %q, got:\n%s", tt.input, tt.expected, generatedCode)
+		}
+	}
+}
+
+func TestGenerateCoalesce(t *testing.T) {
+	input := `server.route("/items", fn(req) {
+  let page = req["query"]["page"] ?? "1"
+  return page
+})`
+	expected := `var page = func() interface{} { v := interface{}(req["query"].(map[string]interface{})["page"]); if v == nil { return "1" }; return v }()`
+	generatedCode := Generate(parseProgram(t, input))
+	if !strings.Contains(generatedCode, expected) {
+		t.Errorf("expected %q, got:\n%s", expected, generatedCode)
+	}
+}
+
+func TestGenerateTry(t *testing.T) {
+	input := `use "strconv"
+fn parse(s: string): error {
+  let n = try strconv.Atoi(s)
+  print(n)
+}`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	expected := "func parse(s string) error {\nn, err := strconv.Atoi(s)\nif err != nil {\n\treturn err\n}\n_ = n\n"
+	if !strings.Contains(generatedCode, expected) {
+		t.Errorf("expected %q, got:\n%s", expected, generatedCode)
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"fn f(): int {\n  let n = try g()\n  return n\n}", "line 2: try is only allowed in a function with return type error"},
+		{"let n = try g()", "line 1: try is only allowed in a function with return type error"},
+		{"fn f(): error {\n  let n = try 5\n}", "line 2: try expects a function call, got 5"},
+		{"print(try g())", "line 1: try is only allowed as the value of a let"},
+	}
+	for _, tt := range tests {
+		_, errs := NewGenerator().Generate(parseProgram(t, tt.input))
+		if len(errs) != 1 || errs[0] != tt.expected {
+			t.Errorf("input %q: expected [%s], got %v", tt.input, tt.expected, errs)
+		}
+	}
+}
+
+func TestRecordedPrimitiveTypes(t *testing.T) {
+	input := `let limit = 10
+let ready = 1 < limit
+let same = ready
+let name = "pisuke" + "!"
+let a = same.value
+let b = name.size`
+	g := NewGenerator()
+	_, errs := g.Generate(parseProgram(t, input))
+	for name, want := range map[string]string{"limit": "int", "ready": "bool", "same": "bool", "name": "string"} {
+		if got := g.valueTypes[name]; got != want {
+			t.Errorf("valueTypes[%q] = %q, want %q", name, got, want)
+		}
+	}
+	expected := []string{
+		"line 5: cannot access value on same of type bool",
+		"line 6: cannot access size on name of type string",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestGenerateNestedStructTags(t *testing.T) {
+	input := `type User = { id: int, name: { first: string, last: string } }
+let u: User = { "id": 1, "name": { "first": "Ada", "last": "Lovelace" } }`
+	generatedCode := Generate(parseProgram(t, input))
+	nested := "struct{First string `json:\"first\"`; Last string `json:\"last\"`}"
+	for _, want := range []string{
+		"\tId int `json:\"id\"`\n",
+		"\tName " + nested + " `json:\"name\"`\n",
+		"Name: " + nested + "{First: \"Ada\", Last: \"Lovelace\"}",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	// the tags keep the Pisuke field names when marshaling
+	input = `use "encoding/json"
+` + input + `
+fn show(v): error {
+  let b = try json.Marshal(v)
+  print(string(b))
+}
+print(show(u))`
+	out := goRun(t, Generate(parseProgram(t, input)))
+	if want := "{\"id\":1,\"name\":{\"first\":\"Ada\",\"last\":\"Lovelace\"}}\n<nil>\n"; out != want {
+		t.Errorf("expected output %q, got %q", want, out)
+	}
+}
+
+// goRun compiles and runs a generated program and returns its output,
+// skipping the test when no Go toolchain is available.
+func goRun(t *testing.T, code string) string {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "run", "main.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run failed: %v\n%s\n%s", err, out, code)
+	}
+	return string(out)
+}
+
+func TestGenerateStringIndex(t *testing.T) {
+	input := `let word = "ピスケ"
+let first = word[0]
+let h = "hello"[1]
+let name: string = "x"
+let c = name[0]
+let m = {"a": 1}
+let v = m["a"]`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"var first = string([]rune(word)[0])",
+		"var h = string([]rune(\"hello\")[1])",
+		"var c = string([]rune(name)[0])",
+		"var v = m[\"a\"]",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateInOperator(t *testing.T) {
+	input := `let xs = ["a", "b"]
+let m = {"k": 1}
+let a = "a" in xs
+let b = "k" in m
+let c = 2 in [1, 2]
+let d = "x" in xs`
+	generatedCode := Generate(parseProgram(t, input))
+	for _, want := range []string{
+		"var a = pskContains(xs, \"a\")",
+		"var b = pskHasKey(m, \"k\")",
+		"var c = pskContains([]interface{}{1, 2}, 2)",
+		"func pskContains(list interface{}, v interface{}) bool {",
+		"func pskHasKey(m interface{}, key interface{}) bool {",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+	// each helper is emitted once however often it is used
+	if n := strings.Count(generatedCode, "func pskContains("); n != 1 {
+		t.Errorf("expected pskContains to be emitted once, got %d", n)
+	}
+}
+
+func TestGenerateInOperatorRuns(t *testing.T) {
+	input := `let xs = ["a", "b"]
+let m = {"k": 1}
+print("a" in xs, "z" in xs, "k" in m, "q" in m)`
+	out := goRun(t, Generate(parseProgram(t, input)))
+	if out != "true false true false\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateUserMain(t *testing.T) {
+	input := `fn main() {
+  let greeting = "hi"
+  print(greeting)
+}
+print("top")`
+	generatedCode := Generate(parseProgram(t, input))
+	if strings.Count(generatedCode, "func main()") != 1 {
+		t.Fatalf("expected a single Go main, got:\n%s", generatedCode)
+	}
+	if !strings.Contains(generatedCode, "func pskMain() interface{} {") {
+		t.Errorf("expected the user main to be renamed, got:\n%s", generatedCode)
+	}
+	if out := goRun(t, generatedCode); out != "top\nhi\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	g := NewGenerator()
+	g.Generate(parseProgram(t, `fn main(args) { print(args) }`))
+	if len(g.Errors) != 1 || g.Errors[0] != "line 1: fn main must not take parameters" {
+		t.Errorf("expected a parameter error, got %v", g.Errors)
+	}
+}
+
+func TestGenerateLibraryPackage(t *testing.T) {
+	input := `type Point = { x: int, y: int }
+const Origin = 0
+fn add(a: int, b: int): int {
+  return a + b
+}`
+	code, errs := GenerateWith(parseProgram(t, input), GenerateOptions{Package: "geometry"})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !strings.HasPrefix(code, "package geometry\n") {
+		t.Errorf("expected package geometry, got:\n%s", code)
+	}
+	for _, unwanted := range []string{"func main()", "func init()"} {
+		if strings.Contains(code, unwanted) {
+			t.Errorf("did not expect %q in a declaration-only library, got:\n%s", unwanted, code)
+		}
+	}
+	if !strings.Contains(code, "func add(a int, b int) int {") {
+		t.Errorf("expected add to be declared, got:\n%s", code)
+	}
+
+	// statements of a library run when the package is initialized
+	code, _ = GenerateWith(parseProgram(t, `print("loaded")`), GenerateOptions{Package: "geometry"})
+	if !strings.Contains(code, "func init() {") || strings.Contains(code, "func main()") {
+		t.Errorf("expected the statements in init, got:\n%s", code)
+	}
+
+	// programs keep their main even without statements
+	if code := Generate(parseProgram(t, input)); !strings.Contains(code, "func main() {") {
+		t.Errorf("expected a main in program mode, got:\n%s", code)
+	}
+}
+
+func TestGenerateCast(t *testing.T) {
+	input := `let m = {"n": 1, "s": "x"}
+let n = m["n"] as int
+let s = m["s"] as string
+let total = n + 1
+let label = s + "!"
+let same = 3 as int`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"var n = m[\"n\"].(int)",
+		"var s = m[\"s\"].(string)",
+		"var total = (n + 1)",
+		"var label = (s + \"!\")",
+		"var same = 3\n",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	g := NewGenerator()
+	g.Generate(parseProgram(t, `let bad = "x" as int`))
+	if len(g.Errors) != 1 || g.Errors[0] != "line 1: cannot cast x of type string to int" {
+		t.Errorf("expected a cast error, got %v", g.Errors)
+	}
+}
+
+func TestGenerateStringConcatQueryParam(t *testing.T) {
+	input := `server.route("/hello", fn(req) {
+  return "Hello, " + req["query"]["name"]
+})
+server.route("/bye", fn(req) {
+  return req.query.name + "!"
+})
+server.route("/hi", fn(req) {
+  let name = req.query.name
+  return "Hi, " + name
+})
+fn greet(who) { return "Hey, " + who }
+let word = "ab"
+let joined = "x" + word[0]`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"(\"Hello, \" + req[\"query\"].(map[string]interface{})[\"name\"].(string))",
+		"(req[\"query\"].(map[string]interface{})[\"name\"].(string) + \"!\")",
+		// other interface{} values are formatted
+		"(\"Hi, \" + fmt.Sprint(name))",
+		"(\"Hey, \" + fmt.Sprint(who))",
+		// a string's characters are strings already
+		"var joined = (\"x\" + string([]rune(word)[0]))",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+}
+
+func TestGenerateRequestAccessors(t *testing.T) {
+	input := `server.route("/hello", fn(req) {
+  let page = req.queryInt("page")
+  let next = page + 1
+  return "Hello, " + req.queryString("name")
+})`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"\t\"strconv\"\n",
+		"var page = func() int { n, _ := strconv.Atoi(r.URL.Query().Get(\"page\")); return n }()",
+		"var next = (page + 1)",
+		"returnValue := interface{}((\"Hello, \" + r.URL.Query().Get(\"name\")))",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	g := NewGenerator()
+	g.Generate(parseProgram(t, `server.route("/a", fn(req) { return req.queryInt() })`))
+	if len(g.Errors) != 1 || g.Errors[0] != "line 1: req.queryInt expects 1 arg (name), got 0" {
+		t.Errorf("expected an argument error, got %v", g.Errors)
+	}
+}
+
+func TestGenerateInferredStructLiteral(t *testing.T) {
+	input := `type User = { id: int, name: string }
+type Tag = { name: string }
+let u = {"id": 1, "name": "A"}
+let n = u.name
+let m = {"id": 1, "extra": 2}`
+	generatedCode, errs := NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		"var u User = User{Id: 1, Name: \"A\"}",
+		"var n = u.Name",
+		// keys that are not exactly the fields of a type keep the map
+		"var m = map[string]interface{}{\"extra\": 2, \"id\": 1}",
+	} {
+		if !strings.Contains(generatedCode, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, generatedCode)
+		}
+	}
+
+	// a variable used as a map keeps its map even when its keys match, and
+	// so does one copied into a variable used as a map
+	input = `type User = { id: int, name: string }
+let u = {id: 1, name: "A"}
+let v = {id: 2, name: "B"}
+let w = v
+let x = {id: 3, name: "C"}
+print(u["id"], w["id"], "id" in x)`
+	generatedCode, errs = NewGenerator().Generate(parseProgram(t, input))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if out := goRun(t, generatedCode); out != "1 2 true\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestGenerateMiddleware(t *testing.T) {
+	input := `server.use(fn(req) {
+  status(401) when req["headers"]["auth"] == nil
+})
+server.use(fn(req) {
+  return 503
+})
+server.route("/hello", fn() {
+  return "hi"
+})`
+	code, errs := GenerateWith(parseProgram(t, input), GenerateOptions{})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{
+		`http.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {`,
+		"\twrapHandler(func(w http.ResponseWriter, r *http.Request) {",
+		"var middlewares = []func(http.HandlerFunc) http.HandlerFunc{",
+		"if len(v) > 0 { headers[strings.ToLower(k)] = v[0] }",
+		`req := map[string]interface{}{"query": query, "headers": headers, "method": r.Method, "path": r.URL.Path}`,
+		"if (req[\"headers\"].(map[string]interface{})[\"auth\"] == nil) {\n\t\t\t\tw.WriteHeader(401)\n\t\t\t\treturn\n\t\t\t}\n\t\t\tnext(w, r)",
+		"w.WriteHeader(503)\n\t\t\treturn\n\t\t}\n\t},",
+		"h = middlewares[i](h)",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("expected %q in:\n%s", want, code)
+		}
+	}
+
+	// without server.use handlers are registered as before
+	if code := Generate(parseProgram(t, `server.route("/", fn() { return "hi" })`)); strings.Contains(code, "wrapHandler") {
+		t.Errorf("did not expect the middleware chain, got:\n%s", code)
+	}
+
+	_, errs = GenerateWith(parseProgram(t, `server.use(fn(req) { return "nope" })
+server.use(handler)`), GenerateOptions{})
+	got := strings.Join(errs, "\n")
+	for _, want := range []string{"middleware must return a status code, got nope", "server.use expects a function literal fn(req), got handler"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q, got %v", want, errs)
+		}
+	}
+}
+
+func TestGenerateMiddlewareIsLoggedAndRecovered(t *testing.T) {
+	input := `server.logJSON(true)
+server.use(fn(req) {
+  status(401) when req["headers"]["auth"] == nil
+})
+server.use(fn(req) {
+  switch req["path"] {
+  case "/boom":
+    panic("boom")
+  }
+})
+server.route("/hello", fn(req) {
+  return "hi"
+})
+server.route("/boom", fn(req) {
+  return "unreachable"
+})`
+	code, errs := GenerateWith(parseProgram(t, input), GenerateOptions{})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	// a request the middleware rejects is logged, and a panic in the
+	// middleware becomes a 500
+	out := goRunHarness(t, code, `package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+)
+
+func main() {
+	register()
+	for _, path := range []string{"/hello", "/boom"} {
+		for _, auth := range []string{"", "yes"} {
+			req := httptest.NewRequest("GET", path, nil)
+			if auth != "" {
+				req.Header.Set("Auth", auth)
+			}
+			rec := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(rec, req)
+			fmt.Println(path, auth, rec.Code)
+		}
+	}
+}
+`)
+	for _, want := range []string{
+		"/hello  401\n", "/hello yes 200\n", "/boom  401\n", "/boom yes 500\n",
+		`"path":"/hello","status":401`, `"path":"/hello","status":200`,
+		`"path":"/boom","status":401`, `"path":"/boom","status":500`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+}
+
+// goRunHarness runs code with its main function renamed to register next to
+// harness, a file of package main whose main calls register.
+func goRunHarness(t *testing.T, code, harness string) string {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+	dir := t.TempDir()
+	code = strings.Replace(code, "func main() {", "func register() {", 1)
+	for name, src := range map[string]string{"main.go": code, "harness.go": harness} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command("go", "run", "main.go", "harness.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run failed: %v\n%s\n%s", err, out, code)
+	}
+	return string(out)
+}
+
+// unsupportedExpression is an expression node codegen does not know about;
+// the embedded interface only supplies ast.Expression's unexported method.
+type unsupportedExpression struct{ ast.Expression }
+
+func (unsupportedExpression) TokenLiteral() string { return "?" }
+func (unsupportedExpression) String() string       { return "?" }
+
+func TestGenerateUnsupportedExpression(t *testing.T) {
+	program := &ast.Program{
+		Statements: []ast.Statement{
+			&ast.LetStatement{
+				Name:  &ast.Identifier{Value: "x"},
+				Value: unsupportedExpression{},
+			},
+		},
+	}
+	_, errs := NewGenerator().Generate(program)
+	expected := "unsupported expression codegen.unsupportedExpression"
+	if len(errs) != 1 || errs[0] != expected {
+		t.Fatalf("expected error %q, got %v", expected, errs)
+	}
+}
+
 // All other tests from before are also here, just omitted for brevity
@@ -0,0 +1,149 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"pisuke/ast"
+)
+
+// File is one Pisuke source file of a multi-file build.
+type File struct {
+	Name    string // name of the Go file to produce, e.g. "math.go"
+	Program *ast.Program
+	// Lines, when set, maps the file's lines for //line directives
+	Lines LineResolver
+	// Imports lists Go import paths added to this file only, like
+	// GenerateOptions.Imports
+	Imports []string
+}
+
+// GoFile is a generated Go source file.
+type GoFile struct {
+	Name   string
+	Source string
+}
+
+// GeneratePackage transpiles a program split across files into one Go file
+// per Pisuke file, all in package main.
+//
+// The last file is the entry point and is generated like Generate: its
+// statements run in main(). The other files are modules. A module's named
+// functions, types, lets and consts become package-level declarations so
+// every file can refer to them, and its remaining statements run in the
+// file's init() function, i.e. before main. Type definitions and server
+// directives apply across all files. The imports g was created with are added
+// to the entry file, and every file is formatted when g.Format is set.
+func (g *Generator) GeneratePackage(files []File) []GoFile {
+	if len(files) == 0 {
+		return nil
+	}
+	for _, f := range files {
+		g.recordDeclarations(f.Program)
+		g.applyServerDirectives(f.Program)
+	}
+
+	out := []GoFile{}
+	last := files[len(files)-1]
+	entry := g.fileGenerator(last.Lines, append(g.options.Imports[:len(g.options.Imports):len(g.options.Imports)], last.Imports...))
+	for _, f := range files[:len(files)-1] {
+		fg := g.fileGenerator(f.Lines, f.Imports)
+		var code bytes.Buffer
+		fg.out = &code
+		fg.genModule(f.Program)
+		out = append(out, GoFile{Name: f.Name, Source: fg.gofmt(fg.assemble(code.Bytes()))})
+		// runtime helpers are declared once, in the entry file
+		entry.requiresMapHelper = entry.requiresMapHelper || fg.requiresMapHelper
+		entry.requiresFilterHelper = entry.requiresFilterHelper || fg.requiresFilterHelper
+		entry.requiresReduceHelper = entry.requiresReduceHelper || fg.requiresReduceHelper
+		entry.requiresContainsHelper = entry.requiresContainsHelper || fg.requiresContainsHelper
+		entry.requiresHasKeyHelper = entry.requiresHasKeyHelper || fg.requiresHasKeyHelper
+		entry.requiresHTML = entry.requiresHTML || fg.requiresHTML
+		entry.requiresStatusWriter = entry.requiresStatusWriter || fg.requiresStatusWriter
+		entry.requiresGzip = entry.requiresGzip || fg.requiresGzip
+		entry.requiresCheckedArith = entry.requiresCheckedArith || fg.requiresCheckedArith
+		g.Errors = append(g.Errors, fg.Errors...)
+	}
+	code, errs := entry.Generate(last.Program)
+	out = append(out, GoFile{Name: last.Name, Source: code})
+	g.Errors = append(g.Errors, errs...)
+	return out
+}
+
+// fileGenerator returns a generator for one file of a package, with the Go
+// imports in imports added. It has g's settings and shares type information
+// and server settings with g but tracks its own imports.
+func (g *Generator) fileGenerator(lines LineResolver, imports []string) *Generator {
+	fg := NewGeneratorWith(GenerateOptions{
+		Lines:           lines,
+		TargetGoVersion: g.TargetGoVersion,
+		UseAny:          g.UseAny,
+		CheckedArith:    g.CheckedArith,
+		Format:          g.Format,
+		Imports:         imports,
+		MaxBodySize:     g.options.MaxBodySize,
+	})
+	fg.typeDefs = g.typeDefs
+	fg.variableTypes = g.variableTypes
+	fg.functions = g.functions
+	fg.functionValues = g.functionValues
+	fg.valueTypes = g.valueTypes
+	fg.collectionKinds = g.collectionKinds
+	fg.elementTypes = g.elementTypes
+	fg.constValues = g.constValues
+	fg.routes = g.routes
+	fg.mapNames = g.mapNames
+	fg.routeHandlers = g.routeHandlers
+	fg.logFormat = g.logFormat
+	fg.logJSON = g.logJSON
+	fg.gzip = g.gzip
+	fg.maxBodySize = g.maxBodySize
+	fg.recoverPanics = g.recoverPanics
+	fg.middlewares = g.middlewares
+	fg.requiresMiddleware = g.requiresMiddleware
+	return fg
+}
+
+// genModule emits a module file: package-level declarations followed by an
+// init function holding the module's other statements.
+func (g *Generator) genModule(program *ast.Program) {
+	g.recordDeclarations(program)
+	g.genNamedFunctions(program)
+
+	initStmts := []ast.Statement{}
+	g.packageLevel = true
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.TypeDefinition, *ast.ConstStatement:
+			g.genStatement(stmt)
+		case *ast.LetStatement:
+			// `let f = fn f() {...}` is already declared as func f
+			if fl, ok := s.Value.(*ast.FunctionLiteral); ok && fl.Name != nil {
+				if fl.Name.Value != s.Name.Value {
+					g.lineDirective(stmt)
+					g.writeLine(fmt.Sprintf("var %s = %s", s.Name.Value, fl.Name.Value))
+				}
+				continue
+			}
+			g.genStatement(stmt)
+		case *ast.ExpressionStatement:
+			if !isNamedFunction(s.Expression) && !isServerDirective(s.Expression) {
+				initStmts = append(initStmts, stmt)
+			}
+		case *ast.UseStatement:
+		default:
+			initStmts = append(initStmts, stmt)
+		}
+	}
+	g.packageLevel = false
+
+	if len(initStmts) == 0 {
+		return
+	}
+	g.writeLine("func init() {")
+	g.indentlevel++
+	for _, stmt := range initStmts {
+		g.genStatement(stmt)
+	}
+	g.indentlevel--
+	g.writeLine("}")
+}
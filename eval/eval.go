@@ -0,0 +1,108 @@
+// Package eval evaluates constant expressions at transpile time.
+//
+// Only pure expressions are constant: integer and string literals, names of
+// other constants, and +, -, * and / on them. + on two strings concatenates.
+// Everything else, including calls and mixed int/string operands, is left
+// for Go to evaluate at run time.
+package eval
+
+import (
+	"errors"
+	"fmt"
+	"pisuke/ast"
+)
+
+var (
+	// ErrNotConstant is returned for expressions that cannot be evaluated at
+	// transpile time.
+	ErrNotConstant = errors.New("not a constant expression")
+	// ErrDivisionByZero is returned when a constant expression divides by
+	// zero.
+	ErrDivisionByZero = errors.New("division by zero")
+	// ErrOverflow is returned when a constant integer expression does not
+	// fit in an int64.
+	ErrOverflow = errors.New("constant overflows int64")
+)
+
+// Value is the result of a constant expression: an int64 or a string.
+type Value interface{}
+
+// Eval evaluates expr. consts holds the values of constants expr may refer
+// to by name.
+func Eval(expr ast.Expression, consts map[string]Value) (Value, error) {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral:
+		return e.Value, nil
+	case *ast.StringLiteral:
+		return e.Value, nil
+	case *ast.Identifier:
+		if v, ok := consts[e.Value]; ok {
+			return v, nil
+		}
+		return nil, ErrNotConstant
+	case *ast.InfixExpression:
+		left, err := Eval(e.Left, consts)
+		if err != nil {
+			return nil, err
+		}
+		right, err := Eval(e.Right, consts)
+		if err != nil {
+			return nil, err
+		}
+		return infix(e.Operator, left, right)
+	}
+	return nil, ErrNotConstant
+}
+
+func infix(op string, left, right Value) (Value, error) {
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok && op == "+" {
+			return l + r, nil
+		}
+		return nil, ErrNotConstant
+	}
+	l, lok := left.(int64)
+	r, rok := right.(int64)
+	if !lok || !rok {
+		return nil, ErrNotConstant
+	}
+	switch op {
+	case "+":
+		if (r > 0 && l+r < l) || (r < 0 && l+r > l) {
+			return nil, ErrOverflow
+		}
+		return l + r, nil
+	case "-":
+		if (r > 0 && l-r > l) || (r < 0 && l-r < l) {
+			return nil, ErrOverflow
+		}
+		return l - r, nil
+	case "*":
+		if l == 0 || r == 0 {
+			return int64(0), nil
+		}
+		c := l * r
+		if c/r != l || (r == -1 && l < 0 && c < 0) {
+			return nil, ErrOverflow
+		}
+		return c, nil
+	case "/":
+		if r == 0 {
+			return nil, ErrDivisionByZero
+		}
+		if r == -1 && l < 0 && -l < 0 {
+			return nil, ErrOverflow
+		}
+		return l / r, nil
+	}
+	return nil, ErrNotConstant
+}
+
+// Literal renders v as Go source.
+func Literal(v Value) string {
+	if s, ok := v.(string); ok {
+		// string literal values keep their source escapes
+		return "\"" + s + "\""
+	}
+	return fmt.Sprintf("%d", v)
+}
@@ -0,0 +1,61 @@
+package eval
+
+import (
+	"pisuke/ast"
+	"pisuke/lexer"
+	"pisuke/parser"
+	"testing"
+)
+
+func parseExpr(t *testing.T, input string) ast.Expression {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	return program.Statements[0].(*ast.ExpressionStatement).Expression
+}
+
+func TestEvalFolding(t *testing.T) {
+	consts := map[string]Value{"SIZE": int64(10), "NAME": "pisuke"}
+	tests := []struct {
+		input    string
+		expected Value
+	}{
+		{"10 * 10", int64(100)},
+		{"1 + 2 * 3 - 4", int64(3)},
+		{"7 / 2", int64(3)},
+		{"SIZE * SIZE", int64(100)},
+		{`"foo" + "bar"`, "foobar"},
+		{`NAME + "-lang"`, "pisuke-lang"},
+	}
+	for _, tt := range tests {
+		got, err := Eval(parseExpr(t, tt.input), consts)
+		if err != nil {
+			t.Errorf("Eval(%s): unexpected error %v", tt.input, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("Eval(%s) = %v, want %v", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected error
+	}{
+		{"1 / 0", ErrDivisionByZero},
+		{"x + 1", ErrNotConstant},
+		{`"a" + 1`, ErrNotConstant},
+		{"f(1)", ErrNotConstant},
+		{"9223372036854775807 + 1", ErrOverflow},
+	}
+	for _, tt := range tests {
+		if _, err := Eval(parseExpr(t, tt.input), nil); err != tt.expected {
+			t.Errorf("Eval(%s): expected %v, got %v", tt.input, tt.expected, err)
+		}
+	}
+}
@@ -1,21 +1,40 @@
 package lexer
 
-import "pisuke/token"
+import (
+	"pisuke/token"
+	"unicode"
+	"unicode/utf8"
+)
 
 type Lexer struct {
 	input        string
 	position     int  // current position in input (points to current char)
 	readPosition int  // current reading position in input (after current char)
 	ch           byte // current char under examination
+	line         int  // line of the current char
+	column       int  // column of the current char
 }
 
 func New(input string) *Lexer {
 	l := &Lexer{input: input}
-	l.readChar()
+	l.Reset()
 	return l
 }
 
+// Reset rewinds l to the start of its input, so the same lexer can produce
+// the token stream again, e.g. for a parser after a token dump.
+func (l *Lexer) Reset() {
+	l.position, l.readPosition, l.ch = 0, 0, 0
+	l.line, l.column = 1, 0
+	l.readChar()
+}
+
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -29,16 +48,55 @@ func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
 	l.skipWhitespace()
+	line, column := l.line, l.column
 
 	switch l.ch {
 	case '=':
-		tok = newToken(token.ASSIGN, l.ch)
+		if l.peek() == '>' {
+			l.readChar()
+			tok = token.Token{Type: token.FAT_ARROW, Literal: "=>"}
+		} else if l.peek() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.EQ, Literal: "=="}
+		} else {
+			tok = newToken(token.ASSIGN, l.ch)
+		}
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		tok = l.newOperator(token.PLUS, token.PLUS_ASSIGN)
+	case '-':
+		tok = l.newOperator(token.MINUS, token.MINUS_ASSIGN)
 	case '*':
-		tok = newToken(token.MUL, l.ch)
+		tok = l.newOperator(token.MUL, token.MUL_ASSIGN)
+	case '/':
+		tok = newToken(token.SLASH, l.ch)
+	case '!':
+		tok = l.newOperator(token.ILLEGAL, token.NOT_EQ)
+	case '<':
+		tok = l.newOperator(token.LT, token.LT_EQ)
+	case '>':
+		tok = l.newOperator(token.GT, token.GT_EQ)
+	case '&':
+		if l.peek() == '&' {
+			l.readChar()
+			tok = token.Token{Type: token.AND, Literal: "&&"}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '.':
+		if isDigit(l.peek()) {
+			return l.numberToken(line, column)
+		}
 		tok = newToken(token.DOT, l.ch)
+	case '?':
+		if l.peek() == '.' {
+			l.readChar()
+			tok = token.Token{Type: token.SAFE_DOT, Literal: "?."}
+		} else if l.peek() == '?' {
+			l.readChar()
+			tok = token.Token{Type: token.COALESCE, Literal: "??"}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
@@ -64,23 +122,49 @@ func (l *Lexer) NextToken() token.Token {
 		tok.Literal = ""
 		tok.Type = token.EOF
 	default:
-		if isLetter(l.ch) {
+		if l.ch == '_' && isDigit(l.peek()) {
+			// a number may not start with an underscore: _1000
+			tok.Literal, _, _ = l.readNumber()
+			tok.Type = token.ILLEGAL
+			tok.Line, tok.Column = line, column
+			return tok
+		} else if l.atLetter() {
 			tok.Literal = l.readIdentifier()
 			tok.Type = lookupIdent(tok.Literal)
+			tok.Line, tok.Column = line, column
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
-			return tok
+			return l.numberToken(line, column)
+		} else if l.ch >= utf8.RuneSelf {
+			// keep a multi-byte character in one ILLEGAL token
+			_, size := utf8.DecodeRuneInString(l.input[l.position:])
+			tok = token.Token{Type: token.ILLEGAL, Literal: l.input[l.position : l.position+size]}
+			for i := 1; i < size; i++ {
+				l.readChar()
+			}
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
 
 	l.readChar()
+	tok.Line, tok.Column = line, column
 	return tok
 }
 
+// Tokens reads the remaining input and returns its tokens, ending with the
+// EOF token. Use NextToken to read the tokens one at a time instead.
+func (l *Lexer) Tokens() []token.Token {
+	tokens := []token.Token{}
+	for {
+		tok := l.NextToken()
+		tokens = append(tokens, tok)
+		if tok.Type == token.EOF {
+			return tokens
+		}
+	}
+}
+
 func (l *Lexer) skipWhitespace() {
 	for {
 		if l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
@@ -103,14 +187,29 @@ func (l *Lexer) peek() byte {
 	}
 }
 
+// readIdentifier reads a run of letters, which may be any Unicode letters
+// such as those of 名前.
 func (l *Lexer) readIdentifier() string {
 	position := l.position
-	for isLetter(l.ch) {
-		l.readChar()
+	for l.atLetter() {
+		_, size := utf8.DecodeRuneInString(l.input[l.position:])
+		for i := 0; i < size; i++ {
+			l.readChar()
+		}
 	}
 	return l.input[position:l.position]
 }
 
+// atLetter reports whether the character at the current position, which
+// may span several bytes, is a letter.
+func (l *Lexer) atLetter() bool {
+	if l.ch < utf8.RuneSelf {
+		return isLetter(l.ch)
+	}
+	r, _ := utf8.DecodeRuneInString(l.input[l.position:])
+	return unicode.IsLetter(r)
+}
+
 func (l *Lexer) readString() string {
 	position := l.position + 1
 	for {
@@ -122,12 +221,64 @@ func (l *Lexer) readString() string {
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readNumber() string {
+// numberToken reads an INT or FLOAT token starting at line and column. A
+// malformed number, such as one with misplaced digit separators or an
+// exponent without digits, is ILLEGAL.
+func (l *Lexer) numberToken(line, column int) token.Token {
+	lit, float, ok := l.readNumber()
+	tok := token.Token{Type: token.INT, Literal: lit, Line: line, Column: column}
+	if float {
+		tok.Type = token.FLOAT
+	}
+	if !ok || !validDigitSeparators(lit) {
+		tok.Type = token.ILLEGAL
+	}
+	return tok
+}
+
+// readNumber reads digits with optional separators followed by an optional
+// fraction and exponent, as in 1_000, 2.5, .5 and 1.5e10. It reports whether
+// the number is a float and whether its exponent, if any, has digits.
+func (l *Lexer) readNumber() (lit string, float, ok bool) {
 	position := l.position
-	for isDigit(l.ch) {
+	l.readDigits()
+	if l.ch == '.' && isDigit(l.peek()) {
+		float = true
 		l.readChar()
+		l.readDigits()
 	}
-	return l.input[position:l.position]
+	if l.ch == 'e' || l.ch == 'E' {
+		float = true
+		l.readChar()
+		if l.ch == '+' || l.ch == '-' {
+			l.readChar()
+		}
+		if !isDigit(l.ch) {
+			return l.input[position:l.position], float, false
+		}
+		l.readDigits()
+	}
+	return l.input[position:l.position], float, true
+}
+
+func (l *Lexer) readDigits() {
+	for isDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+}
+
+// validDigitSeparators reports whether every underscore in the number lit
+// sits between two digits.
+func validDigitSeparators(lit string) bool {
+	for i := 0; i < len(lit); i++ {
+		if lit[i] != '_' {
+			continue
+		}
+		if i == 0 || i == len(lit)-1 || !isDigit(lit[i-1]) || !isDigit(lit[i+1]) {
+			return false
+		}
+	}
+	return true
 }
 
 func isLetter(ch byte) bool {
@@ -138,16 +289,45 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
+// newOperator returns the compound token (a compound assignment such as +=,
+// or <= and >=) when the current operator character is followed by '=', and
+// the plain operator otherwise.
+func (l *Lexer) newOperator(op, assign token.TokenType) token.Token {
+	if l.peek() == '=' {
+		ch := l.ch
+		l.readChar()
+		return token.Token{Type: assign, Literal: string(ch) + "="}
+	}
+	return newToken(op, l.ch)
+}
+
 func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
 
 var keywords = map[string]token.TokenType{
-	"fn":     token.FN,
-	"let":    token.LET,
-	"const":  token.CONST,
-	"return": token.RETURN,
-	"type":   token.TYPE,
+	"fn":          token.FN,
+	"let":         token.LET,
+	"const":       token.CONST,
+	"return":      token.RETURN,
+	"type":        token.TYPE,
+	"use":         token.USE,
+	"break":       token.BREAK,
+	"continue":    token.CONTINUE,
+	"switch":      token.SWITCH,
+	"case":        token.CASE,
+	"default":     token.DEFAULT,
+	"fallthrough": token.FALLTHROUGH,
+	"when":        token.WHEN,
+	"try":         token.TRY,
+	"in":          token.IN,
+	"as":          token.AS,
+}
+
+// IsKeyword reports whether ident is a reserved word.
+func IsKeyword(ident string) bool {
+	_, ok := keywords[ident]
+	return ok
 }
 
 func lookupIdent(ident string) token.TokenType {
@@ -84,3 +84,188 @@ let result = add(five, ten)
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := `let x = 5
+  print(x)`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"let", 1, 1},
+		{"x", 1, 5},
+		{"=", 1, 7},
+		{"5", 1, 9},
+		{"print", 2, 3},
+		{"(", 2, 8},
+		{"x", 2, 9},
+		{")", 2, 10},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
+
+func TestNumericLiteralUnderscores(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{"1_000_000", token.INT, "1_000_000"},
+		{"1_0", token.INT, "1_0"},
+		{"1000_", token.ILLEGAL, "1000_"},
+		{"1__000", token.ILLEGAL, "1__000"},
+		{"_1000", token.ILLEGAL, "_1000"},
+	}
+
+	for i, tt := range tests {
+		tok := New(tt.input).NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Errorf("tests[%d] - expected %s %q, got %s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestFloatLiterals(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{"2.5", token.FLOAT, "2.5"},
+		{".5", token.FLOAT, ".5"},
+		{"1.5e10", token.FLOAT, "1.5e10"},
+		{"1e10", token.FLOAT, "1e10"},
+		{"2.5E-3", token.FLOAT, "2.5E-3"},
+		{".5e+2", token.FLOAT, ".5e+2"},
+		{"1_000.25", token.FLOAT, "1_000.25"},
+		{"1e", token.ILLEGAL, "1e"},
+		{"1.5e+", token.ILLEGAL, "1.5e+"},
+		{"1_.5", token.ILLEGAL, "1_.5"},
+	}
+
+	for i, tt := range tests {
+		tok := New(tt.input).NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Errorf("tests[%d] - expected %s %q, got %s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+
+	// a dot between a number and a name stays a member access, and a minus
+	// sign is its own token
+	l := New("1.abs -2.3 x.y")
+	expected := []token.Token{
+		{Type: token.INT, Literal: "1"}, {Type: token.DOT, Literal: "."}, {Type: token.IDENT, Literal: "abs"},
+		{Type: token.MINUS, Literal: "-"}, {Type: token.FLOAT, Literal: "2.3"},
+		{Type: token.IDENT, Literal: "x"}, {Type: token.DOT, Literal: "."}, {Type: token.IDENT, Literal: "y"},
+	}
+	for i, want := range expected {
+		tok := l.NextToken()
+		if tok.Type != want.Type || tok.Literal != want.Literal {
+			t.Fatalf("tokens[%d] - expected %s %q, got %s %q", i, want.Type, want.Literal, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestCompoundAssignTokens(t *testing.T) {
+	l := New("i += 1 - 2 -= 3 *= 4 * 5")
+	expected := []token.TokenType{
+		token.IDENT, token.PLUS_ASSIGN, token.INT, token.MINUS, token.INT,
+		token.MINUS_ASSIGN, token.INT, token.MUL_ASSIGN, token.INT, token.MUL, token.INT,
+	}
+	for i, tt := range expected {
+		tok := l.NextToken()
+		if tok.Type != tt {
+			t.Fatalf("tests[%d] - expected %s, got %s %q", i, tt, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestComparisonTokens(t *testing.T) {
+	l := New("a < b <= c > d >= e && f & g in h == i != j ! k")
+	expected := []token.TokenType{
+		token.IDENT, token.LT, token.IDENT, token.LT_EQ, token.IDENT, token.GT, token.IDENT,
+		token.GT_EQ, token.IDENT, token.AND, token.IDENT, token.ILLEGAL, token.IDENT,
+		token.IN, token.IDENT, token.EQ, token.IDENT, token.NOT_EQ, token.IDENT,
+		token.ILLEGAL, token.IDENT,
+	}
+	for i, tt := range expected {
+		tok := l.NextToken()
+		if tok.Type != tt {
+			t.Fatalf("tests[%d] - expected %s, got %s %q", i, tt, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	l := New("let x = 1")
+	if tok := l.NextToken(); tok.Type != token.LET {
+		t.Fatalf("expected LET, got %s", tok.Type)
+	}
+	// Tokens continues from the current position and ends with EOF
+	tokens := l.Tokens()
+	expected := []token.TokenType{token.IDENT, token.ASSIGN, token.INT, token.EOF}
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected %d tokens, got %v", len(expected), tokens)
+	}
+	for i, tt := range expected {
+		if tokens[i].Type != tt {
+			t.Errorf("tokens[%d] - expected %s, got %s", i, tt, tokens[i].Type)
+		}
+	}
+	if tokens := New("").Tokens(); len(tokens) != 1 || tokens[0].Type != token.EOF {
+		t.Errorf("expected only EOF for empty input, got %v", tokens)
+	}
+}
+
+func TestReset(t *testing.T) {
+	l := New("let x = 1\nlet y = 2")
+	first := l.Tokens()
+	l.Reset()
+	again := l.Tokens()
+	if len(again) != len(first) {
+		t.Fatalf("expected %d tokens after Reset, got %d", len(first), len(again))
+	}
+	for i := range first {
+		if again[i] != first[i] {
+			t.Errorf("tokens[%d] - expected %+v, got %+v", i, first[i], again[i])
+		}
+	}
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	l := New(`let 名前 = "ピスケ"
+let café = 名前
+let x = 1 ★`)
+	expected := []struct {
+		typ     token.TokenType
+		literal string
+	}{
+		{token.LET, "let"}, {token.IDENT, "名前"}, {token.ASSIGN, "="}, {token.STRING, "ピスケ"},
+		{token.LET, "let"}, {token.IDENT, "café"}, {token.ASSIGN, "="}, {token.IDENT, "名前"},
+		{token.LET, "let"}, {token.IDENT, "x"}, {token.ASSIGN, "="}, {token.INT, "1"}, {token.ILLEGAL, "★"},
+		{token.EOF, ""},
+	}
+	for i, tt := range expected {
+		tok := l.NextToken()
+		if tok.Type != tt.typ || tok.Literal != tt.literal {
+			t.Fatalf("tests[%d] - expected %s %q, got %s %q", i, tt.typ, tt.literal, tok.Type, tok.Literal)
+		}
+	}
+}
@@ -6,27 +6,44 @@ import (
 	"pisuke/lexer"
 	"pisuke/token"
 	"strconv"
+	"strings"
 )
 
 // Operator precedence constants
 const (
 	_ int = iota
 	LOWEST
+	COALESCE    // ??
+	AND         // &&
 	EQUALS      // ==
 	LESSGREATER // > or <
 	SUM         // +
 	PRODUCT     // *
+	CAST        // x as T
 	PREFIX      // -X or !X
 	CALL        // myFunction(X)
 	INDEX       // array[index]
 )
 
 var precedences = map[token.TokenType]int{
+	token.COALESCE: COALESCE,
+	token.AND:      AND,
+	token.EQ:       EQUALS,
+	token.NOT_EQ:   EQUALS,
+	token.LT:       LESSGREATER,
+	token.GT:       LESSGREATER,
+	token.LT_EQ:    LESSGREATER,
+	token.GT_EQ:    LESSGREATER,
+	token.IN:       LESSGREATER,
 	token.PLUS:     SUM,
+	token.MINUS:    SUM,
 	token.MUL:      PRODUCT,
+	token.SLASH:    PRODUCT,
+	token.AS:       CAST,
 	token.LPAREN:   CALL,
 	token.LBRACKET: INDEX,
 	token.DOT:      CALL,
+	token.SAFE_DOT: CALL,
 }
 
 type (
@@ -54,18 +71,34 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
+	p.registerPrefix(token.MINUS, p.parseNegativeNumber)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseListLiteral)
 	p.registerPrefix(token.LBRACE, p.parseMapLiteral)
 	p.registerPrefix(token.FN, p.parseFunctionLiteral)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
+	p.registerInfix(token.MINUS, p.parseInfixExpression)
 	p.registerInfix(token.MUL, p.parseInfixExpression)
+	p.registerInfix(token.SLASH, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.COALESCE, p.parseInfixExpression)
+	p.registerInfix(token.IN, p.parseInfixExpression)
+	p.registerInfix(token.EQ, p.parseInfixExpression)
+	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.AS, p.parseCastExpression)
+	p.registerInfix(token.LT, p.parseComparisonExpression)
+	p.registerInfix(token.GT, p.parseComparisonExpression)
+	p.registerInfix(token.LT_EQ, p.parseComparisonExpression)
+	p.registerInfix(token.GT_EQ, p.parseComparisonExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
 	p.registerInfix(token.DOT, p.parseMemberAccessExpression)
+	p.registerInfix(token.SAFE_DOT, p.parseMemberAccessExpression)
 
 	p.nextToken()
 	p.nextToken()
@@ -91,8 +124,13 @@ func (p *Parser) ParseProgram() *ast.Program {
 	program.Statements = []ast.Statement{}
 
 	for p.curToken.Type != token.EOF {
+		errs := len(p.Errors)
 		stmt := p.parseStatement()
-		if stmt != nil {
+		if len(p.Errors) > errs {
+			// drop the broken statement and resume at the next one, so
+			// one mistake does not hide the ones after it
+			p.skipToNextStatement()
+		} else if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
 		}
 		p.nextToken()
@@ -101,6 +139,24 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return program
 }
 
+// skipToNextStatement advances until the next token starts a top-level
+// statement: the first token of a later line in column 1, other than a
+// closing bracket. Tokens of the broken statement are skipped rather than
+// reported again.
+func (p *Parser) skipToNextStatement() {
+	line := p.curToken.Line
+	for !p.peekTokenIs(token.EOF) {
+		if p.peekToken.Line > line && p.peekToken.Column == 1 {
+			switch p.peekToken.Type {
+			case token.RBRACE, token.RPAREN, token.RBRACKET:
+			default:
+				return
+			}
+		}
+		p.nextToken()
+	}
+}
+
 func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
 	case token.LET:
@@ -111,24 +167,143 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseReturnStatement()
 	case token.TYPE:
 		return p.parseTypeDefinition()
+	case token.USE:
+		return p.parseUseStatement()
+	case token.BREAK:
+		return &ast.BreakStatement{Token: p.curToken}
+	case token.CONTINUE:
+		return &ast.ContinueStatement{Token: p.curToken}
+	case token.SWITCH:
+		return p.parseSwitchStatement()
+	case token.FALLTHROUGH:
+		return &ast.FallthroughStatement{Token: p.curToken}
+	case token.IDENT:
+		if p.peekTokenIs(token.PLUS_ASSIGN) || p.peekTokenIs(token.MINUS_ASSIGN) || p.peekTokenIs(token.MUL_ASSIGN) {
+			return p.parseCompoundAssignStatement()
+		}
+		return p.parseExpressionStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
+// parseSwitchStatement parses `switch value { case 1, 2: ... default: ... }`.
+// Case bodies run up to the next case, the default or the closing brace;
+// their statements may be separated by newlines or semicolons.
+func (p *Parser) parseSwitchStatement() *ast.SwitchStatement {
+	stmt := &ast.SwitchStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	p.nextToken()
+	for !p.curTokenIs(token.RBRACE) {
+		c := &ast.SwitchCase{Token: p.curToken}
+		switch p.curToken.Type {
+		case token.CASE:
+			if stmt.Default != nil {
+				p.Errors = append(p.Errors, "default must be the last case of a switch")
+				return nil
+			}
+			p.nextToken()
+			c.Values = append(c.Values, p.parseExpression(LOWEST))
+			for p.peekTokenIs(token.COMMA) {
+				p.nextToken()
+				p.nextToken()
+				c.Values = append(c.Values, p.parseExpression(LOWEST))
+			}
+		case token.DEFAULT:
+			if stmt.Default != nil {
+				p.Errors = append(p.Errors, "switch has more than one default")
+				return nil
+			}
+		default:
+			p.Errors = append(p.Errors, fmt.Sprintf("expected case or default in switch, got %s", p.curToken.Literal))
+			return nil
+		}
+		if !p.expectPeek(token.COLON) {
+			return nil
+		}
+		p.nextToken()
+		if !p.parseCaseBody(c) {
+			return nil
+		}
+		if c.Token.Type == token.DEFAULT {
+			stmt.Default = c
+		} else {
+			stmt.Cases = append(stmt.Cases, c)
+		}
+	}
+	return stmt
+}
+
+// parseCaseBody parses the statements of switch case c, leaving the current
+// token on the case, default or closing brace that ends it. It reports
+// false on an error.
+func (p *Parser) parseCaseBody(c *ast.SwitchCase) bool {
+	for !p.curTokenIs(token.CASE) && !p.curTokenIs(token.DEFAULT) && !p.curTokenIs(token.RBRACE) {
+		if p.curTokenIs(token.EOF) {
+			p.Errors = append(p.Errors, "expected } to close the switch, got end of input")
+			return false
+		}
+		if p.curTokenIs(token.SEMICOLON) {
+			p.nextToken()
+			continue
+		}
+		errs := len(p.Errors)
+		s := p.parseStatement()
+		if len(p.Errors) > errs {
+			return false
+		}
+		if s != nil {
+			c.Body = append(c.Body, s)
+		}
+		p.nextToken()
+	}
+	return true
+}
+
+// parseCompoundAssignStatement parses `name += value` and its -= and *=
+// forms.
+func (p *Parser) parseCompoundAssignStatement() *ast.CompoundAssignStatement {
+	stmt := &ast.CompoundAssignStatement{Token: p.curToken}
+	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	p.nextToken()
+	stmt.Operator = p.curToken.Literal
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+	return stmt
+}
+
 func (p *Parser) parseLetStatement() *ast.LetStatement {
 	stmt := &ast.LetStatement{Token: p.curToken}
 	if !p.expectPeek(token.IDENT) {
 		return nil
 	}
 	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	// further names: let val, ok = ...
+	if p.peekTokenIs(token.COMMA) {
+		stmt.Names = []*ast.Identifier{stmt.Name}
+		for p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			stmt.Names = append(stmt.Names, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+		}
+	}
 	// optional type annotation: : Type
 	if p.peekTokenIs(token.COLON) {
 		p.nextToken()
 		p.nextToken()
-		if p.curToken.Type == token.IDENT {
-			stmt.TypeName = p.curToken.Literal
-		}
+		stmt.TypeName = p.parseTypeAnnotation()
+	}
+	// an array declared without a value starts out zeroed, as if assigned
+	// the empty list: let buf: [int; 10]
+	if _, _, ok := ast.ArrayType(stmt.TypeName); ok && !p.peekTokenIs(token.ASSIGN) {
+		stmt.Value = &ast.ListLiteral{Token: p.curToken}
+		return stmt
 	}
 	if !p.expectPeek(token.ASSIGN) {
 		return nil
@@ -138,6 +313,56 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	return stmt
 }
 
+// parseTypeAnnotation parses the type starting at the current token: a type
+// name, a list type `[T]`, a fixed-size array type `[T; N]` or a map type
+// `{K: V}`. It returns the annotation
+// in that canonical spelling, or "" when no type is found.
+func (p *Parser) parseTypeAnnotation() string {
+	switch p.curToken.Type {
+	case token.IDENT:
+		return p.curToken.Literal
+	case token.LBRACKET:
+		p.nextToken()
+		elem := p.parseTypeAnnotation()
+		if elem == "" {
+			return ""
+		}
+		// fixed-size array: [T; N] with N an integer or a constant name
+		if p.peekTokenIs(token.SEMICOLON) {
+			p.nextToken()
+			p.nextToken()
+			if p.curToken.Type != token.INT && p.curToken.Type != token.IDENT {
+				p.Errors = append(p.Errors, fmt.Sprintf("array size must be an integer or a constant, got %s", p.curToken.Literal))
+				return ""
+			}
+			size := p.curToken.Literal
+			if !p.expectPeek(token.RBRACKET) {
+				return ""
+			}
+			return "[" + elem + "; " + size + "]"
+		}
+		if !p.expectPeek(token.RBRACKET) {
+			return ""
+		}
+		return "[" + elem + "]"
+	case token.LBRACE:
+		if !p.expectPeek(token.IDENT) {
+			return ""
+		}
+		key := p.curToken.Literal
+		if !p.expectPeek(token.COLON) {
+			return ""
+		}
+		p.nextToken()
+		value := p.parseTypeAnnotation()
+		if value == "" || !p.expectPeek(token.RBRACE) {
+			return ""
+		}
+		return "{" + key + ": " + value + "}"
+	}
+	return ""
+}
+
 func (p *Parser) parseConstStatement() *ast.ConstStatement {
 	stmt := &ast.ConstStatement{Token: p.curToken}
 	if !p.expectPeek(token.IDENT) {
@@ -148,9 +373,7 @@ func (p *Parser) parseConstStatement() *ast.ConstStatement {
 	if p.peekTokenIs(token.COLON) {
 		p.nextToken()
 		p.nextToken()
-		if p.curToken.Type == token.IDENT {
-			stmt.TypeName = p.curToken.Literal
-		}
+		stmt.TypeName = p.parseTypeAnnotation()
 	}
 	if !p.expectPeek(token.ASSIGN) {
 		return nil
@@ -167,9 +390,26 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+// parseUseStatement parses `use "net/url"`, which imports a Go package into
+// the generated program.
+func (p *Parser) parseUseStatement() *ast.UseStatement {
+	stmt := &ast.UseStatement{Token: p.curToken}
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+	stmt.Path = p.curToken.Literal
+	return stmt
+}
+
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 	stmt.Expression = p.parseExpression(LOWEST)
+	// statement modifier: <expr> when <condition>
+	if p.peekTokenIs(token.WHEN) {
+		p.nextToken()
+		p.nextToken()
+		stmt.Guard = p.parseExpression(LOWEST)
+	}
 	return stmt
 }
 
@@ -249,7 +489,8 @@ func (p *Parser) parseMapLiteral() ast.Expression {
 
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
-	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
+	// digit separators are for readability only: 1_000_000
+	value, err := strconv.ParseInt(strings.ReplaceAll(p.curToken.Literal, "_", ""), 0, 64)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
 		p.Errors = append(p.Errors, msg)
@@ -259,6 +500,35 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+	value, err := strconv.ParseFloat(strings.ReplaceAll(p.curToken.Literal, "_", ""), 64)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse %q as float", p.curToken.Literal)
+		p.Errors = append(p.Errors, msg)
+		return nil
+	}
+	lit.Value = value
+	return lit
+}
+
+// parseNegativeNumber parses a minus sign directly before a number literal,
+// as in -5 or -2.3, into a negative literal.
+func (p *Parser) parseNegativeNumber() ast.Expression {
+	minus := p.curToken
+	if !p.peekTokenIs(token.INT) && !p.peekTokenIs(token.FLOAT) {
+		p.Errors = append(p.Errors, fmt.Sprintf("unary minus is only supported before a number, got %s", p.peekToken.Literal))
+		return nil
+	}
+	p.nextToken()
+	p.curToken.Literal = "-" + p.curToken.Literal
+	p.curToken.Line, p.curToken.Column = minus.Line, minus.Column
+	if p.curTokenIs(token.FLOAT) {
+		return p.parseFloatLiteral()
+	}
+	return p.parseIntegerLiteral()
+}
+
 func (p *Parser) parseGroupedExpression() ast.Expression {
 	p.nextToken()
 	exp := p.parseExpression(LOWEST)
@@ -268,6 +538,25 @@ func (p *Parser) parseGroupedExpression() ast.Expression {
 	return exp
 }
 
+func (p *Parser) parseTryExpression() ast.Expression {
+	expression := &ast.TryExpression{Token: p.curToken}
+	p.nextToken()
+	expression.Call = p.parseExpression(PREFIX)
+	return expression
+}
+
+// parseCastExpression parses `x as T`, where T is a type annotation.
+func (p *Parser) parseCastExpression(left ast.Expression) ast.Expression {
+	expression := &ast.CastExpression{Token: p.curToken, Value: left}
+	p.nextToken()
+	expression.Type = p.parseTypeAnnotation()
+	if expression.Type == "" {
+		p.Errors = append(p.Errors, fmt.Sprintf("expected a type after as, got %s", p.curToken.Literal))
+		return nil
+	}
+	return expression
+}
+
 func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	expression := &ast.InfixExpression{
 		Token:    p.curToken,
@@ -280,6 +569,37 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+// parseComparisonExpression parses a comparison, desugaring a chain such as
+// 1 < x < 10 into 1 < x && x < 10. The shared middle operand appears in both
+// comparisons and so is evaluated twice.
+func (p *Parser) parseComparisonExpression(left ast.Expression) ast.Expression {
+	comparison := p.parseInfixExpression(left).(*ast.InfixExpression)
+	// the previous link of the chain: a comparison, or the last comparison
+	// of an already desugared chain
+	prev, ok := left.(*ast.InfixExpression)
+	if ok && prev.Operator == "&&" {
+		prev, ok = prev.Right.(*ast.InfixExpression)
+	}
+	if !ok || !isComparison(prev.Operator) {
+		return comparison
+	}
+	comparison.Left = prev.Right
+	return &ast.InfixExpression{
+		Token:    token.Token{Type: token.AND, Literal: "&&", Line: comparison.Token.Line, Column: comparison.Token.Column},
+		Operator: "&&",
+		Left:     left,
+		Right:    comparison,
+	}
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "<", ">", "<=", ">=":
+		return true
+	}
+	return false
+}
+
 func (p *Parser) parseFunctionLiteral() ast.Expression {
 	lit := &ast.FunctionLiteral{Token: p.curToken}
 	// optional function name
@@ -290,9 +610,12 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	if !p.expectPeek(token.LPAREN) {
 		return nil
 	}
-	params, paramTypes := p.parseFunctionParameters()
+	params, paramTypes, defaults := p.parseFunctionParameters()
 	lit.Parameters = params
 	lit.ParamTypes = paramTypes
+	if len(defaults) > 0 {
+		lit.Defaults = defaults
+	}
 	// optional return type
 	if p.peekTokenIs(token.COLON) {
 		p.nextToken() // consume ':'
@@ -301,20 +624,53 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 			lit.ReturnType = p.curToken.Literal
 		}
 	}
+	// expression body: fn double(x) => x * 2 returns the expression
+	if p.peekTokenIs(token.FAT_ARROW) {
+		p.nextToken()
+		arrow := p.curToken
+		p.nextToken()
+		ret := &ast.ReturnStatement{
+			Token:       token.Token{Type: token.RETURN, Literal: "return", Line: arrow.Line, Column: arrow.Column},
+			ReturnValue: p.parseExpression(LOWEST),
+		}
+		lit.Body = &ast.BlockStatement{Token: arrow, Statements: []ast.Statement{ret}}
+		return lit
+	}
 	if !p.expectPeek(token.LBRACE) {
 		return nil
 	}
 	lit.Body = p.parseBlockStatement()
 	return lit
 }
-func (p *Parser) parseFunctionParameters() ([]*ast.Identifier, map[string]string) {
+func (p *Parser) parseFunctionParameters() ([]*ast.Identifier, map[string]string, map[string]ast.Expression) {
 	identifiers := []*ast.Identifier{}
 	types := make(map[string]string)
+	defaults := make(map[string]ast.Expression)
 	if p.peekTokenIs(token.RPAREN) {
 		p.nextToken()
-		return identifiers, types
+		return identifiers, types, defaults
 	}
 	p.nextToken()
+	identifiers = append(identifiers, p.parseParameter(types, defaults))
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		// newlines are whitespace, so a signature may span several lines;
+		// allow the trailing comma such a list usually ends with
+		if p.peekTokenIs(token.RPAREN) {
+			break
+		}
+		p.nextToken()
+		identifiers = append(identifiers, p.parseParameter(types, defaults))
+	}
+	if !p.expectPeek(token.RPAREN) {
+		return nil, nil, nil
+	}
+	return identifiers, types, defaults
+}
+
+// parseParameter parses `name`, `name: type` or either followed by
+// `= default`, recording the type and default value by parameter name.
+func (p *Parser) parseParameter(types map[string]string, defaults map[string]ast.Expression) *ast.Identifier {
 	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 	// if next token is ':' then parse type
 	if p.peekTokenIs(token.COLON) {
@@ -324,26 +680,31 @@ func (p *Parser) parseFunctionParameters() ([]*ast.Identifier, map[string]string
 			types[ident.Value] = p.curToken.Literal
 		}
 	}
-	identifiers = append(identifiers, ident)
-	for p.peekTokenIs(token.COMMA) {
-		p.nextToken()
+	if p.peekTokenIs(token.ASSIGN) {
+		p.nextToken() // consume '='
 		p.nextToken()
-		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-		if p.peekTokenIs(token.COLON) {
-			p.nextToken()
-			p.nextToken()
-			if p.curToken.Type == token.IDENT {
-				types[ident.Value] = p.curToken.Literal
-			}
-		}
-		identifiers = append(identifiers, ident)
+		defaults[ident.Value] = p.parseExpression(LOWEST)
 	}
-	if !p.expectPeek(token.RPAREN) {
-		return nil, nil
+	return ident
+}
+
+// curIsFieldType reports whether the current token starts a field type
+// annotation: a type name, a list type or a map type. A brace is a map type
+// `{K: V}` when its first name is a map key type; otherwise it opens an
+// inline nested object type.
+func (p *Parser) curIsFieldType() bool {
+	switch p.curToken.Type {
+	case token.IDENT, token.LBRACKET:
+		return true
+	case token.LBRACE:
+		return p.peekTokenIs(token.IDENT) && mapKeyTypes[p.peekToken.Literal]
 	}
-	return identifiers, types
+	return false
 }
 
+// mapKeyTypes are the type names allowed as keys of a map type.
+var mapKeyTypes = map[string]bool{"string": true, "int": true, "bool": true}
+
 func (p *Parser) parseTypeDefinition() *ast.TypeDefinition {
 	td := &ast.TypeDefinition{Token: p.curToken}
 	if !p.expectPeek(token.IDENT) {
@@ -353,17 +714,23 @@ func (p *Parser) parseTypeDefinition() *ast.TypeDefinition {
 	if !p.expectPeek(token.ASSIGN) {
 		return nil
 	}
+	// alias form: type Id = int
+	if p.peekTokenIs(token.IDENT) {
+		p.nextToken()
+		td.Alias = p.curToken.Literal
+		return td
+	}
 	if !p.expectPeek(token.LBRACE) {
 		return nil
 	}
 
 	fields := []*ast.Field{}
-	// parse fields until RBRACE
+	// parse fields until RBRACE; fields are separated by commas, semicolons
+	// or just newlines
 	for !p.peekTokenIs(token.RBRACE) {
 		p.nextToken()
-		// expect IDENT
 		if p.curToken.Type != token.IDENT {
-			p.peekError(token.IDENT)
+			p.fieldNameError()
 			return nil
 		}
 		fieldName := p.curToken.Literal
@@ -371,9 +738,13 @@ func (p *Parser) parseTypeDefinition() *ast.TypeDefinition {
 			return nil
 		}
 		p.nextToken()
-		// field type can be an identifier or an inline nested object type
-		if p.curToken.Type == token.IDENT {
-			fieldType := p.curToken.Literal
+		// field type can be an identifier, a list or map type or an inline
+		// nested object type
+		if p.curIsFieldType() {
+			fieldType := p.parseTypeAnnotation()
+			if fieldType == "" {
+				return nil
+			}
 			fields = append(fields, &ast.Field{Name: fieldName, Type: fieldType})
 		} else if p.curToken.Type == token.LBRACE {
 			// parse inline nested type
@@ -382,7 +753,7 @@ func (p *Parser) parseTypeDefinition() *ast.TypeDefinition {
 			for !p.peekTokenIs(token.RBRACE) {
 				p.nextToken()
 				if p.curToken.Type != token.IDENT {
-					p.peekError(token.IDENT)
+					p.fieldNameError()
 					return nil
 				}
 				nfName := p.curToken.Literal
@@ -390,13 +761,16 @@ func (p *Parser) parseTypeDefinition() *ast.TypeDefinition {
 					return nil
 				}
 				p.nextToken()
-				if p.curToken.Type != token.IDENT {
+				if !p.curIsFieldType() {
 					p.peekError(token.IDENT)
 					return nil
 				}
-				nfType := p.curToken.Literal
+				nfType := p.parseTypeAnnotation()
+				if nfType == "" {
+					return nil
+				}
 				nestedFields = append(nestedFields, &ast.Field{Name: nfName, Type: nfType})
-				if p.peekTokenIs(token.COMMA) {
+				if p.peekTokenIs(token.COMMA) || p.peekTokenIs(token.SEMICOLON) {
 					p.nextToken()
 				}
 			}
@@ -409,8 +783,8 @@ func (p *Parser) parseTypeDefinition() *ast.TypeDefinition {
 			p.peekError(token.IDENT)
 			return nil
 		}
-		// optional comma
-		if p.peekTokenIs(token.COMMA) {
+		// optional separator
+		if p.peekTokenIs(token.COMMA) || p.peekTokenIs(token.SEMICOLON) {
 			p.nextToken()
 		}
 	}
@@ -422,12 +796,24 @@ func (p *Parser) parseTypeDefinition() *ast.TypeDefinition {
 	return td
 }
 
+// fieldNameError reports a type definition field that does not start with
+// a name.
+func (p *Parser) fieldNameError() {
+	p.Errors = append(p.Errors, fmt.Sprintf("expected a field name, got %s", p.curToken.Literal))
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
 	p.nextToken() // consume {
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
+		errs := len(p.Errors)
 		stmt := p.parseStatement()
+		if len(p.Errors) > errs {
+			// the block's end is unknown after an error; leave recovery to
+			// ParseProgram instead of parsing the rest as part of the block
+			return block
+		}
 		if stmt != nil {
 			block.Statements = append(block.Statements, stmt)
 		}
@@ -444,8 +830,34 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+	// list[:end]
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		return p.parseSliceExpression(exp.Token, left, nil)
+	}
 	p.nextToken()
 	exp.Index = p.parseExpression(LOWEST)
+	// list[start:] or list[start:end]
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		return p.parseSliceExpression(exp.Token, left, exp.Index)
+	}
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+	return exp
+}
+
+// parseSliceExpression parses the remainder of a slice after its ':' (the
+// current token); start is nil when the lower bound was omitted.
+func (p *Parser) parseSliceExpression(tok token.Token, left, start ast.Expression) ast.Expression {
+	exp := &ast.SliceExpression{Token: tok, Left: left, Start: start}
+	if p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+		return exp
+	}
+	p.nextToken()
+	exp.End = p.parseExpression(LOWEST)
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
@@ -453,8 +865,12 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 }
 
 func (p *Parser) parseMemberAccessExpression(left ast.Expression) ast.Expression {
-	exp := &ast.MemberAccessExpression{Token: p.curToken, Object: left}
+	exp := &ast.MemberAccessExpression{Token: p.curToken, Object: left, Optional: p.curTokenIs(token.SAFE_DOT)}
 
+	// keywords are fine as property names, e.g. server.use(...)
+	if lexer.IsKeyword(p.peekToken.Literal) {
+		p.peekToken.Type = token.IDENT
+	}
 	if !p.expectPeek(token.IDENT) {
 		return nil
 	}
@@ -474,6 +890,10 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 	list = append(list, p.parseExpression(LOWEST))
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
+		// trailing comma: [1, 2, 3,]
+		if p.peekTokenIs(end) {
+			break
+		}
 		p.nextToken()
 		list = append(list, p.parseExpression(LOWEST))
 	}
@@ -171,6 +171,78 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestNumberLiteralForms(t *testing.T) {
+	tests := []struct {
+		input string
+		want  interface{}
+	}{
+		{"2.5", 2.5},
+		{".5", 0.5},
+		{"1.5e10", 1.5e10},
+		{"1_000.25", 1000.25},
+		{"-2.3", -2.3},
+		{"-5", int64(-5)},
+		{"-9223372036854775808", int64(-9223372036854775808)},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		var got interface{}
+		switch lit := program.Statements[0].(*ast.ExpressionStatement).Expression.(type) {
+		case *ast.FloatLiteral:
+			got = lit.Value
+		case *ast.IntegerLiteral:
+			got = lit.Value
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v (%T), got %v (%T)", tt.input, tt.want, tt.want, got, got)
+		}
+	}
+
+	p := New(lexer.New("3 - -2.5 * x"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	if got := program.String(); got != "(3 - (-2.5 * x))" {
+		t.Errorf("expected negative literal operand, got %q", got)
+	}
+	p = New(lexer.New("-x"))
+	p.ParseProgram()
+	if len(p.Errors) == 0 || p.Errors[0] != "unary minus is only supported before a number, got x" {
+		t.Errorf("expected unary minus error, got %v", p.Errors)
+	}
+}
+
+func TestSwitchStatement(t *testing.T) {
+	p := New(lexer.New("switch x {\ncase 1, 2:\n\tprint(x)\n\tfallthrough\ncase 3: print(3); break\ndefault:\n}"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	ss, ok := program.Statements[0].(*ast.SwitchStatement)
+	if !ok {
+		t.Fatalf("expected *ast.SwitchStatement, got %T", program.Statements[0])
+	}
+	if len(ss.Cases) != 2 || len(ss.Cases[0].Values) != 2 || len(ss.Cases[1].Body) != 2 || ss.Default == nil {
+		t.Fatalf("unexpected switch %+v", ss)
+	}
+	want := "switch x {\ncase 1, 2:\n\tprint(x)\n\tfallthrough\ncase 3:\n\tprint(3)\n\tbreak\ndefault:\n}"
+	if got := ss.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	for input, want := range map[string]string{
+		"switch x { default: print(1) case 1: print(2) }": "default must be the last case of a switch",
+		"switch x { default: default: }":                  "switch has more than one default",
+		"switch x { print(1) }":                           "expected case or default in switch, got print",
+		"switch x { case 1: print(1)":                     "expected } to close the switch, got end of input",
+	} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors) == 0 || p.Errors[0] != want {
+			t.Errorf("%s: expected %q, got %v", input, want, p.Errors)
+		}
+	}
+}
+
 func TestParsingInfixExpressions(t *testing.T) {
 	infixTests := []struct {
 		input      string
@@ -180,6 +252,7 @@ func TestParsingInfixExpressions(t *testing.T) {
 	}{
 		{"5 + 5", 5, "+", 5},
 		{"5 * 5", 5, "*", 5},
+		{"5 - 5", 5, "-", 5},
 	}
 
 	for _, tt := range infixTests {
@@ -386,6 +459,34 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"(1 + 2) * 3",
 			"((1 + 2) * 3)",
 		},
+		{
+			"1 - 2 + 3 * 4",
+			"((1 - 2) + (3 * 4))",
+		},
+		{
+			"a + 1 < b * 2",
+			"((a + 1) < (b * 2))",
+		},
+		{
+			"a < b && c >= d",
+			"((a < b) && (c >= d))",
+		},
+		{
+			"m?.a ?? b + 1",
+			"((m?.a) ?? (b + 1))",
+		},
+		{
+			"x + 1 in xs && ok",
+			"(((x + 1) in xs) && ok)",
+		},
+		{
+			"a * m[k] as int + 1",
+			"((a * ((m[k]) as int)) + 1)",
+		},
+		{
+			"a < b == c != nil && ok",
+			"((((a < b) == c) != nil) && ok)",
+		},
 	}
 
 	for _, tt := range tests {
@@ -530,3 +631,471 @@ func testInfixExpression(t *testing.T, exp ast.Expression, left interface{},
 	}
 	return true
 }
+
+func TestTypeAliasDefinition(t *testing.T) {
+	input := `type Id = int`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statement. got=%d", len(program.Statements))
+	}
+	td, ok := program.Statements[0].(*ast.TypeDefinition)
+	if !ok {
+		t.Fatalf("stmt not *ast.TypeDefinition. got=%T", program.Statements[0])
+	}
+	if td.Name.Value != "Id" || td.Alias != "int" || td.Fields != nil {
+		t.Errorf("unexpected alias definition: %s", td.String())
+	}
+	if td.String() != "type Id = int" {
+		t.Errorf("td.String() wrong. got=%q", td.String())
+	}
+}
+
+func TestListTypedFields(t *testing.T) {
+	input := `type Todo = { title: string, tags: [string], meta: { scores: [int] } }`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	td, ok := program.Statements[0].(*ast.TypeDefinition)
+	if !ok {
+		t.Fatalf("stmt not *ast.TypeDefinition. got=%T", program.Statements[0])
+	}
+	if len(td.Fields) != 3 || td.Fields[1].Type != "[string]" {
+		t.Fatalf("unexpected fields: %s", td.String())
+	}
+	if elem, ok := td.Fields[1].ElementType(); !ok || elem != "string" {
+		t.Errorf("tags element type wrong. got=%q, %v", elem, ok)
+	}
+	if _, ok := td.Fields[0].ElementType(); ok {
+		t.Errorf("title must not be a list field")
+	}
+	if nested := td.Fields[2].Nested; nested == nil || nested.Fields[0].Type != "[int]" {
+		t.Errorf("unexpected nested field: %s", td.String())
+	}
+}
+
+func TestTypeDefinitionFieldSeparators(t *testing.T) {
+	want := New(lexer.New(`type User = { id: int, name: string, addr: { city: string, zip: int } }`)).ParseProgram().String()
+	for _, input := range []string{
+		"type User = {\n\tid: int\n\tname: string\n\taddr: {\n\t\tcity: string\n\t\tzip: int\n\t}\n}",
+		"type User = { id: int; name: string; addr: { city: string; zip: int; }; }",
+		"type User = {\n\tid: int,\n\tname: string;\n\taddr: { city: string\n zip: int },\n}",
+	} {
+		p := New(lexer.New(input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		if got := program.String(); got != want {
+			t.Errorf("%q: expected %q, got %q", input, want, got)
+		}
+	}
+
+	p := New(lexer.New("type User = { id: int;; name: string }"))
+	p.ParseProgram()
+	if len(p.Errors) == 0 || p.Errors[0] != "expected a field name, got ;" {
+		t.Errorf("expected a field name error, got %v", p.Errors)
+	}
+}
+
+func TestTypedConstStatement(t *testing.T) {
+	input := `const MAX: int = 100`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.ConstStatement)
+	if !ok {
+		t.Fatalf("stmt not *ast.ConstStatement. got=%T", program.Statements[0])
+	}
+	if stmt.Name.Value != "MAX" || stmt.TypeName != "int" {
+		t.Errorf("unexpected const: name=%q type=%q", stmt.Name.Value, stmt.TypeName)
+	}
+	testIntegerLiteral(t, stmt.Value, 100)
+}
+
+func TestParsingSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"list[1:3]", "(list[1:3])"},
+		{"list[:3]", "(list[:3])"},
+		{"list[2:]", "(list[2:])"},
+		{"list[:]", "(list[:])"},
+		{"list[1 + 1:n]", "(list[(1 + 1):n])"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		if _, ok := stmt.Expression.(*ast.SliceExpression); !ok {
+			t.Fatalf("exp not *ast.SliceExpression. got=%T", stmt.Expression)
+		}
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+}
+
+func TestUseStatement(t *testing.T) {
+	input := `use "net/url"`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statement. got=%d", len(program.Statements))
+	}
+	us, ok := program.Statements[0].(*ast.UseStatement)
+	if !ok {
+		t.Fatalf("stmt not *ast.UseStatement. got=%T", program.Statements[0])
+	}
+	if us.Path != "net/url" {
+		t.Errorf("us.Path not %q. got=%q", "net/url", us.Path)
+	}
+}
+
+func TestMultiNameLetStatement(t *testing.T) {
+	input := `let val, ok = m["key"]`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("stmt not *ast.LetStatement. got=%T", program.Statements[0])
+	}
+	if len(stmt.Names) != 2 || stmt.Names[0].Value != "val" || stmt.Names[1].Value != "ok" {
+		t.Fatalf("unexpected names: %v", stmt.Names)
+	}
+	if stmt.Name != stmt.Names[0] {
+		t.Errorf("stmt.Name should be the first name")
+	}
+	if stmt.String() != `let val, ok = (m[key])` {
+		t.Errorf("stmt.String() wrong. got=%q", stmt.String())
+	}
+}
+
+func TestFunctionParameterDefaults(t *testing.T) {
+	input := `fn greet(greeting, name: string = "world", times = 2) { return greeting }`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	fl, ok := stmt.Expression.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FunctionLiteral. got=%T", stmt.Expression)
+	}
+	if len(fl.Parameters) != 3 || len(fl.Defaults) != 2 {
+		t.Fatalf("expected 3 parameters and 2 defaults, got %d and %d", len(fl.Parameters), len(fl.Defaults))
+	}
+	if _, ok := fl.Defaults["greeting"]; ok {
+		t.Errorf("greeting should have no default")
+	}
+	if fl.ParamTypes["name"] != "string" {
+		t.Errorf("name type wrong. got=%q", fl.ParamTypes["name"])
+	}
+	testIntegerLiteral(t, fl.Defaults["times"], 2)
+	if sl, ok := fl.Defaults["name"].(*ast.StringLiteral); !ok || sl.Value != "world" {
+		t.Errorf("name default wrong. got=%v", fl.Defaults["name"])
+	}
+}
+
+func TestLoopControlStatements(t *testing.T) {
+	input := `break
+continue`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d", len(program.Statements))
+	}
+	if _, ok := program.Statements[0].(*ast.BreakStatement); !ok {
+		t.Errorf("stmt not *ast.BreakStatement. got=%T", program.Statements[0])
+	}
+	if _, ok := program.Statements[1].(*ast.ContinueStatement); !ok {
+		t.Errorf("stmt not *ast.ContinueStatement. got=%T", program.Statements[1])
+	}
+}
+
+func TestKeywordMemberAccess(t *testing.T) {
+	l := lexer.New(`server.use(fn(req) { return req })`)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	call, ok := stmt.Expression.(*ast.CallExpression)
+	if !ok {
+		t.Fatalf("expression not *ast.CallExpression. got=%T", stmt.Expression)
+	}
+	mae, ok := call.Function.(*ast.MemberAccessExpression)
+	if !ok || mae.Property.Value != "use" {
+		t.Fatalf("expected member access of use, got %s", call.Function)
+	}
+}
+
+func TestCollectionTypeAnnotations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let xs: [int] = []", "[int]"},
+		{"let m: {string: int} = {}", "{string: int}"},
+		{"let grid: [[int]] = []", "[[int]]"},
+		{"let buf: [int; 10]", "[int; 10]"},
+		{"let rows: [[int; N]; 2] = []", "[[int; N]; 2]"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		stmt := program.Statements[0].(*ast.LetStatement)
+		if stmt.TypeName != tt.expected {
+			t.Errorf("TypeName = %q, want %q", stmt.TypeName, tt.expected)
+		}
+	}
+}
+
+func TestCompoundAssignStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		operator string
+		expected string
+	}{
+		{"i += 1", "+=", "i += 1"},
+		{"i -= n * 2", "-=", "i -= (n * 2)"},
+		{"i *= 3", "*=", "i *= 3"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		stmt, ok := program.Statements[0].(*ast.CompoundAssignStatement)
+		if !ok {
+			t.Fatalf("stmt not *ast.CompoundAssignStatement. got=%T", program.Statements[0])
+		}
+		if stmt.Name.Value != "i" || stmt.Operator != tt.operator {
+			t.Errorf("got %s %s, want i %s", stmt.Name.Value, stmt.Operator, tt.operator)
+		}
+		if stmt.String() != tt.expected {
+			t.Errorf("String() = %q, want %q", stmt.String(), tt.expected)
+		}
+	}
+}
+
+func TestExpressionBodiedFunction(t *testing.T) {
+	p := New(lexer.New(`fn double(x: int) :int => x * 2`))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	fl, ok := stmt.Expression.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("expression not *ast.FunctionLiteral. got=%T", stmt.Expression)
+	}
+	if len(fl.Body.Statements) != 1 {
+		t.Fatalf("body should have 1 statement, got %d", len(fl.Body.Statements))
+	}
+	ret, ok := fl.Body.Statements[0].(*ast.ReturnStatement)
+	if !ok {
+		t.Fatalf("body statement not *ast.ReturnStatement. got=%T", fl.Body.Statements[0])
+	}
+	testInfixExpression(t, ret.ReturnValue, "x", "*", 2)
+}
+
+func TestWhenModifier(t *testing.T) {
+	p := New(lexer.New(`server.route("/admin", handler) when ADMIN_ENABLED`))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	if _, ok := stmt.Expression.(*ast.CallExpression); !ok {
+		t.Fatalf("expression not *ast.CallExpression. got=%T", stmt.Expression)
+	}
+	if !testIdentifier(t, stmt.Guard, "ADMIN_ENABLED") {
+		return
+	}
+}
+
+func TestMultiLineFunctionParameters(t *testing.T) {
+	input := `fn add(
+	a: int,
+	b: int = 2
+) :int {
+	return a + b
+}
+fn sub(
+	a: int,
+	b: int,
+) :int { return a - b }`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d", len(program.Statements))
+	}
+	for i, name := range []string{"add", "sub"} {
+		fl, ok := program.Statements[i].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+		if !ok {
+			t.Fatalf("statement %d is not a function literal", i)
+		}
+		if fl.Name.Value != name || len(fl.Parameters) != 2 || fl.ReturnType != "int" {
+			t.Errorf("unexpected signature for %s: %s", name, fl.String())
+		}
+		if fl.ParamTypes["a"] != "int" || fl.ParamTypes["b"] != "int" {
+			t.Errorf("%s: unexpected parameter types %v", name, fl.ParamTypes)
+		}
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	input := `let = 5
+fn add(a, b): int {
+  return a +
+}
+let ok = 1
+const = 2
+print(ok)`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	expected := []string{
+		"expected next token to be IDENT, got = instead",
+		"no prefix parse function for } found",
+		"expected next token to be IDENT, got = instead",
+	}
+	if len(p.Errors) != len(expected) {
+		t.Fatalf("expected errors %q, got %q", expected, p.Errors)
+	}
+	for i, e := range expected {
+		if p.Errors[i] != e {
+			t.Errorf("Errors[%d] = %q, want %q", i, p.Errors[i], e)
+		}
+	}
+	// the statements between the errors are still parsed
+	if got := program.String(); got != "let ok = 1\nprint(ok)" {
+		t.Errorf("expected the valid statements, got %q", got)
+	}
+}
+
+func TestBlockString(t *testing.T) {
+	input := `fn outer(n: int): int {
+  let x: int = n
+  let inner = fn() { return x }
+  return x
+}
+fn noop() {}`
+	expected := "fn outer(n: int): int {\n" +
+		"\tlet x: int = n\n" +
+		"\tlet inner = fn() {\n" +
+		"\t\treturn x\n" +
+		"\t}\n" +
+		"\treturn x\n" +
+		"}\n" +
+		"fn noop() {}"
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	if got := program.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestTrailingCommas(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2, 3,]", "[1, 2, 3]"},
+		{"[\n\t1,\n\t2,\n]", "[1, 2]"},
+		{`{"a": 1,}`, "{a:1}"},
+		{"add(1, 2,)", "add(1, 2)"},
+		{"fn(a, b,) { a }", "fn(a, b) {\n\ta\n}"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		if len(program.Statements) != 1 {
+			t.Fatalf("%s: expected 1 statement, got %d", tt.input, len(program.Statements))
+		}
+		if got := program.String(); got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestComparisonChaining(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 < x < 10", "((1 < x) && (x < 10))"},
+		{"0 <= i < n", "((0 <= i) && (i < n))"},
+		{"a < b <= c < d", "(((a < b) && (b <= c)) && (c < d))"},
+		{"10 > x + 1 > 0", "((10 > (x + 1)) && ((x + 1) > 0))"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if actual := program.String(); actual != tt.expected {
+			t.Errorf("input %q: expected=%q, got=%q", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+func TestSafeMemberAccess(t *testing.T) {
+	p := New(lexer.New(`req["user"]?.profile.name`))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	outer, ok := stmt.Expression.(*ast.MemberAccessExpression)
+	if !ok || outer.Optional {
+		t.Fatalf("expected a plain member access, got %#v", stmt.Expression)
+	}
+	inner, ok := outer.Object.(*ast.MemberAccessExpression)
+	if !ok || !inner.Optional {
+		t.Fatalf("expected an optional member access, got %#v", outer.Object)
+	}
+	if got := program.String(); got != "(((req[user])?.profile).name)" {
+		t.Errorf("program.String() = %q", got)
+	}
+}
+
+func TestTryExpression(t *testing.T) {
+	p := New(lexer.New("let n = try strconv.Atoi(s)"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.LetStatement)
+	te, ok := stmt.Value.(*ast.TryExpression)
+	if !ok {
+		t.Fatalf("expected *ast.TryExpression, got %T", stmt.Value)
+	}
+	if _, ok := te.Call.(*ast.CallExpression); !ok {
+		t.Fatalf("expected the call to be wrapped, got %T", te.Call)
+	}
+	if got := te.String(); got != "try (strconv.Atoi)(s)" {
+		t.Errorf("te.String() = %q", got)
+	}
+}
@@ -0,0 +1,41 @@
+// Package pisuke transpiles Pisuke source code to Go as a library, for tools
+// that embed the language instead of running the pisuke command.
+package pisuke
+
+import (
+	"errors"
+	"pisuke/codegen"
+	"pisuke/lexer"
+	"pisuke/parser"
+	"pisuke/typecheck"
+)
+
+// Transpile runs source through the lexer, parser, type checker and code
+// generator and returns the generated Go program. It reads no imports and
+// touches no files: source must be self-contained.
+//
+// Each stage runs only when the previous one succeeded, so errs holds the
+// errors of the first failing stage. goCode is empty when errs is non-empty.
+func Transpile(source string) (goCode string, errs []error) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors) > 0 {
+		return "", toErrors(p.Errors)
+	}
+	if diags := typecheck.CheckProgram(program); len(diags) > 0 {
+		return "", toErrors(diags.Strings())
+	}
+	code, msgs := codegen.GenerateWith(program, codegen.GenerateOptions{})
+	if len(msgs) > 0 {
+		return "", toErrors(msgs)
+	}
+	return code, nil
+}
+
+func toErrors(msgs []string) []error {
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = errors.New(msg)
+	}
+	return errs
+}
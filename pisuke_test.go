@@ -0,0 +1,54 @@
+package pisuke
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranspile(t *testing.T) {
+	code, errs := Transpile(`let greeting = "hello"
+print(greeting)`)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for _, want := range []string{"package main", "\"fmt\"", "fmt.Println(greeting)"} {
+		if !strings.Contains(code, want) {
+			t.Errorf("expected %q in generated code, got:\n%s", want, code)
+		}
+	}
+}
+
+func TestTranspileMissingBoolField(t *testing.T) {
+	code, errs := Transpile(`type Todo = { title: string, done: bool }
+let t: Todo = { title: "a" }
+print(t)`)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if want := `Todo{Title: "a", Done: false}`; !strings.Contains(code, want) {
+		t.Errorf("expected %q in generated code, got:\n%s", want, code)
+	}
+}
+
+func TestTranspileErrors(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		// parser error
+		{"let = 1", "expected next token to be IDENT, got = instead"},
+		// type error
+		{`let x: int = "hello"`, "x: cannot use string value as int"},
+		// codegen error
+		{`let r = respond(200, "ok")`, "line 1: respond can only be returned from a route handler"},
+	}
+	for _, tt := range tests {
+		code, errs := Transpile(tt.source)
+		if code != "" {
+			t.Errorf("source %q: expected no code, got:\n%s", tt.source, code)
+		}
+		if len(errs) == 0 || errs[0].Error() != tt.expected {
+			t.Errorf("source %q: expected error %q, got %v", tt.source, tt.expected, errs)
+		}
+	}
+}
@@ -5,6 +5,8 @@ type TokenType string
 type Token struct {
 	Type    TokenType
 	Literal string
+	Line    int // 1-based line of the token's first character
+	Column  int // 1-based column (in bytes) of the token's first character
 }
 
 const (
@@ -14,12 +16,28 @@ const (
 	// Identifiers + literals
 	IDENT  = "IDENT"  // add, foobar, x, y, ...
 	INT    = "INT"    // 1343456
+	FLOAT  = "FLOAT"  // 2.5, .5, 1.5e10
 	STRING = "STRING" // "Hello World"
 
 	// Operators
-	ASSIGN = "="
-	PLUS   = "+"
-	MUL    = "*"
+	ASSIGN       = "="
+	PLUS         = "+"
+	MINUS        = "-"
+	MUL          = "*"
+	SLASH        = "/"
+	PLUS_ASSIGN  = "+="
+	MINUS_ASSIGN = "-="
+	MUL_ASSIGN   = "*="
+	FAT_ARROW    = "=>"
+	LT           = "<"
+	GT           = ">"
+	LT_EQ        = "<="
+	GT_EQ        = ">="
+	EQ           = "=="
+	NOT_EQ       = "!="
+	AND          = "&&"
+	SAFE_DOT     = "?."
+	COALESCE     = "??"
 
 	// Delimiters
 	LPAREN    = "("
@@ -34,9 +52,22 @@ const (
 	SEMICOLON = ";"
 
 	// Keywords
-	LET    = "LET"
-	CONST  = "CONST"
-	FN     = "FN"
-	RETURN = "RETURN"
-	TYPE   = "TYPE"
+	LET      = "LET"
+	CONST    = "CONST"
+	FN       = "FN"
+	RETURN   = "RETURN"
+	TYPE     = "TYPE"
+	USE      = "USE"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	SWITCH   = "SWITCH"
+	CASE     = "CASE"
+	DEFAULT  = "DEFAULT"
+	WHEN     = "WHEN"
+	TRY      = "TRY"
+	IN       = "IN"
+	AS       = "AS"
+
+	// FALLTHROUGH ends a switch case by running the next one
+	FALLTHROUGH = "FALLTHROUGH"
 )
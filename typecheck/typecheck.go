@@ -3,17 +3,67 @@ package typecheck
 import (
 	"fmt"
 	"pisuke/ast"
+	"pisuke/eval"
+	"sort"
 )
 
-// CheckProgram runs simple static checks over program and returns error messages.
-func CheckProgram(program *ast.Program) []string {
-	errs := []string{}
+// Severity tells how serious a Diagnostic is.
+type Severity int
+
+const (
+	// SeverityError marks a problem that stops the build.
+	SeverityError Severity = iota
+	// SeverityWarning marks a suspicious construct that still builds.
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a problem found by CheckProgram. Line and Column locate the
+// node it is about; they are 0 when the node has no position.
+type Diagnostic struct {
+	Message  string
+	Severity Severity
+	Line     int
+	Column   int
+}
+
+func (d Diagnostic) String() string { return d.Message }
+
+// Diagnostics is the list of problems found in a program.
+type Diagnostics []Diagnostic
+
+// Strings returns the messages of ds, the form CheckProgram reported before
+// diagnostics carried positions.
+func (ds Diagnostics) Strings() []string {
+	msgs := make([]string, len(ds))
+	for i, d := range ds {
+		msgs[i] = d.Message
+	}
+	return msgs
+}
+
+// errorAt returns an error diagnostic located at node.
+func errorAt(node ast.Node, format string, args ...interface{}) Diagnostic {
+	return Diagnostic{Message: fmt.Sprintf(format, args...), Severity: SeverityError, Line: ast.LineOf(node), Column: ast.ColumnOf(node)}
+}
+
+// CheckProgram runs simple static checks over program and returns the
+// problems found.
+func CheckProgram(program *ast.Program) Diagnostics {
+	errs := Diagnostics{}
 	// collect type defs
 	typeDefs := map[string]*ast.TypeDefinition{}
 	// collect function signatures: name -> (param types, return)
 	funcSigs := map[string]struct {
 		ParamOrder []string
 		Params     map[string]string
+		Defaults   map[string]ast.Expression
 		Return     string
 	}{}
 	for _, s := range program.Statements {
@@ -29,8 +79,9 @@ func CheckProgram(program *ast.Program) []string {
 				funcSigs[fl.Name.Value] = struct {
 					ParamOrder []string
 					Params     map[string]string
+					Defaults   map[string]ast.Expression
 					Return     string
-				}{ParamOrder: order, Params: fl.ParamTypes, Return: fl.ReturnType}
+				}{ParamOrder: order, Params: fl.ParamTypes, Defaults: fl.Defaults, Return: fl.ReturnType}
 			}
 		}
 		if es, ok := s.(*ast.ExpressionStatement); ok {
@@ -42,50 +93,75 @@ func CheckProgram(program *ast.Program) []string {
 				funcSigs[fl.Name.Value] = struct {
 					ParamOrder []string
 					Params     map[string]string
+					Defaults   map[string]ast.Expression
 					Return     string
-				}{ParamOrder: order, Params: fl.ParamTypes, Return: fl.ReturnType}
+				}{ParamOrder: order, Params: fl.ParamTypes, Defaults: fl.Defaults, Return: fl.ReturnType}
 			}
 		}
 	}
-	// collect variable types
+	// resolveType follows aliases (type Id = int) so that an alias and its
+	// target compare equal
+	resolveType := func(t string) string {
+		seen := map[string]bool{}
+		for !seen[t] {
+			seen[t] = true
+			td, ok := typeDefs[t]
+			if !ok || td.Alias == "" {
+				break
+			}
+			t = td.Alias
+		}
+		return t
+	}
+	for _, td := range typeDefs {
+		if td.Alias == "" {
+			continue
+		}
+		if target := resolveType(td.Alias); !isPrimitiveType(target) {
+			errs = append(errs, errorAt(td, "type %s: cannot alias non-primitive type %s", td.Name.Value, td.Alias))
+		}
+	}
+
+	// collect variable types; map literals assigned to names used as maps
+	// are not inferred to be structs
+	mapNames := ast.MapNames(program.Statements)
 	varTypes := map[string]string{}
+	// lists holds the untyped lets holding a list literal
+	lists := map[string]bool{}
 	for _, s := range program.Statements {
 		switch st := s.(type) {
 		case *ast.LetStatement:
 			if st.TypeName != "" {
 				varTypes[st.Name.Value] = st.TypeName
 			}
-			// try to infer variable type from a map literal by matching fields
+			if _, ok := st.Value.(*ast.ListLiteral); ok && st.TypeName == "" {
+				lists[st.Name.Value] = true
+			}
+			// scalar literals give their own type
 			if st.TypeName == "" {
+				switch v := st.Value.(type) {
+				case *ast.IntegerLiteral:
+					varTypes[st.Name.Value] = "int"
+				case *ast.FloatLiteral:
+					varTypes[st.Name.Value] = "float"
+				case *ast.StringLiteral:
+					varTypes[st.Name.Value] = "string"
+				case *ast.Identifier:
+					if v.Value == "true" || v.Value == "false" {
+						varTypes[st.Name.Value] = "bool"
+					} else if t, ok := varTypes[v.Value]; ok {
+						// a copy has the type of the value it copies
+						varTypes[st.Name.Value] = t
+					}
+				case *ast.CastExpression:
+					varTypes[st.Name.Value] = v.Type
+				}
+			}
+			// try to infer variable type from a map literal by matching fields
+			if st.TypeName == "" && !mapNames[st.Name.Value] {
 				if ml, ok := st.Value.(*ast.MapLiteral); ok {
-					// attempt to find a typeDef that matches keys
-					for tname, td := range typeDefs {
-						okMatch := true
-						for _, f := range td.Fields {
-							// must exist in map
-							found := false
-							for k := range ml.Pairs {
-								if ks, ok := k.(*ast.StringLiteral); ok {
-									if ks.Value == f.Name {
-										found = true
-										break
-									}
-								} else if id, ok := k.(*ast.Identifier); ok {
-									if id.Value == f.Name {
-										found = true
-										break
-									}
-								}
-							}
-							if !found {
-								okMatch = false
-								break
-							}
-						}
-						if okMatch {
-							varTypes[st.Name.Value] = tname
-							break
-						}
+					if tname := ast.InferStructType(ml, typeDefs); tname != "" {
+						varTypes[st.Name.Value] = tname
 					}
 				}
 			}
@@ -98,6 +174,58 @@ func CheckProgram(program *ast.Program) []string {
 
 	// helper to check map literal against type definition
 	var checkMapAgainstType func(m *ast.MapLiteral, td *ast.TypeDefinition, path string)
+	// checkListField checks the value of a field of list type [elem]: it must
+	// be a list whose elements have type elem
+	checkListField := func(v ast.Expression, elem, path string) {
+		ll, ok := v.(*ast.ListLiteral)
+		if !ok {
+			if got := staticType(v, varTypes); got != "" {
+				errs = append(errs, errorAt(v, "%s: type mismatch, expected [%s] got %s", path, elem, got))
+			}
+			return
+		}
+		for i, el := range ll.Elements {
+			if ml, ok := el.(*ast.MapLiteral); ok {
+				if td, ok := typeDefs[elem]; ok && td.Alias == "" {
+					checkMapAgainstType(ml, td, fmt.Sprintf("%s[%d]", path, i))
+					continue
+				}
+			}
+			if got := staticType(el, varTypes); got != "" && resolveType(got) != resolveType(elem) {
+				errs = append(errs, errorAt(el, "%s[%d]: type mismatch, expected %s got %s", path, i, elem, got))
+			}
+		}
+	}
+	// checkMapField checks the value of a field of map type {key: value}: it
+	// must be a map whose keys and values have those types
+	checkMapField := func(v ast.Expression, key, value, path string) {
+		ml, ok := v.(*ast.MapLiteral)
+		if !ok {
+			if got := staticType(v, varTypes); got != "" {
+				errs = append(errs, errorAt(v, "%s: type mismatch, expected {%s: %s} got %s", path, key, value, got))
+			}
+			return
+		}
+		// ml.Pairs is a Go map; sort the errors for a stable report
+		msgs := Diagnostics{}
+		for k, val := range ml.Pairs {
+			name := k.String()
+			if _, ok := k.(*ast.Identifier); ok {
+				// a bare key such as {a: 1} is the string "a"
+				if resolveType(key) != "string" {
+					msgs = append(msgs, errorAt(k, "%s[%s]: type mismatch, expected %s key got string", path, name, key))
+				}
+			} else if got := staticType(k, varTypes); got != "" && resolveType(got) != resolveType(key) {
+				msgs = append(msgs, errorAt(k, "%s[%s]: type mismatch, expected %s key got %s", path, name, key, got))
+			}
+			if got := staticType(val, varTypes); got != "" && resolveType(got) != resolveType(value) {
+				msgs = append(msgs, errorAt(val, "%s[%s]: type mismatch, expected %s got %s", path, name, value, got))
+			}
+		}
+		sort.Slice(msgs, func(i, j int) bool { return msgs[i].Message < msgs[j].Message })
+		errs = append(errs, msgs...)
+	}
+
 	checkMapAgainstType = func(m *ast.MapLiteral, td *ast.TypeDefinition, path string) {
 		// build map of provided keys
 		provided := map[string]ast.Expression{}
@@ -111,7 +239,10 @@ func CheckProgram(program *ast.Program) []string {
 		for _, f := range td.Fields {
 			pv, ok := provided[f.Name]
 			if !ok {
-				errs = append(errs, fmt.Sprintf("%s: missing field '%s'", path, f.Name))
+				// a missing bool field is false
+				if f.Nested != nil || resolveType(f.Type) != "bool" {
+					errs = append(errs, errorAt(m, "%s: missing field '%s'", path, f.Name))
+				}
 				continue
 			}
 			// check basic type
@@ -120,22 +251,31 @@ func CheckProgram(program *ast.Program) []string {
 				if mv, ok := pv.(*ast.MapLiteral); ok {
 					checkMapAgainstType(mv, f.Nested, path+"."+f.Name)
 				} else {
-					errs = append(errs, fmt.Sprintf("%s.%s: expected nested object", path, f.Name))
+					errs = append(errs, errorAt(pv, "%s.%s: expected nested object", path, f.Name))
 				}
+			} else if elem, ok := f.ElementType(); ok {
+				checkListField(pv, elem, path+"."+f.Name)
+			} else if key, value, ok := f.MapTypes(); ok {
+				checkMapField(pv, key, value, path+"."+f.Name)
 			} else {
-				// expect simple types int/string
+				// expect simple types int/string/float/bool
 				switch val := pv.(type) {
 				case *ast.IntegerLiteral:
-					if f.Type != "int" {
-						errs = append(errs, fmt.Sprintf("%s.%s: type mismatch, expected %s got int", path, f.Name, f.Type))
+					if resolveType(f.Type) != "int" {
+						errs = append(errs, errorAt(val, "%s.%s: type mismatch, expected %s got int", path, f.Name, f.Type))
 					}
 				case *ast.StringLiteral:
-					if f.Type != "string" {
-						errs = append(errs, fmt.Sprintf("%s.%s: type mismatch, expected %s got string", path, f.Name, f.Type))
+					if resolveType(f.Type) != "string" {
+						errs = append(errs, errorAt(val, "%s.%s: type mismatch, expected %s got string", path, f.Name, f.Type))
+					}
+				case *ast.FloatLiteral:
+					if resolveType(f.Type) != "float" {
+						errs = append(errs, errorAt(val, "%s.%s: type mismatch, expected %s got float", path, f.Name, f.Type))
+					}
+				case *ast.Identifier:
+					if (val.Value == "true" || val.Value == "false") && resolveType(f.Type) != "bool" {
+						errs = append(errs, errorAt(val, "%s.%s: type mismatch, expected %s got bool", path, f.Name, f.Type))
 					}
-				default:
-					// other expression types not deeply checked here
-					_ = val
 				}
 			}
 		}
@@ -145,21 +285,51 @@ func CheckProgram(program *ast.Program) []string {
 	for _, s := range program.Statements {
 		switch st := s.(type) {
 		case *ast.LetStatement:
+			if len(st.Names) > 0 {
+				if ie, ok := st.Value.(*ast.IndexExpression); !ok || len(st.Names) != 2 {
+					errs = append(errs, errorAt(st, "%s: multi-name let is only supported as `let val, ok = m[key]`", st.Name.Value))
+				} else if kind := nonMapKind(ie.Left, lists, varTypes, resolveType); kind != "" {
+					errs = append(errs, errorAt(st, "%s: `let val, ok = m[key]` needs a map, %s is %s", st.Name.Value, ie.Left.String(), kind))
+				}
+			}
 			if st.TypeName != "" {
+				if msg := checkAnnotatedValue(st.Name.Value, st.TypeName, st.Value, varTypes, resolveType); msg != "" {
+					errs = append(errs, errorAt(st, "%s", msg))
+				}
+				if isPrimitiveType(st.TypeName) {
+					continue
+				}
+				if _, ok := collectionElementTypes(st.TypeName); ok {
+					for _, t := range unknownElementTypes(st.TypeName, typeDefs) {
+						errs = append(errs, errorAt(st, "unknown type: %s", t))
+					}
+					continue
+				}
 				td, ok := typeDefs[st.TypeName]
 				if !ok {
-					errs = append(errs, fmt.Sprintf("unknown type: %s", st.TypeName))
+					errs = append(errs, errorAt(st, "unknown type: %s", st.TypeName))
 					continue
 				}
 				if ml, ok := st.Value.(*ast.MapLiteral); ok {
 					checkMapAgainstType(ml, td, st.Name.Value)
 				}
+			} else if ml, ok := st.Value.(*ast.MapLiteral); ok && !mapNames[st.Name.Value] {
+				// a map literal inferred to be a struct must fit its fields
+				if td, ok := typeDefs[ast.InferStructType(ml, typeDefs)]; ok {
+					checkMapAgainstType(ml, td, st.Name.Value)
+				}
 			}
 		case *ast.ConstStatement:
 			if st.TypeName != "" {
+				if msg := checkAnnotatedValue(st.Name.Value, st.TypeName, st.Value, varTypes, resolveType); msg != "" {
+					errs = append(errs, errorAt(st, "%s", msg))
+				}
+				if isPrimitiveType(st.TypeName) {
+					continue
+				}
 				td, ok := typeDefs[st.TypeName]
 				if !ok {
-					errs = append(errs, fmt.Sprintf("unknown type: %s", st.TypeName))
+					errs = append(errs, errorAt(st, "unknown type: %s", st.TypeName))
 					continue
 				}
 				if ml, ok := st.Value.(*ast.MapLiteral); ok {
@@ -169,8 +339,25 @@ func CheckProgram(program *ast.Program) []string {
 		}
 	}
 
+	// names declared anywhere in the program, which a call may refer to
+	declared := map[string]bool{}
+	collectDeclaredNames(program.Statements, declared)
+
+	// errorIn returns an error at node in the let or const named ctx, whose
+	// name prefixes the message; other statements pass an empty ctx
+	errorIn := func(ctx string, node ast.Node, format string, args ...interface{}) Diagnostic {
+		d := errorAt(node, format, args...)
+		if ctx != "" {
+			d.Message = ctx + ": " + d.Message
+		}
+		return d
+	}
+
 	// traverse member access expressions to ensure fields exist
 	var checkExpr func(expr ast.Expression, ctx string)
+	// checkStmts checks the expressions of stmts, including those of switch
+	// cases and nested function bodies
+	var checkStmts func(stmts []ast.Statement, ctx string)
 	checkExpr = func(expr ast.Expression, ctx string) {
 		switch e := expr.(type) {
 		case *ast.MemberAccessExpression:
@@ -186,7 +373,7 @@ func CheckProgram(program *ast.Program) []string {
 							}
 						}
 						if !found {
-							errs = append(errs, fmt.Sprintf("%s: unknown field '%s' on type %s", ctx, e.Property.Value, vt))
+							errs = append(errs, errorIn(ctx, e, "unknown field '%s' on type %s", e.Property.Value, vt))
 						}
 					}
 				}
@@ -194,29 +381,90 @@ func CheckProgram(program *ast.Program) []string {
 			// continue deeper
 			checkExpr(e.Object, ctx)
 		case *ast.CallExpression:
+			if mae, ok := e.Function.(*ast.MemberAccessExpression); ok {
+				if obj, ok := mae.Object.(*ast.Identifier); ok && obj.Value == "server" {
+					if msg := checkServerDirective(mae.Property.Value, e.Arguments); msg != "" {
+						errs = append(errs, errorIn(ctx, e, "%s", msg))
+					}
+					if mae.Property.Value == "route" {
+						declared := func(name string) bool { _, ok := funcSigs[name]; return ok }
+						if msg := checkRouteHandler(e.Arguments, declared); msg != "" {
+							errs = append(errs, errorIn(ctx, e, "%s", msg))
+						}
+					}
+				} else if n, builtin := builtinArity[mae.Property.Value]; builtin && len(e.Arguments) != n-1 {
+					// list.map(fn): the receiver is the list argument
+					errs = append(errs, errorIn(ctx, e, "method %s expects %d args, got %d", mae.Property.Value, n-1, len(e.Arguments)))
+				}
+			}
 			// check function call against known signature if identifier
+			if ident, ok := e.Function.(*ast.Identifier); ok && ident.Value == "sleep" {
+				if _, shadowed := funcSigs["sleep"]; !shadowed {
+					if msg := checkSleep(e.Arguments, varTypes, resolveType); msg != "" {
+						errs = append(errs, errorIn(ctx, e, "%s", msg))
+					}
+				}
+			}
+			if ident, ok := e.Function.(*ast.Identifier); ok && ident.Value == "writeFile" {
+				if _, shadowed := funcSigs["writeFile"]; !shadowed {
+					if msg := checkWriteFile(e.Arguments, varTypes, resolveType); msg != "" {
+						errs = append(errs, errorIn(ctx, e, "%s", msg))
+					}
+				}
+			}
+			if ident, ok := e.Function.(*ast.Identifier); ok && ident.Value == "format" {
+				if _, shadowed := funcSigs["format"]; !shadowed {
+					if msg := checkFormat(e.Arguments, varTypes, resolveType); msg != "" {
+						errs = append(errs, errorIn(ctx, e, "%s", msg))
+					}
+				}
+			}
+			if ident, ok := e.Function.(*ast.Identifier); ok && ident.Value == "assert" {
+				if _, shadowed := funcSigs["assert"]; !shadowed {
+					if msg := checkAssert(e.Arguments, varTypes, resolveType); msg != "" {
+						errs = append(errs, errorIn(ctx, e, "%s", msg))
+					}
+				}
+			}
 			if ident, ok := e.Function.(*ast.Identifier); ok {
+				if _, sig := funcSigs[ident.Value]; !sig && !declared[ident.Value] && !isBuiltinFunction(ident.Value) {
+					errs = append(errs, errorIn(ctx, e, "unknown function '%s'", ident.Value))
+				}
+				if n, builtin := builtinArity[ident.Value]; builtin {
+					if _, shadowed := funcSigs[ident.Value]; !shadowed && len(e.Arguments) != n {
+						errs = append(errs, errorIn(ctx, e, "built-in %s expects %d args, got %d", ident.Value, n, len(e.Arguments)))
+					}
+				}
 				if sig, found := funcSigs[ident.Value]; found {
-					// arg count check
-					if len(e.Arguments) != len(sig.ParamOrder) {
-						errs = append(errs, fmt.Sprintf("%s: function %s expects %d args, got %d", ctx, ident.Value, len(sig.ParamOrder), len(e.Arguments)))
+					// arg count check; trailing parameters with defaults may be omitted
+					required := len(sig.ParamOrder) - len(sig.Defaults)
+					if len(e.Arguments) < required || len(e.Arguments) > len(sig.ParamOrder) {
+						if required == len(sig.ParamOrder) {
+							errs = append(errs, errorIn(ctx, e, "function %s expects %d args, got %d", ident.Value, len(sig.ParamOrder), len(e.Arguments)))
+						} else {
+							errs = append(errs, errorIn(ctx, e, "function %s expects %d to %d args, got %d", ident.Value, required, len(sig.ParamOrder), len(e.Arguments)))
+						}
 					} else {
-						for i, paramName := range sig.ParamOrder {
+						for i, paramName := range sig.ParamOrder[:len(e.Arguments)] {
 							ptyp := sig.Params[paramName]
+							if ptyp == "" {
+								// untyped parameter accepts anything
+								continue
+							}
 							arg := e.Arguments[i]
 							switch a := arg.(type) {
 							case *ast.IntegerLiteral:
-								if ptyp != "int" {
-									errs = append(errs, fmt.Sprintf("%s: arg %d for %s should be %s", ctx, i, ident.Value, ptyp))
+								if resolveType(ptyp) != "int" {
+									errs = append(errs, errorIn(ctx, arg, "arg %d for %s should be %s", i, ident.Value, ptyp))
 								}
 							case *ast.StringLiteral:
-								if ptyp != "string" {
-									errs = append(errs, fmt.Sprintf("%s: arg %d for %s should be %s", ctx, i, ident.Value, ptyp))
+								if resolveType(ptyp) != "string" {
+									errs = append(errs, errorIn(ctx, arg, "arg %d for %s should be %s", i, ident.Value, ptyp))
 								}
 							case *ast.Identifier:
 								if vt, ok := varTypes[a.Value]; ok {
-									if vt != ptyp {
-										errs = append(errs, fmt.Sprintf("%s: arg %d for %s: expected %s got %s", ctx, i, ident.Value, ptyp, vt))
+									if resolveType(vt) != resolveType(ptyp) {
+										errs = append(errs, errorIn(ctx, arg, "arg %d for %s: expected %s got %s", i, ident.Value, ptyp, vt))
 									}
 								}
 							}
@@ -230,30 +478,637 @@ func CheckProgram(program *ast.Program) []string {
 				checkExpr(a, ctx)
 			}
 		case *ast.IndexExpression:
+			if msg := checkIndexable(e.Left, varTypes, typeDefs, resolveType); msg != "" {
+				errs = append(errs, errorIn(ctx, e, "%s", msg))
+			}
+			checkExpr(e.Left, ctx)
+		case *ast.SliceExpression:
+			if msg := checkIndexable(e.Left, varTypes, typeDefs, resolveType); msg != "" {
+				errs = append(errs, errorIn(ctx, e, "%s", msg))
+			}
 			checkExpr(e.Left, ctx)
+		case *ast.CastExpression:
+			checkExpr(e.Value, ctx)
 		case *ast.InfixExpression:
+			if e.Operator == "in" {
+				if msg := checkMembership(e.Right, varTypes, resolveType); msg != "" {
+					errs = append(errs, errorIn(ctx, e, "%s", msg))
+				}
+			}
 			checkExpr(e.Left, ctx)
 			checkExpr(e.Right, ctx)
 		case *ast.FunctionLiteral:
-			// check body
-			for _, stmt := range e.Body.Statements {
-				if es, ok := stmt.(*ast.ExpressionStatement); ok {
-					checkExpr(es.Expression, ctx)
+			if msg := unreachableAfterReturn(e.Body); msg != "" {
+				errs = append(errs, errorIn(ctx, e, "%s", msg))
+			}
+			for _, msg := range checkParamDefaults(e, resolveType) {
+				errs = append(errs, errorIn(ctx, e, "%s", msg))
+			}
+			for _, d := range checkLoopControl(e.Body.Statements) {
+				if ctx != "" {
+					d.Message = ctx + ": " + d.Message
+				}
+				errs = append(errs, d)
+			}
+			// check body; calls in it may refer to functions declared later
+			checkStmts(e.Body.Statements, ctx)
+		}
+	}
+	checkStmts = func(stmts []ast.Statement, ctx string) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *ast.ExpressionStatement:
+				checkExpr(s.Expression, ctx)
+			case *ast.LetStatement:
+				checkExpr(s.Value, ctx)
+			case *ast.ConstStatement:
+				checkExpr(s.Value, ctx)
+			case *ast.ReturnStatement:
+				if s.ReturnValue != nil {
+					checkExpr(s.ReturnValue, ctx)
+				}
+			case *ast.CompoundAssignStatement:
+				checkExpr(s.Value, ctx)
+			case *ast.BlockStatement:
+				checkStmts(s.Statements, ctx)
+			case *ast.SwitchStatement:
+				checkExpr(s.Value, ctx)
+				cases := s.Cases
+				if s.Default != nil {
+					cases = append(cases[:len(cases):len(cases)], s.Default)
+				}
+				for _, c := range cases {
+					for _, v := range c.Values {
+						checkExpr(v, ctx)
+					}
+					checkStmts(c.Body, ctx)
 				}
 			}
 		}
 	}
 
+	errs = append(errs, checkLoopControl(program.Statements)...)
+	errs = append(errs, checkConstExpressions(program.Statements)...)
+	errs = append(errs, checkAssignments(program.Statements, map[string]string{}, resolveType)...)
+	errs = append(errs, checkGuards(program.Statements)...)
+
 	for _, s := range program.Statements {
 		switch st := s.(type) {
-		case *ast.ExpressionStatement:
-			checkExpr(st.Expression, "<expr>")
 		case *ast.LetStatement:
 			checkExpr(st.Value, st.Name.Value)
 		case *ast.ConstStatement:
 			checkExpr(st.Value, st.Name.Value)
+		default:
+			checkStmts([]ast.Statement{s}, "")
+		}
+	}
+
+	return errs
+}
+
+// checkConstExpressions evaluates the top-level consts the way codegen folds
+// them and reports divisions by zero.
+func checkConstExpressions(stmts []ast.Statement) Diagnostics {
+	errs := Diagnostics{}
+	consts := map[string]eval.Value{}
+	for _, stmt := range stmts {
+		cs, ok := stmt.(*ast.ConstStatement)
+		if !ok {
+			continue
+		}
+		v, err := eval.Eval(cs.Value, consts)
+		if err == eval.ErrDivisionByZero {
+			errs = append(errs, errorAt(cs, "%s: division by zero in constant expression", cs.Name.Value))
+		}
+		if err == nil {
+			consts[cs.Name.Value] = v
 		}
 	}
+	return errs
+}
 
+// checkGuards checks the conditions of `when` modifiers: a guard is `true`,
+// `false` or the name of a top-level const, so whether a statement runs is
+// fixed when the program starts.
+func checkGuards(stmts []ast.Statement) Diagnostics {
+	errs := Diagnostics{}
+	consts := map[string]bool{}
+	for _, stmt := range stmts {
+		if cs, ok := stmt.(*ast.ConstStatement); ok {
+			consts[cs.Name.Value] = true
+		}
+	}
+	for _, stmt := range stmts {
+		es, ok := stmt.(*ast.ExpressionStatement)
+		if !ok || es.Guard == nil {
+			continue
+		}
+		if id, ok := es.Guard.(*ast.Identifier); ok && (id.Value == "true" || id.Value == "false" || consts[id.Value]) {
+			continue
+		}
+		errs = append(errs, errorAt(es, "when guard must be a const or true/false, got %s", es.Guard.String()))
+	}
 	return errs
 }
+
+// constMarker marks constants in the scopes of checkAssignments.
+const constMarker = "const"
+
+// checkAssignments checks that compound assignments in stmts update a
+// declared int variable. outer maps the names visible from the enclosing
+// scope to their type, "" when unknown. Function bodies are checked with
+// their parameters added.
+func checkAssignments(stmts []ast.Statement, outer map[string]string, resolveType func(string) string) Diagnostics {
+	errs := Diagnostics{}
+	scope := map[string]string{}
+	for k, v := range outer {
+		scope[k] = v
+	}
+	var checkFunctions func(expr ast.Expression)
+	checkFunctions = func(expr ast.Expression) {
+		switch e := expr.(type) {
+		case *ast.FunctionLiteral:
+			inner := map[string]string{}
+			for k, v := range scope {
+				inner[k] = v
+			}
+			for _, p := range e.Parameters {
+				inner[p.Value] = e.ParamTypes[p.Value]
+			}
+			errs = append(errs, checkAssignments(e.Body.Statements, inner, resolveType)...)
+		case *ast.CallExpression:
+			for _, a := range e.Arguments {
+				checkFunctions(a)
+			}
+		}
+	}
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.LetStatement:
+			t := s.TypeName
+			if t == "" {
+				switch s.Value.(type) {
+				case *ast.IntegerLiteral:
+					t = "int"
+				case *ast.FloatLiteral:
+					t = "float"
+				case *ast.StringLiteral:
+					t = "string"
+				}
+			}
+			for _, n := range append([]*ast.Identifier{s.Name}, s.Names...) {
+				scope[n.Value] = t
+			}
+			checkFunctions(s.Value)
+		case *ast.ConstStatement:
+			scope[s.Name.Value] = constMarker
+		case *ast.ExpressionStatement:
+			checkFunctions(s.Expression)
+		case *ast.ReturnStatement:
+			checkFunctions(s.ReturnValue)
+		case *ast.CompoundAssignStatement:
+			name := s.Name.Value
+			t, declared := scope[name]
+			switch {
+			case !declared:
+				errs = append(errs, errorAt(s, "cannot assign to undeclared variable %s", name))
+			case t == constMarker:
+				errs = append(errs, errorAt(s, "cannot assign to constant %s", name))
+			case t == "":
+				errs = append(errs, errorAt(s, "%s needs an int variable, %s is untyped", s.Operator, name))
+			case resolveType(t) != "int":
+				errs = append(errs, errorAt(s, "%s needs an int variable, %s is %s", s.Operator, name, t))
+			}
+		}
+	}
+	return errs
+}
+
+// checkLoopControl reports break and continue statements among stmts. The
+// language has no loops yet, so the only valid use is a break ending a
+// switch case. Function bodies are checked separately since loop control
+// cannot cross a function boundary.
+func checkLoopControl(stmts []ast.Statement) Diagnostics {
+	errs := Diagnostics{}
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.BreakStatement, *ast.ContinueStatement:
+			errs = append(errs, errorAt(s, "%s outside of a loop", s.TokenLiteral()))
+		case *ast.SwitchStatement:
+			cases := s.Cases
+			if s.Default != nil {
+				cases = append(cases[:len(cases):len(cases)], s.Default)
+			}
+			for _, c := range cases {
+				for _, cs := range c.Body {
+					if _, ok := cs.(*ast.BreakStatement); ok {
+						continue
+					}
+					errs = append(errs, checkLoopControl([]ast.Statement{cs})...)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkParamDefaults validates default parameter values. Defaults are filled
+// in at call sites of named functions, so they must be literals, match the
+// parameter's type and only appear on trailing parameters.
+func checkParamDefaults(fl *ast.FunctionLiteral, resolveType func(string) string) []string {
+	if len(fl.Defaults) == 0 {
+		return nil
+	}
+	errs := []string{}
+	if fl.Name == nil {
+		errs = append(errs, "default parameter values require a named function")
+	}
+	seenDefault := false
+	for _, p := range fl.Parameters {
+		d, ok := fl.Defaults[p.Value]
+		if !ok {
+			if seenDefault {
+				errs = append(errs, fmt.Sprintf("parameter %s without default follows a parameter with a default", p.Value))
+			}
+			continue
+		}
+		seenDefault = true
+		var got string
+		switch d.(type) {
+		case *ast.IntegerLiteral:
+			got = "int"
+		case *ast.FloatLiteral:
+			got = "float"
+		case *ast.StringLiteral:
+			got = "string"
+		default:
+			errs = append(errs, fmt.Sprintf("default value of parameter %s must be a literal", p.Value))
+			continue
+		}
+		if want, typed := fl.ParamTypes[p.Value]; typed && resolveType(want) != got {
+			errs = append(errs, fmt.Sprintf("default value of parameter %s should be %s, got %s", p.Value, want, got))
+		}
+	}
+	return errs
+}
+
+// unreachableAfterReturn reports the first statement of block that follows a
+// return at the same block level, or "" when there is none.
+func unreachableAfterReturn(block *ast.BlockStatement) string {
+	if block == nil {
+		return ""
+	}
+	for i, stmt := range block.Statements {
+		if _, ok := stmt.(*ast.ReturnStatement); !ok || i == len(block.Statements)-1 {
+			continue
+		}
+		next := block.Statements[i+1]
+		if line := ast.LineOf(next); line > 0 {
+			return fmt.Sprintf("unreachable code after return at line %d", line)
+		}
+		return "unreachable code after return"
+	}
+	return ""
+}
+
+// checkRouteHandler validates the arguments of server.route(path, handler):
+// the handler is a function literal or the name of a declared function.
+func checkRouteHandler(args []ast.Expression, declared func(name string) bool) string {
+	if len(args) != 2 {
+		return fmt.Sprintf("server.route expects 2 args, got %d", len(args))
+	}
+	switch h := args[1].(type) {
+	case *ast.FunctionLiteral:
+		return ""
+	case *ast.Identifier:
+		if declared(h.Value) {
+			return ""
+		}
+		return fmt.Sprintf("server.route handler %s is not a declared function", h.Value)
+	}
+	return fmt.Sprintf("server.route handler must be a function, got %s", args[1].String())
+}
+
+// checkServerDirective validates the arguments of server configuration
+// directives and returns an error message, or "" when they are valid.
+func checkServerDirective(name string, args []ast.Expression) string {
+	switch name {
+	case "logFormat":
+		if len(args) != 1 {
+			return fmt.Sprintf("server.logFormat expects 1 arg, got %d", len(args))
+		}
+		if _, ok := args[0].(*ast.StringLiteral); !ok {
+			return "server.logFormat expects a string literal"
+		}
+	case "maxBodySize":
+		if len(args) != 1 {
+			return fmt.Sprintf("server.maxBodySize expects 1 arg, got %d", len(args))
+		}
+		if il, ok := args[0].(*ast.IntegerLiteral); !ok || il.Value <= 0 {
+			return "server.maxBodySize expects a positive integer literal"
+		}
+	case "recover":
+		if len(args) != 1 {
+			return fmt.Sprintf("server.recover expects 1 arg, got %d", len(args))
+		}
+		if ident, ok := args[0].(*ast.Identifier); !ok || (ident.Value != "true" && ident.Value != "false") {
+			return "server.recover expects true or false"
+		}
+	}
+	return ""
+}
+
+// checkIndexable reports indexing or slicing a variable known to hold an
+// int, a bool or a struct; strings, lists and maps can be indexed.
+func checkIndexable(left ast.Expression, varTypes map[string]string, typeDefs map[string]*ast.TypeDefinition, resolveType func(string) string) string {
+	id, ok := left.(*ast.Identifier)
+	if !ok {
+		return ""
+	}
+	vt, known := varTypes[id.Value]
+	if !known {
+		return ""
+	}
+	switch resolveType(vt) {
+	case "int", "bool":
+		return fmt.Sprintf("cannot index %s of type %s", id.Value, vt)
+	}
+	if td, ok := typeDefs[vt]; ok && td.Alias == "" {
+		return fmt.Sprintf("cannot index %s of type %s", id.Value, vt)
+	}
+	return ""
+}
+
+// nonMapKind describes what expr is known to be when that is not a map, as
+// in "a list" or "int", for a comma-ok lookup, which only a map supports. It
+// returns "" when expr is a map or its type is not known.
+func nonMapKind(expr ast.Expression, lists map[string]bool, varTypes map[string]string, resolveType func(string) string) string {
+	switch e := expr.(type) {
+	case *ast.ListLiteral:
+		return "a list"
+	case *ast.StringLiteral:
+		return "a string"
+	case *ast.Identifier:
+		if lists[e.Value] {
+			return "a list"
+		}
+	}
+	t := staticType(expr, varTypes)
+	if t == "" {
+		return ""
+	}
+	resolved := resolveType(t)
+	if _, ok := ast.ListElementType(resolved); ok {
+		return "a list"
+	}
+	if _, _, ok := ast.ArrayType(resolved); ok {
+		return "an array"
+	}
+	if _, _, ok := ast.MapElementTypes(resolved); ok {
+		return ""
+	}
+	return t
+}
+
+// checkMembership validates the right operand of `x in c`: c must be a list
+// or a map, as far as its type is known.
+func checkMembership(right ast.Expression, varTypes map[string]string, resolveType func(string) string) string {
+	switch right.(type) {
+	case *ast.ListLiteral, *ast.MapLiteral:
+		return ""
+	}
+	t := staticType(right, varTypes)
+	if t == "" {
+		return ""
+	}
+	if _, ok := collectionElementTypes(resolveType(t)); ok {
+		return ""
+	}
+	return fmt.Sprintf("in expects a list or map on the right, got %s", t)
+}
+
+// checkAssert validates assert(cond) and assert(cond, message): cond must be
+// bool and the message a string, as far as their types are known.
+func checkAssert(args []ast.Expression, varTypes map[string]string, resolveType func(string) string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Sprintf("assert expects 1 or 2 args, got %d", len(args))
+	}
+	if t := staticType(args[0], varTypes); t != "" && resolveType(t) != "bool" {
+		return fmt.Sprintf("assert condition must be bool, got %s", t)
+	}
+	if len(args) == 2 {
+		if t := staticType(args[1], varTypes); t != "" && resolveType(t) != "string" {
+			return fmt.Sprintf("assert message must be string, got %s", t)
+		}
+	}
+	return ""
+}
+
+// checkSleep validates sleep(ms): a single int number of milliseconds.
+func checkSleep(args []ast.Expression, varTypes map[string]string, resolveType func(string) string) string {
+	if len(args) != 1 {
+		return fmt.Sprintf("sleep expects 1 args, got %d", len(args))
+	}
+	if t := staticType(args[0], varTypes); t != "" && resolveType(t) != "int" {
+		return fmt.Sprintf("sleep expects a number of milliseconds, got %s", t)
+	}
+	return ""
+}
+
+// checkWriteFile validates writeFile(path, contents): both are strings.
+func checkWriteFile(args []ast.Expression, varTypes map[string]string, resolveType func(string) string) string {
+	if len(args) != 2 {
+		return fmt.Sprintf("writeFile expects 2 args, got %d", len(args))
+	}
+	if t := staticType(args[1], varTypes); t != "" && resolveType(t) != "string" {
+		return fmt.Sprintf("writeFile contents must be string, got %s", t)
+	}
+	return ""
+}
+
+// checkFormat validates format(spec, values...): the spec is a string.
+func checkFormat(args []ast.Expression, varTypes map[string]string, resolveType func(string) string) string {
+	if len(args) == 0 {
+		return "format expects a format string, got no args"
+	}
+	if t := staticType(args[0], varTypes); t != "" && resolveType(t) != "string" {
+		return fmt.Sprintf("format expects a format string first, got %s", t)
+	}
+	return ""
+}
+
+// checkAnnotatedValue reports a let or const whose value has a known scalar
+// type that differs from the annotation, as in `let x: int = "hello"`.
+func checkAnnotatedValue(name, typeName string, value ast.Expression, varTypes map[string]string, resolveType func(string) string) string {
+	got := staticType(value, varTypes)
+	if got == "" || resolveType(got) == resolveType(typeName) {
+		return ""
+	}
+	return fmt.Sprintf("%s: cannot use %s value as %s", name, got, typeName)
+}
+
+// staticType returns the type of expr when it is evident from literals and
+// declared variable types, or "" when unknown.
+func staticType(expr ast.Expression, varTypes map[string]string) string {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral:
+		return "int"
+	case *ast.FloatLiteral:
+		return "float"
+	case *ast.StringLiteral:
+		return "string"
+	case *ast.Identifier:
+		if e.Value == "true" || e.Value == "false" {
+			return "bool"
+		}
+		return varTypes[e.Value]
+	case *ast.InfixExpression:
+		switch e.Operator {
+		case "<", ">", "<=", ">=", "==", "!=", "&&", "in":
+			return "bool"
+		}
+	case *ast.CastExpression:
+		return e.Type
+	}
+	return ""
+}
+
+// builtinArity lists the argument counts of the list built-ins; reduce takes
+// the list, a callback fn(acc, item) and the initial accumulator.
+var builtinArity = map[string]int{
+	"map":    2,
+	"filter": 2,
+	"reduce": 3,
+}
+
+// builtinFunctions lists the functions callable without a declaration: the
+// built-ins lowered by codegen, and the Go built-ins and conversions, which
+// are passed through to the generated code as written.
+var builtinFunctions = map[string]bool{
+	"print": true, "format": true, "env": true, "sleep": true,
+	"readFile": true, "writeFile": true, "assert": true,
+	"status": true, "respond": true, "html": true, "render": true,
+
+	"append": true, "cap": true, "clear": true, "close": true, "complex": true,
+	"copy": true, "delete": true, "imag": true, "len": true, "make": true,
+	"max": true, "min": true, "new": true, "panic": true, "real": true,
+	"recover": true,
+
+	"bool": true, "byte": true, "rune": true, "string": true, "error": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+	"uintptr": true, "float32": true, "float64": true,
+	"complex64": true, "complex128": true,
+}
+
+// isBuiltinFunction reports whether name is a built-in function.
+func isBuiltinFunction(name string) bool {
+	_, list := builtinArity[name]
+	return list || builtinFunctions[name]
+}
+
+// collectDeclaredNames adds to names every let, const, function and
+// parameter name declared in stmts, at any depth. Scopes are not told apart,
+// so a call only counts as unknown when nothing by its name exists.
+func collectDeclaredNames(stmts []ast.Statement, names map[string]bool) {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.LetStatement:
+			names[s.Name.Value] = true
+			for _, n := range s.Names {
+				names[n.Value] = true
+			}
+			collectExprNames(s.Value, names)
+		case *ast.ConstStatement:
+			names[s.Name.Value] = true
+			collectExprNames(s.Value, names)
+		case *ast.ReturnStatement:
+			collectExprNames(s.ReturnValue, names)
+		case *ast.CompoundAssignStatement:
+			collectExprNames(s.Value, names)
+		case *ast.ExpressionStatement:
+			collectExprNames(s.Expression, names)
+		case *ast.SwitchStatement:
+			for _, c := range append(s.Cases[:len(s.Cases):len(s.Cases)], s.Default) {
+				if c != nil {
+					collectDeclaredNames(c.Body, names)
+				}
+			}
+		}
+	}
+}
+
+// collectExprNames adds the names declared by the function literals within
+// expr to names.
+func collectExprNames(expr ast.Expression, names map[string]bool) {
+	switch e := expr.(type) {
+	case *ast.FunctionLiteral:
+		if e.Name != nil {
+			names[e.Name.Value] = true
+		}
+		for _, p := range e.Parameters {
+			names[p.Value] = true
+		}
+		collectDeclaredNames(e.Body.Statements, names)
+	case *ast.CallExpression:
+		collectExprNames(e.Function, names)
+		for _, a := range e.Arguments {
+			collectExprNames(a, names)
+		}
+	case *ast.InfixExpression:
+		collectExprNames(e.Left, names)
+		collectExprNames(e.Right, names)
+	case *ast.ListLiteral:
+		for _, el := range e.Elements {
+			collectExprNames(el, names)
+		}
+	case *ast.MapLiteral:
+		for _, v := range e.Pairs {
+			collectExprNames(v, names)
+		}
+	case *ast.TryExpression:
+		collectExprNames(e.Call, names)
+	case *ast.CastExpression:
+		collectExprNames(e.Value, names)
+	}
+}
+
+// collectionElementTypes returns the element type of a list annotation `[T]`
+// or an array annotation `[T; N]`, or the key and value types of a map
+// annotation `{K: V}`.
+func collectionElementTypes(t string) ([]string, bool) {
+	if elem, ok := ast.ListElementType(t); ok {
+		return []string{elem}, true
+	}
+	if elem, _, ok := ast.ArrayType(t); ok {
+		return []string{elem}, true
+	}
+	if key, value, ok := ast.MapElementTypes(t); ok {
+		return []string{key, value}, true
+	}
+	return nil, false
+}
+
+// unknownElementTypes returns the element types of the list or map type t,
+// at any depth, that are neither primitive nor defined.
+func unknownElementTypes(t string, typeDefs map[string]*ast.TypeDefinition) []string {
+	unknown := []string{}
+	elems, _ := collectionElementTypes(t)
+	for _, e := range elems {
+		if _, nested := collectionElementTypes(e); nested {
+			unknown = append(unknown, unknownElementTypes(e, typeDefs)...)
+		} else if !isPrimitiveType(e) && typeDefs[e] == nil {
+			unknown = append(unknown, e)
+		}
+	}
+	return unknown
+}
+
+// isPrimitiveType reports whether t is a built-in scalar type.
+func isPrimitiveType(t string) bool {
+	switch t {
+	case "int", "float", "string", "bool":
+		return true
+	}
+	return false
+}
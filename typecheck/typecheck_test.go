@@ -1,8 +1,10 @@
 package typecheck
 
 import (
+	"fmt"
 	"pisuke/lexer"
 	"pisuke/parser"
+	"strings"
 	"testing"
 )
 
@@ -16,7 +18,7 @@ print(u.name.n)`
 	if len(p.Errors) != 0 {
 		t.Fatalf("parser errors: %v", p.Errors)
 	}
-	errs := CheckProgram(program)
+	errs := CheckProgram(program).Strings()
 	if len(errs) != 0 {
 		t.Fatalf("typecheck errors: %v", errs)
 	}
@@ -31,8 +33,722 @@ let u:User = { "id": 1 }`
 	if len(p.Errors) != 0 {
 		t.Fatalf("parser errors: %v", p.Errors)
 	}
-	errs := CheckProgram(program)
+	errs := CheckProgram(program).Strings()
 	if len(errs) == 0 {
 		t.Fatalf("expected missing field error, got none")
 	}
 }
+
+func TestListTypedFields(t *testing.T) {
+	src := `type Tag = { name: string }
+type Todo = { title: string, tags: [string], labels: [Tag] }
+let ok: Todo = { "title": "a", "tags": ["x", "y"], "labels": [{ "name": "home" }] }
+let bad: Todo = { "title": "b", "tags": ["x", 2], "labels": [{ "label": "home" }] }
+let scalar: Todo = { "title": "c", "tags": "x", "labels": [] }`
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	got := strings.Join(CheckProgram(program).Strings(), "\n")
+	for _, want := range []string{
+		"bad.tags[1]: type mismatch, expected string got int",
+		"bad.labels[0]: missing field 'name'",
+		"scalar.tags: type mismatch, expected [string] got string",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "ok.") {
+		t.Errorf("unexpected error for a valid value:\n%s", got)
+	}
+}
+
+func TestMapTypedFields(t *testing.T) {
+	src := `type Config = { name: string, env: {string: string} }
+let ok: Config = { "name": "a", "env": { "HOME": "/root", mode: "dev" } }
+let bad: Config = { "name": "b", "env": { "HOME": 1, 2: "x" } }
+let scalar: Config = { "name": "c", "env": "x" }`
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	got := strings.Join(CheckProgram(program).Strings(), "\n")
+	for _, want := range []string{
+		"bad.env[HOME]: type mismatch, expected string got int",
+		"bad.env[2]: type mismatch, expected string key got int",
+		"scalar.env: type mismatch, expected {string: string} got string",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "ok.") {
+		t.Errorf("unexpected error for a valid value:\n%s", got)
+	}
+}
+
+func TestBoolFields(t *testing.T) {
+	src := `type Flag = bool
+type Todo = { title: string, done: Flag, meta: { pinned: bool } }
+let ready = 1 < 2
+let ok: Todo = { title: "a", done: ready, meta: { pinned: false } }
+let bad: Todo = { title: "b", done: "true", meta: { pinned: 1 } }
+let swapped: Todo = { title: true, done: false, meta: { pinned: true } }
+let later: Todo = { title: "c", meta: {} }
+let untitled: Todo = { done: true, meta: {} }`
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"bad.done: type mismatch, expected Flag got string",
+		"bad.meta.pinned: type mismatch, expected bool got int",
+		"swapped.title: type mismatch, expected string got bool",
+		// missing bool fields are false, other fields are required
+		"untitled: missing field 'title'",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestTypeAliasIsInterchangeable(t *testing.T) {
+	src := `type Id = int
+type User = { id: Id, name: string }
+fn find(id: Id): string { return "x" }
+let u:User = { "id": 1, "name": "Alice" }
+find(1)`
+	l := lexer.New(src)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 0 {
+		t.Fatalf("typecheck errors: %v", errs)
+	}
+}
+
+func TestTypeAliasMismatch(t *testing.T) {
+	src := `type Id = int
+fn find(id: Id): string { return "x" }
+find("1")`
+	l := lexer.New(src)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error for string passed as Id, got %v", errs)
+	}
+}
+
+func TestListBuiltinArity(t *testing.T) {
+	src := `let total = reduce(nums, fn(acc, x) { return acc })`
+	l := lexer.New(src)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 arity error, got %v", errs)
+	}
+}
+
+func TestLogFormatRequiresStringLiteral(t *testing.T) {
+	src := `let f = "{path}"
+server.logFormat(f)`
+	l := lexer.New(src)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+}
+
+func TestMaxBodySizeValidation(t *testing.T) {
+	tests := []struct {
+		src      string
+		wantErrs int
+	}{
+		{`server.maxBodySize(2048)`, 0},
+		{`server.maxBodySize(0)`, 1},
+		{`server.maxBodySize("1MB")`, 1},
+		{`server.maxBodySize()`, 1},
+	}
+	for _, tt := range tests {
+		l := lexer.New(tt.src)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		if len(p.Errors) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors)
+		}
+		if errs := CheckProgram(program).Strings(); len(errs) != tt.wantErrs {
+			t.Errorf("%s: expected %d errors, got %v", tt.src, tt.wantErrs, errs)
+		}
+	}
+}
+
+func TestUnreachableCodeAfterReturn(t *testing.T) {
+	src := `fn greet(name: string): string {
+	return name
+	print("never")
+}
+let f = fn() { return 1 }`
+	l := lexer.New(src)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	if !strings.Contains(errs[0], "unreachable code after return at line 3") {
+		t.Errorf("unexpected error: %s", errs[0])
+	}
+}
+
+func TestMultiNameLetRequiresIndex(t *testing.T) {
+	src := `fn f() {}
+let a, b = f()`
+	l := lexer.New(src)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	if errs := CheckProgram(program).Strings(); len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+}
+
+func TestUnknownFunction(t *testing.T) {
+	src := `fn double(x: int): int { return x * 2 }
+let f = double
+let apply = fn(g, x) { return g(x) }
+print(len("ab"), format("%d", f(1)), apply(double, 2))
+let n = tripel(3)
+fn run() {
+	missing()
+}
+let b = [104, 105]
+let xs = append([1, 2], 3)
+print(string(b), int(2), cap(xs))
+fn body() {
+	let y = nope(1)
+	const z = gone()
+	print(y, z)
+}
+let x: int = 1
+switch x {
+case 1:
+	absent(1)
+default:
+	print(x)
+}
+x += lost(3)
+fn inner(v: int) {
+	switch v {
+	case 1:
+		hidden()
+	}
+	v += vanished()
+}`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"n: unknown function 'tripel'",
+		"unknown function 'missing'",
+		"unknown function 'nope'",
+		"unknown function 'gone'",
+		"unknown function 'absent'",
+		"unknown function 'lost'",
+		"unknown function 'hidden'",
+		"unknown function 'vanished'",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestForwardReferences(t *testing.T) {
+	src := `let n = later(1, 2)
+fn first(x: int): int { return second("a") }
+fn second(s: int): int { return first(s) }
+fn later(x: int): int { return x }`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"n: function later expects 1 args, got 2",
+		"arg 0 for second should be int",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestDefaultParameters(t *testing.T) {
+	tests := []struct {
+		src      string
+		wantErrs int
+	}{
+		{`fn greet(a: string, name: string = "world") { return a }
+greet("hi")
+greet("hi", "you")`, 0},
+		{`fn greet(a: string, name: string = "world") { return a }
+greet()`, 1},
+		{`fn greet(a: string, name: string = "world") { return a }
+greet("a", "b", "c")`, 1},
+		{`fn greet(name: string = 1) { return name }`, 1},
+		{`fn greet(name = "world", a) { return name }`, 1},
+		{`let f = fn(name = "world") { return name }`, 1},
+	}
+	for _, tt := range tests {
+		l := lexer.New(tt.src)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		if len(p.Errors) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors)
+		}
+		if errs := CheckProgram(program).Strings(); len(errs) != tt.wantErrs {
+			t.Errorf("%s: expected %d errors, got %v", tt.src, tt.wantErrs, errs)
+		}
+	}
+}
+
+// withLines renders ds as "line N: message", to check the lines reported.
+func withLines(ds Diagnostics) []string {
+	msgs := make([]string, len(ds))
+	for i, d := range ds {
+		msgs[i] = fmt.Sprintf("line %d: %s", d.Line, d.Message)
+	}
+	return msgs
+}
+
+func TestLoopControlOutsideLoop(t *testing.T) {
+	src := `break
+fn f() {
+	continue
+}`
+	l := lexer.New(src)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors)
+	}
+	errs := withLines(CheckProgram(program))
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if errs[0] != "line 1: break outside of a loop" {
+		t.Errorf("unexpected error: %s", errs[0])
+	}
+	if errs[1] != "line 3: continue outside of a loop" {
+		t.Errorf("unexpected error: %s", errs[1])
+	}
+
+	// a switch case may break, but continue still needs a loop
+	program = parser.New(lexer.New("switch 1 {\ncase 1: break\ndefault: continue\n}")).ParseProgram()
+	errs = withLines(CheckProgram(program))
+	if len(errs) != 1 || errs[0] != "line 3: continue outside of a loop" {
+		t.Errorf("expected only the continue to be reported, got %v", errs)
+	}
+}
+
+func TestListMethodArity(t *testing.T) {
+	src := `let xs = [1]
+let ys = xs.map(fn(x) { return x }, 1)
+let zs = xs.filter(fn(x) { return x })`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 || !strings.Contains(errs[0], "method map expects 1 args, got 2") {
+		t.Fatalf("expected one map arity error, got %v", errs)
+	}
+}
+
+func TestConstDivisionByZero(t *testing.T) {
+	src := `const ZERO = 0
+const A = 10 / ZERO
+const B = 10 / 2`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 || errs[0] != "A: division by zero in constant expression" {
+		t.Fatalf("expected one division by zero error, got %v", errs)
+	}
+}
+
+func TestCollectionTypeAnnotations(t *testing.T) {
+	src := `type User = { name: string }
+let users: [User] = []
+let index: {string: [Missing]} = {}`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 || errs[0] != "unknown type: Missing" {
+		t.Fatalf("expected only the Missing element type to be reported, got %v", errs)
+	}
+}
+
+func TestIndexNonIndexable(t *testing.T) {
+	src := `let n: int = 5
+let count = 3
+let s = "abc"
+let a = n[0]
+let b = count[1:]
+let c = s[0]`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"a: cannot index n of type int",
+		"b: cannot index count of type int",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestRouteHandlerMustBeFunction(t *testing.T) {
+	src := `fn hello() { return "hi" }
+server.route("/a", hello)
+server.route("/b", fn() { return "b" })
+server.route("/c", 42)
+server.route("/d", missing)`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"server.route handler must be a function, got 42",
+		"server.route handler missing is not a declared function",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestCompoundAssignTargets(t *testing.T) {
+	src := `let i = 0
+let name = "x"
+const LIMIT = 10
+i += 1
+name += "y"
+LIMIT -= 1
+missing *= 2
+fn scale(n: int, m) {
+	n *= 2
+	m += 1
+}`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := withLines(CheckProgram(program))
+	expected := []string{
+		"line 5: += needs an int variable, name is string",
+		"line 6: cannot assign to constant LIMIT",
+		"line 7: cannot assign to undeclared variable missing",
+		"line 10: += needs an int variable, m is untyped",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestWhenGuards(t *testing.T) {
+	src := `const ADMIN = true
+let flag = 1
+server.route("/a", fn() { return "a" }) when ADMIN
+server.route("/b", fn() { return "b" }) when false
+server.route("/c", fn() { return "c" }) when flag`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := withLines(CheckProgram(program))
+	if len(errs) != 1 || errs[0] != "line 5: when guard must be a const or true/false, got flag" {
+		t.Fatalf("expected one guard error, got %v", errs)
+	}
+}
+
+func TestAssertArguments(t *testing.T) {
+	src := `let ok = true
+let n = 1
+assert(ok)
+assert(ok, "message")
+assert(n)
+assert(ok, 2)
+assert()`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"assert condition must be bool, got int",
+		"assert message must be string, got int",
+		"assert expects 1 or 2 args, got 0",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestSleepArgument(t *testing.T) {
+	src := `let ms = 100
+sleep(ms)
+sleep("soon")
+sleep()`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"sleep expects a number of milliseconds, got string",
+		"sleep expects 1 args, got 0",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestMembershipOperand(t *testing.T) {
+	src := `let xs = [1, 2]
+let name = "pisuke"
+let n = 3
+let a = 1 in xs
+let b = "k" in {"k": 1}
+let c = "p" in name
+let d = 1 in n`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"c: in expects a list or map on the right, got string",
+		"d: in expects a list or map on the right, got int",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestCastRecordsType(t *testing.T) {
+	src := `let m = {"n": 1}
+let n = m["n"] as int
+let s: string = n
+let d = m["n"] as int
+sleep(d)`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 || errs[0] != "s: cannot use int value as string" {
+		t.Errorf("expected a mismatch for s, got %v", errs)
+	}
+}
+
+func TestInferredStructFields(t *testing.T) {
+	src := `type User = { id: int, name: string }
+let u = {"id": 1, "name": "A"}
+let extra = {"id": 1, "name": "A", "age": 3}
+print(u.age)
+print(extra.age)`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	if len(errs) != 1 || errs[0] != "unknown field 'age' on type User" {
+		t.Errorf("expected an unknown field error for u only, got %v", errs)
+	}
+
+	// the values of an inferred struct must fit its fields, and a variable
+	// indexed like a map keeps its map
+	src = `type User = { id: int, name: string }
+let bad = {id: "x", name: "A"}
+let m = {id: "y", name: "B"}
+print(m["id"], m.missing)`
+	program = parser.New(lexer.New(src)).ParseProgram()
+	errs = CheckProgram(program).Strings()
+	if len(errs) != 1 || errs[0] != "bad.id: type mismatch, expected int got string" {
+		t.Errorf("expected a type mismatch for bad only, got %v", errs)
+	}
+
+	// a map literal searched with in or copied into a map keeps its map, and
+	// a copy of a struct cannot be indexed
+	src = `type User = { id: int, name: string }
+let a = {id: 1, name: "A"}
+let b = a
+let c = {id: 2, name: "B"}
+let s: User = {id: 3, name: "C"}
+let t = s
+print(b["id"], "id" in c, t["id"])`
+	program = parser.New(lexer.New(src)).ParseProgram()
+	errs = CheckProgram(program).Strings()
+	if len(errs) != 1 || errs[0] != "cannot index t of type User" {
+		t.Errorf("expected an index error for t only, got %v", errs)
+	}
+}
+
+func TestCommaOkNeedsMap(t *testing.T) {
+	src := `let m = {"a": 1}
+let v, ok = m["a"]
+let counts: {string: int} = {}
+let c, found = counts["x"]
+let xs = [1, 2]
+let x, has = xs[0]
+let s: string = "ab"
+let ch, valid = s[0]
+let a, b = [1][0]`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"x: `let val, ok = m[key]` needs a map, xs is a list",
+		"ch: `let val, ok = m[key]` needs a map, s is string",
+		"a: `let val, ok = m[key]` needs a map, [1] is a list",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestFormatArguments(t *testing.T) {
+	src := `let n = 1
+let spec = "%d"
+let a = format(spec, n)
+let b = format(n)
+let c = format()`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"b: format expects a format string first, got int",
+		"c: format expects a format string, got no args",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestWriteFileArguments(t *testing.T) {
+	src := `let body = "hi"
+writeFile("a.txt", body)
+writeFile("a.txt", 42)
+writeFile("a.txt")`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"writeFile contents must be string, got int",
+		"writeFile expects 2 args, got 1",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestAnnotatedScalarMismatch(t *testing.T) {
+	src := `type Id = int
+type User = { name: string }
+let x: int = "hello"
+let name: string = "ok"
+let id: Id = 7
+let ready: bool = 1
+const limit: string = 10
+let u: User = "bob"`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	errs := CheckProgram(program).Strings()
+	expected := []string{
+		"x: cannot use string value as int",
+		"ready: cannot use int value as bool",
+		"limit: cannot use int value as string",
+		"u: cannot use string value as User",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%d] = %q, want %q", i, errs[i], e)
+		}
+	}
+}
+
+func TestDiagnosticPositions(t *testing.T) {
+	src := `let ok = 1
+let x: int = "hello"
+  assert(ok)`
+	program := parser.New(lexer.New(src)).ParseProgram()
+	diags := CheckProgram(program)
+	expected := []Diagnostic{
+		{Message: "x: cannot use string value as int", Severity: SeverityError, Line: 2, Column: 1},
+		{Message: "assert condition must be bool, got int", Severity: SeverityError, Line: 3, Column: 3},
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, diags)
+	}
+	for i, want := range expected {
+		if diags[i] != want {
+			t.Errorf("diags[%d] = %+v, want %+v", i, diags[i], want)
+		}
+	}
+	if got := diags.Strings(); got[0] != expected[0].Message || got[1] != expected[1].Message {
+		t.Errorf("Strings() = %q", got)
+	}
+	if SeverityError.String() != "error" || SeverityWarning.String() != "warning" {
+		t.Errorf("unexpected severity names %s, %s", SeverityError, SeverityWarning)
+	}
+}